@@ -0,0 +1,167 @@
+// Package auth validates the bearer tokens that authorize API requests.
+//
+// A Validator only accepts tokens signed with one of its keys' algorithms,
+// for the expected issuer and audience, and within their validity period
+// give or take a leeway for clock skew between servers. Each way a token can
+// fail maps to one of the errors below, which Challenge turns into a
+// WWW-Authenticate header (RFC 6750).
+//
+// Tokens issued before audiences were checked don't have one. A Validator can
+// keep accepting those signed with the secret up to a cutoff with
+// AcceptLegacy, until they expire.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultLeeway is how far the clocks of the servers issuing and validating a
+// token may disagree
+const DefaultLeeway = 30 * time.Second
+
+var (
+	ErrNoToken     = errors.New("No authorization token")
+	ErrMalformed   = errors.New("Malformed authorization token")
+	ErrSignature   = errors.New("Invalid authorization token signature")
+	ErrIssuer      = errors.New("Invalid authorization issuer")
+	ErrAudience    = errors.New("Authorization token is for another audience")
+	ErrExpired     = errors.New("Authorization token is expired")
+	ErrNotValidYet = errors.New("Authorization token is not valid yet")
+	ErrRevoked     = errors.New("Authorization token has been revoked")
+)
+
+// tokenErrors are the errors a rejected token maps to. A token can fail
+// several checks at once, so the most fundamental one wins.
+var tokenErrors = []struct {
+	cause, err error
+}{
+	{jwt.ErrTokenMalformed, ErrMalformed},
+	{jwt.ErrTokenUnverifiable, ErrSignature},
+	{jwt.ErrTokenSignatureInvalid, ErrSignature},
+	{jwt.ErrTokenInvalidIssuer, ErrIssuer},
+	{jwt.ErrTokenInvalidAudience, ErrAudience},
+	{jwt.ErrTokenExpired, ErrExpired},
+	{jwt.ErrTokenNotValidYet, ErrNotValidYet},
+	{jwt.ErrTokenUsedBeforeIssued, ErrNotValidYet},
+}
+
+// Keys finds the key that verifies a token and lists the algorithms its keys
+// use. *keyring.Keyring implements it.
+type Keys interface {
+	Keyfunc(token *jwt.Token) (any, error)
+	Methods() []string
+}
+
+// Validator checks tokens against a set of keys
+type Validator struct {
+	keys         Keys
+	audience     string
+	leeway       time.Duration
+	legacyBefore time.Time
+	now          func() time.Time
+}
+
+// NewValidator creates a validator that accepts tokens for audience, which
+// must be set, allowing leeway either side of their validity period
+func NewValidator(keys Keys, audience string, leeway time.Duration) *Validator {
+	return &Validator{keys: keys, audience: audience, leeway: leeway, now: time.Now}
+}
+
+// AcceptLegacy makes the validator also accept tokens without an audience
+// that were signed with HS256 and issued before cutoff. A zero cutoff accepts
+// none.
+func (v *Validator) AcceptLegacy(cutoff time.Time) {
+	v.legacyBefore = cutoff
+}
+
+// Validate checks a token from issuer and decodes its claims into claims. The
+// token must expire.
+func (v *Validator) Validate(token, issuer string, claims jwt.Claims) error {
+	if len(token) == 0 {
+		return ErrNoToken
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(v.leeway),
+		jwt.WithTimeFunc(v.now),
+	}
+	_, err := jwt.ParseWithClaims(token, claims, v.keys.Keyfunc,
+		append(options, jwt.WithValidMethods(v.keys.Methods()), jwt.WithAudience(v.audience))...)
+	if errors.Is(err, jwt.ErrTokenRequiredClaimMissing) && !v.legacyBefore.IsZero() {
+		err = v.validateLegacy(token, claims, options)
+	}
+	if err == nil {
+		return nil
+	}
+	for _, e := range tokenErrors {
+		if errors.Is(err, e.cause) {
+			return e.err
+		}
+	}
+	// Required claims that are missing, or have the wrong type
+	return ErrMalformed
+}
+
+// validateLegacy checks a token that is missing a required claim, in case it
+// is a token without an audience issued before the cutoff
+func (v *Validator) validateLegacy(token string, claims jwt.Claims, options []jwt.ParserOption) error {
+	hs256 := jwt.SigningMethodHS256.Alg()
+	if !slices.Contains(v.keys.Methods(), hs256) {
+		return jwt.ErrTokenRequiredClaimMissing
+	}
+	_, err := jwt.ParseWithClaims(token, claims, v.keys.Keyfunc,
+		append(options, jwt.WithValidMethods([]string{hs256}))...)
+	if err != nil {
+		return err
+	}
+
+	// Tokens Chirpy issues always have an audience from the cutoff on
+	if aud, err := claims.GetAudience(); err != nil || len(aud) > 0 {
+		return jwt.ErrTokenInvalidAudience
+	}
+	issued, err := claims.GetIssuedAt()
+	if err != nil || issued == nil || !issued.Before(v.legacyBefore) {
+		return jwt.ErrTokenInvalidAudience
+	}
+	return nil
+}
+
+// BearerToken returns the token in a request's Authorization header, or ""
+// if it doesn't have one
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Challenge is the WWW-Authenticate header of a response rejecting a request
+// with err. Requests without a token are only told how to authenticate, and
+// the description of other errors is only included if it is one of the
+// errors above, so it can't leak details of the server.
+func Challenge(realm string, err error) string {
+	if errors.Is(err, ErrNoToken) {
+		return fmt.Sprintf(`Bearer realm="%s"`, realm)
+	}
+
+	result := fmt.Sprintf(`Bearer realm="%s", error="invalid_token"`, realm)
+	for _, known := range []error{ErrMalformed, ErrSignature, ErrIssuer, ErrAudience, ErrExpired, ErrNotValidYet, ErrRevoked} {
+		if errors.Is(err, known) {
+			result += fmt.Sprintf(`, error_description="%s"`, known)
+			break
+		}
+	}
+	return result
+}
@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/almushel/chirpy/internal/keyring"
+)
+
+const (
+	testSecret   = "secret"
+	testIssuer   = "issuer"
+	testAudience = "audience"
+)
+
+var testNow = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func testClaims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Issuer:    testIssuer,
+		Audience:  jwt.ClaimStrings{testAudience},
+		Subject:   "1",
+		IssuedAt:  jwt.NewNumericDate(testNow.Add(-time.Minute)),
+		ExpiresAt: jwt.NewNumericDate(testNow.Add(time.Hour)),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, claims jwt.Claims, key any) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidate(t *testing.T) {
+	v := NewValidator(keyring.New(testSecret, time.Hour), testAudience, DefaultLeeway)
+	v.now = func() time.Time { return testNow }
+
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name   string
+		token  func() string
+		issuer string
+		err    error
+	}{
+		{
+			name:  "valid",
+			token: func() string { return sign(t, jwt.SigningMethodHS256, testClaims(), []byte(testSecret)) },
+		},
+		{
+			name:  "no token",
+			token: func() string { return "" },
+			err:   ErrNoToken,
+		},
+		{
+			name:  "malformed",
+			token: func() string { return "not.a.token" },
+			err:   ErrMalformed,
+		},
+		{
+			name: "wrong secret",
+			token: func() string {
+				return sign(t, jwt.SigningMethodHS256, testClaims(), []byte("other"))
+			},
+			err: ErrSignature,
+		},
+		{
+			name:  "unsigned",
+			token: func() string { return sign(t, jwt.SigningMethodNone, testClaims(), jwt.UnsafeAllowNoneSignatureType) },
+			err:   ErrSignature,
+		},
+		{
+			name:  "unpinned algorithm",
+			token: func() string { return sign(t, jwt.SigningMethodHS512, testClaims(), []byte(testSecret)) },
+			err:   ErrSignature,
+		},
+		{
+			name:  "asymmetric without a key ID",
+			token: func() string { return sign(t, jwt.SigningMethodEdDSA, testClaims(), edKey) },
+			err:   ErrSignature,
+		},
+		{
+			name:   "wrong issuer",
+			token:  func() string { return sign(t, jwt.SigningMethodHS256, testClaims(), []byte(testSecret)) },
+			issuer: "other",
+			err:    ErrIssuer,
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := testClaims()
+				claims.Audience = jwt.ClaimStrings{"other"}
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+			err: ErrAudience,
+		},
+		{
+			name: "no audience",
+			token: func() string {
+				claims := testClaims()
+				claims.Audience = nil
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+			err: ErrMalformed,
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := testClaims()
+				claims.ExpiresAt = jwt.NewNumericDate(testNow.Add(-time.Minute))
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+			err: ErrExpired,
+		},
+		{
+			name: "expired within leeway",
+			token: func() string {
+				claims := testClaims()
+				claims.ExpiresAt = jwt.NewNumericDate(testNow.Add(-DefaultLeeway / 2))
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+		},
+		{
+			name: "no expiry",
+			token: func() string {
+				claims := testClaims()
+				claims.ExpiresAt = nil
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+			err: ErrMalformed,
+		},
+		{
+			name: "not before",
+			token: func() string {
+				claims := testClaims()
+				claims.NotBefore = jwt.NewNumericDate(testNow.Add(time.Minute))
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+			err: ErrNotValidYet,
+		},
+		{
+			name: "not before within leeway",
+			token: func() string {
+				claims := testClaims()
+				claims.NotBefore = jwt.NewNumericDate(testNow.Add(DefaultLeeway / 2))
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+		},
+		{
+			name: "issued in the future",
+			token: func() string {
+				claims := testClaims()
+				claims.IssuedAt = jwt.NewNumericDate(testNow.Add(time.Minute))
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+			err: ErrNotValidYet,
+		},
+		{
+			name: "issued in the future within leeway",
+			token: func() string {
+				claims := testClaims()
+				claims.IssuedAt = jwt.NewNumericDate(testNow.Add(DefaultLeeway / 2))
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+		},
+		{
+			name: "wrong claim type",
+			token: func() string {
+				claims := jwt.MapClaims{"iss": testIssuer, "aud": testAudience, "exp": "tomorrow"}
+				return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+			},
+			err: ErrMalformed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := testIssuer
+			if len(test.issuer) > 0 {
+				issuer = test.issuer
+			}
+			claims := new(jwt.RegisteredClaims)
+			err := v.Validate(test.token(), issuer, claims)
+			if err != test.err {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+			if err == nil && claims.Subject != "1" {
+				t.Fatalf("Claims weren't decoded: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestValidateKeyring(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+	key, err := keyring.ParseKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := keyring.New(testSecret, time.Hour)
+	kr.Add(key)
+	v := NewValidator(kr, testAudience, DefaultLeeway)
+	v.now = func() time.Time { return testNow }
+
+	token, _ := kr.Sign(testClaims())
+	if err = v.Validate(token, testIssuer, new(jwt.RegisteredClaims)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret can't sign for a key ID
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	forged.Header["kid"] = key.ID
+	token, _ = forged.SignedString([]byte(testSecret))
+	if err = v.Validate(token, testIssuer, new(jwt.RegisteredClaims)); err != ErrSignature {
+		t.Fatalf("Expected %v, got %v", ErrSignature, err)
+	}
+}
+
+func TestValidateLegacy(t *testing.T) {
+	v := NewValidator(keyring.New(testSecret, time.Hour), testAudience, DefaultLeeway)
+	v.now = func() time.Time { return testNow }
+	legacy := func(issued time.Time) string {
+		claims := testClaims()
+		claims.Audience = nil
+		claims.IssuedAt = jwt.NewNumericDate(issued)
+		return sign(t, jwt.SigningMethodHS256, claims, []byte(testSecret))
+	}
+	before := legacy(testNow.Add(-time.Hour))
+
+	if err := v.Validate(before, testIssuer, new(jwt.RegisteredClaims)); err != ErrMalformed {
+		t.Fatalf("Expected %v without a cutoff, got %v", ErrMalformed, err)
+	}
+
+	v.AcceptLegacy(testNow.Add(-time.Minute))
+	claims := new(jwt.RegisteredClaims)
+	if err := v.Validate(before, testIssuer, claims); err != nil || claims.Subject != "1" {
+		t.Fatalf("Token issued before the cutoff was rejected: %v", err)
+	}
+	if err := v.Validate(legacy(testNow.Add(-time.Minute)), testIssuer, new(jwt.RegisteredClaims)); err != ErrAudience {
+		t.Fatalf("Expected %v for a token issued at the cutoff, got %v", ErrAudience, err)
+	}
+	if err := v.Validate(before, "other", new(jwt.RegisteredClaims)); err != ErrIssuer {
+		t.Fatalf("Expected %v, got %v", ErrIssuer, err)
+	}
+
+	noExpiry := testClaims()
+	noExpiry.Audience, noExpiry.ExpiresAt = nil, nil
+	noExpiry.IssuedAt = jwt.NewNumericDate(testNow.Add(-time.Hour))
+	token := sign(t, jwt.SigningMethodHS256, noExpiry, []byte(testSecret))
+	if err := v.Validate(token, testIssuer, new(jwt.RegisteredClaims)); err != ErrMalformed {
+		t.Fatalf("Expected %v for a token that doesn't expire, got %v", ErrMalformed, err)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header, token string
+	}{
+		{"", ""},
+		{"Bearer abc", "abc"},
+		{"bearer abc", "abc"},
+		{"Bearer  abc ", "abc"},
+		{"Bearer", ""},
+		{"Basic abc", ""},
+		{"ApiKey abc", ""},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", test.header)
+		if token := BearerToken(r); token != test.token {
+			t.Errorf("%q: expected %q, got %q", test.header, test.token, token)
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	tests := []struct {
+		err       error
+		challenge string
+	}{
+		{ErrNoToken, `Bearer realm="chirpy"`},
+		{ErrExpired, `Bearer realm="chirpy", error="invalid_token", error_description="Authorization token is expired"`},
+		{fmt.Errorf("%w: session has ended", ErrRevoked), `Bearer realm="chirpy", error="invalid_token", error_description="Authorization token has been revoked"`},
+		{errors.New(`Internal "details"`), `Bearer realm="chirpy", error="invalid_token"`},
+	}
+
+	for _, test := range tests {
+		if challenge := Challenge("chirpy", test.err); challenge != test.challenge {
+			t.Errorf("%v: expected %s, got %s", test.err, test.challenge, challenge)
+		}
+	}
+}
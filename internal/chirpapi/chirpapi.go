@@ -1,6 +1,8 @@
 package chirpapi
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,35 +10,66 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
 
+	"github.com/almushel/chirpy/internal/auth"
 	"github.com/almushel/chirpy/internal/chirpydb"
+	"github.com/almushel/chirpy/internal/keyring"
+	"github.com/almushel/chirpy/internal/moderation"
 )
 
 type ApiConfig struct {
-	filerserverHits int
-	db              *chirpydb.DB
-	jwtSecret       string
+	filerserverHits atomic.Int64
+	db              chirpydb.Store
+	keys            *keyring.Keyring
+	audience        string
+	leeway          time.Duration
+	legacyBefore    time.Time
+	tokens          *auth.Validator
 	polkaKey        string
+	scrapeToken     string
+	filter          *moderation.Filter
+	metrics         apiMetrics
+
+	// done is closed to end long-lived streams when the server shuts down
+	done         chan struct{}
+	closeStreams sync.Once
 }
 
 const (
 	AccessIssuer  = "chirpy-access"
 	RefreshIssuer = "chirpy-refresh"
+
+	// ChirpEditWindow is how long after posting an author may edit a chirp
+	ChirpEditWindow = 15 * time.Minute
+
+	AccessTokenLifetime  = time.Hour
+	RefreshTokenLifetime = 60 * 24 * time.Hour
+
+	// DefaultAudience is the audience of Chirpy's tokens, unless another one
+	// is set with SetTokenValidation
+	DefaultAudience = "chirpy"
+	// authRealm is the realm of WWW-Authenticate challenges
+	authRealm = "chirpy"
 )
 
-func NewChirpAPI(dbPath, jwtSecret, polkaKey string) (*ApiConfig, error) {
-	var err error
-	result := new(ApiConfig)
-	result.db, err = chirpydb.NewDB(dbPath)
-	if err != nil {
-		return nil, err
+func NewChirpAPI(db chirpydb.Store, jwtSecret, polkaKey string) (*ApiConfig, error) {
+	if db == nil {
+		return nil, errors.New("No chirp database")
 	}
-	result.jwtSecret = jwtSecret
+	result := new(ApiConfig)
+	result.initMetrics()
+	result.db = chirpydb.Timed(db, result.observeDB)
+	result.keys = keyring.New(jwtSecret, RefreshTokenLifetime)
+	result.SetTokenValidation(DefaultAudience, auth.DefaultLeeway)
 	result.polkaKey = polkaKey
+	result.filter = moderation.NewFilter(moderation.DefaultWords, moderation.ActionMask)
+	result.done = make(chan struct{})
 
 	return result, nil
 }
@@ -53,55 +86,131 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 	w.Write(body)
 }
 
+// respondWithAuthError rejects a request whose token failed validation
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", auth.Challenge(authRealm, err))
+	respondWithError(w, 401, err.Error())
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.WriteHeader(code)
 	body, _ := json.Marshal(payload)
 	w.Write(body)
 }
 
+// accessClaims are the claims of the tokens Chirpy issues. Role is the user's
+// role when an access token was issued, and parseToken replaces it with their
+// current role; refresh tokens don't have one, but have an ID instead.
+// Session is the token family of the login both kinds of token descend from.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Role    string `json:"role,omitempty"`
+	Session int    `json:"sid,omitempty"`
+}
+
+// newTokenID returns a random ID for a refresh token
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+// newAccessToken issues an access token carrying the user's role
+func (cfg *ApiConfig) newAccessToken(user chirpydb.User, session int) (string, error) {
+	return cfg.keys.Sign(accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    AccessIssuer,
+			Audience:  jwt.ClaimStrings{cfg.audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenLifetime)),
+			Subject:   fmt.Sprint(user.ID),
+		},
+		Role:    user.Role,
+		Session: session,
+	})
+}
+
+// newRefreshToken issues the refresh token tokenID of a token family
+func (cfg *ApiConfig) newRefreshToken(family chirpydb.TokenFamily) (string, error) {
+	return cfg.keys.Sign(accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    RefreshIssuer,
+			Audience:  jwt.ClaimStrings{cfg.audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(RefreshTokenLifetime)),
+			Subject:   fmt.Sprint(family.UserID),
+			ID:        family.TokenID,
+		},
+		Session: family.ID,
+	})
+}
+
 func (cfg *ApiConfig) checkAuthorization(tokenString, issuer string) (id int, err error) {
-	if len(tokenString) == 0 {
-		err = errors.New("No authorization header")
-		return
-	}
+	id, _, err = cfg.checkClaims(tokenString, issuer)
+	return
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) { return []byte(cfg.jwtSecret), nil })
-	if err != nil {
-		return
+// checkClaims validates a token like checkAuthorization and also returns the
+// user's current role
+func (cfg *ApiConfig) checkClaims(tokenString, issuer string) (id int, role string, err error) {
+	claims, id, err := cfg.parseToken(tokenString, issuer)
+	if err == nil {
+		role = claims.Role
 	}
+	return
+}
 
-	i, err := token.Claims.GetIssuer()
-	if i != issuer {
-		err = errors.New("Invalid authorization issuer")
+// parseToken validates a token and returns its claims and subject. Its errors
+// are meant for respondWithAuthError.
+func (cfg *ApiConfig) parseToken(tokenString, issuer string) (claims *accessClaims, id int, err error) {
+	claims = new(accessClaims)
+	err = cfg.tokens.Validate(tokenString, issuer, claims)
+	if err != nil {
 		return
 	}
-	if i == RefreshIssuer && cfg.db.IsTokenRevoked(tokenString) {
-		err = errors.New("Refresh token has been revoked")
+	if issuer == RefreshIssuer && cfg.db.IsTokenRevoked(chirpydb.TokenKey(tokenString)) {
+		err = auth.ErrRevoked
 		return
 	}
 
-	expires, err := token.Claims.GetExpirationTime()
+	id, err = strconv.Atoi(claims.Subject)
 	if err != nil {
+		err = auth.ErrMalformed
 		return
 	}
 
-	if time.Now().After(expires.Time) {
-		err = errors.New("Authorization token is expired")
-		return
+	// Suspending a user cuts off the tokens they already have
+	user, err := cfg.db.GetUser(id)
+	if err == nil && user.IsSuspended {
+		err = errSuspended
 	}
-
-	idStr, err := token.Claims.GetSubject()
-	if err != nil {
-		return
+	// and changing their role changes what the tokens allow, so a demoted
+	// moderator can't keep moderating until their token expires
+	claims.Role = user.Role
+	// and so does ending the session they were issued for
+	if err == nil && claims.Session != 0 {
+		var session chirpydb.TokenFamily
+		session, err = cfg.db.GetTokenFamily(claims.Session)
+		if err == nil && (session.Revoked() || session.UserID != id) {
+			err = errSessionEnded
+		}
+	} else if err == nil {
+		// Tokens issued before sessions existed are only ended by logging out
+		// everywhere. Their issue time only has second precision, so tokens
+		// issued in the same second as the logout are ended too.
+		var cutoff time.Time
+		cutoff, err = cfg.db.TokensValidAfter(id)
+		if err == nil && !cutoff.IsZero() && (claims.IssuedAt == nil || !claims.IssuedAt.After(cutoff)) {
+			err = errSessionEnded
+		}
 	}
-	id, err = strconv.Atoi(idStr)
 
 	return
 }
 
 func (cfg *ApiConfig) MiddlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.filerserverHits++
+		cfg.filerserverHits.Add(1)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -118,20 +227,85 @@ func (cfg *ApiConfig) MetricsHandler(w http.ResponseWriter, r *http.Request) {
 
 </html>
 `,
-		cfg.filerserverHits)
+		cfg.filerserverHits.Load())
 	w.Write([]byte(body))
 }
 
 func (cfg *ApiConfig) ResetHandler(w http.ResponseWriter, r *http.Request) {
-	cfg.filerserverHits = 0
+	cfg.filerserverHits.Store(0)
 }
 
 func (cfg *ApiConfig) PostChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Body      string `json:"body"`
+		InReplyTo int    `json:"in_reply_to"`
+	}
+
+	id, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	var code int
+	defer func() {
+		if err != nil {
+			respondWithError(w, code, err.Error())
+		}
+	}()
+
+	params := new(parameters)
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(params)
+
+	if err != nil {
+		code = 400
+		return
+	} else if len(params.Body) > 140 {
+		code = 400
+		err = errors.New("Chirp is too long")
+		return
+	}
+	if params.InReplyTo != 0 {
+		var parent chirpydb.Chirp
+		parent, err = cfg.db.GetChirp(params.InReplyTo)
+		if err != nil || !parent.Published() {
+			err = fmt.Errorf("Chirp #%d not found", params.InReplyTo)
+			code = 400
+			return
+		}
+	}
+	body, hold, err := cfg.moderate(params.Body)
+	if err != nil {
+		code = 400
+		return
+	}
+
+	// Held chirps are accepted, but aren't public until a moderator approves them
+	create, status := cfg.db.CreateChirp, 201
+	if hold {
+		create, status = cfg.db.HoldChirp, 202
+	}
+	rb, err := create(body, id, params.InReplyTo)
+	if err != nil {
+		code = 500
+		return
+	}
+
+	respondWithJSON(w, status, rb)
+}
+
+func (cfg *ApiConfig) PutChirpsHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Body string `json:"body"`
 	}
 
-	var err error
+	id, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
 	var code int
 	defer func() {
 		if err != nil {
@@ -139,22 +313,31 @@ func (cfg *ApiConfig) PostChirpsHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}()
 
-	ts := r.Header.Get("Authorization")
-	if len(ts) < len("Bearer ") {
-		err = errors.New("No authorization header")
-		code = 401
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		err = errors.New("Invalid chirp ID")
+		code = 404
 		return
 	}
-	id, err := cfg.checkAuthorization(ts[len("Bearer "):], AccessIssuer)
+	chirp, err := cfg.db.GetChirp(chirpID)
 	if err != nil {
-		code = 401
+		code = 404
+		return
+	}
+	if chirp.AuthorID != id {
+		err = errors.New("Not authorized chirp author")
+		code = 403
+		return
+	}
+	if time.Since(chirp.CreatedAt) > ChirpEditWindow {
+		err = errors.New("Chirp can no longer be edited")
+		code = 403
 		return
 	}
 
 	params := new(parameters)
 	decoder := json.NewDecoder(r.Body)
 	err = decoder.Decode(params)
-
 	if err != nil {
 		code = 400
 		return
@@ -164,24 +347,69 @@ func (cfg *ApiConfig) PostChirpsHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	rb, err := cfg.db.CreateChirp(params.Body, id)
+	// An edit can't take a published chirp back out of view, so edits that
+	// would be held are rejected instead
+	body, hold, err := cfg.moderate(params.Body)
+	if err == nil && hold {
+		err = errBlockedWords
+	}
+	if err != nil {
+		code = 400
+		return
+	}
+
+	rb, err := cfg.db.UpdateChirp(chirpID, body)
 	if err != nil {
 		code = 500
 		return
 	}
 
-	profaneWords := [3]string{
-		"kerfuffle", "sharbert", "fornax",
+	respondWithJSON(w, 200, rb)
+}
+
+// GetThreadHandler returns the conversation around a chirp. Only the chirp
+// itself can be unpublished, if the caller wrote it: GetThread includes it but
+// leaves out the other chirps nobody else can see.
+func (cfg *ApiConfig) GetThreadHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid chirp ID")
+		return
 	}
-	for _, word := range profaneWords {
-		lower := strings.ToLower(rb.Body)
-		i := strings.Index(lower, word)
-		if i >= 0 {
-			rb.Body = rb.Body[:i] + "****" + rb.Body[i+len(word):]
-		}
+
+	chirp, err := cfg.db.GetChirp(id)
+	if err != nil || !cfg.canView(r, chirp) {
+		respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", id))
+		return
+	}
+	thread, err := cfg.db.GetThread(id)
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", id))
+		return
 	}
 
-	respondWithJSON(w, 201, rb)
+	respondWithJSON(w, 200, thread)
+}
+
+func (cfg *ApiConfig) GetChirpHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid chirp ID")
+		return
+	}
+
+	chirp, err := cfg.db.GetChirp(id)
+	if err != nil || !cfg.canView(r, chirp) {
+		respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", id))
+		return
+	}
+	history, err := cfg.db.GetChirpHistory(id)
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", id))
+		return
+	}
+
+	respondWithJSON(w, 200, history)
 }
 
 func (cfg *ApiConfig) GetChirpsHandler(w http.ResponseWriter, r *http.Request) {
@@ -189,49 +417,116 @@ func (cfg *ApiConfig) GetChirpsHandler(w http.ResponseWriter, r *http.Request) {
 	if len(idStr) > 0 {
 		id, _ := strconv.Atoi(idStr)
 		chirp, err := cfg.db.GetChirp(id)
-		if err != nil {
+		if err != nil || !cfg.canView(r, chirp) {
 			respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", id))
 			return
 		}
-		respondWithJSON(w, 200, chirp)
+		rb, err := cfg.withLikes(r, []chirpydb.Chirp{chirp})
+		if err != nil {
+			respondWithError(w, 500, "Failed to load likes")
+			return
+		}
+		respondWithJSON(w, 200, rb[0])
 		return
 	}
 
-	chirps, err := cfg.db.GetChirps()
+	var err error
+	query := r.URL.Query()
+	q := chirpydb.ChirpQuery{Desc: query.Get("sort") == "desc"}
+
+	authorIDStr := query.Get("author_id")
+	if len(authorIDStr) > 0 {
+		q.AuthorID, err = strconv.Atoi(authorIDStr)
+		if err != nil {
+			respondWithError(w, 400, "Invalid author_id")
+			return
+		}
+	}
+	limit, err := parseLimit(query.Get("limit"))
 	if err != nil {
-		respondWithError(w, 500, "Failed to load chirp database")
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	q.After, err = decodeCursor(query.Get("cursor"), q.Desc)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
 		return
 	}
 
-	sort := r.URL.Query().Get("sort")
-	if sort == "desc" {
-		for i, e := 0, len(chirps)-1; i < e; i, e = i+1, e-1 {
-			chirps[i], chirps[e] = chirps[e], chirps[i]
-		}
+	// Ask for one extra chirp to find out if there is another page
+	q.Limit = limit + 1
+	rb, err := cfg.db.ListChirps(q)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load chirp database")
+		return
+	}
+	if len(rb) > limit {
+		rb = rb[:limit]
+		last := rb[len(rb)-1]
+		setNextLink(w, r, "cursor", encodeCursor(last.Cursor(), q.Desc))
+	}
+	chirps, err := cfg.withLikes(r, rb)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load likes")
+		return
 	}
 
-	var rb []chirpydb.Chirp
-	authorIDStr := r.URL.Query().Get("author_id")
+	respondWithJSON(w, 200, chirps)
+}
+
+func (cfg *ApiConfig) SearchChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	query := r.URL.Query()
+	q := chirpydb.SearchQuery{Query: query.Get("q")}
+
+	if len(strings.TrimSpace(q.Query)) == 0 {
+		respondWithError(w, 400, "Missing search query")
+		return
+	}
+	authorIDStr := query.Get("author_id")
 	if len(authorIDStr) > 0 {
-		authorID, err := strconv.Atoi(authorIDStr)
+		q.AuthorID, err = strconv.Atoi(authorIDStr)
 		if err != nil {
 			respondWithError(w, 400, "Invalid author_id")
 			return
 		}
-		for _, chirp := range chirps {
-			if chirp.AuthorID == authorID {
-				rb = append(rb, chirp)
-			}
+	}
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	offsetStr := query.Get("offset")
+	if len(offsetStr) > 0 {
+		q.Offset, err = strconv.Atoi(offsetStr)
+		if err != nil || q.Offset < 0 {
+			respondWithError(w, 400, "Invalid offset")
+			return
 		}
-	} else {
-		rb = chirps
 	}
 
-	respondWithJSON(w, 200, rb)
+	// Results are ranked rather than chronological, so pages are by offset
+	q.Limit = limit + 1
+	rb, err := cfg.db.SearchChirps(q)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if len(rb) > limit {
+		rb = rb[:limit]
+		setNextLink(w, r, "offset", strconv.Itoa(q.Offset+limit))
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.Chirp{}, rb...))
 }
 
 func (cfg *ApiConfig) DeleteChirpsHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+	id, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
 	var code int
 	defer func() {
 		if err != nil {
@@ -239,18 +534,6 @@ func (cfg *ApiConfig) DeleteChirpsHandler(w http.ResponseWriter, r *http.Request
 		}
 	}()
 
-	ts := r.Header.Get("Authorization")
-	if len(ts) < len("Bearer ") {
-		err = errors.New("Invalid authorization header")
-		code = 401
-		return
-	}
-	id, err := cfg.checkAuthorization(ts[len("Bearer "):], AccessIssuer)
-	if err != nil {
-		code = 401
-		return
-	}
-
 	idStr := chi.URLParam(r, "chirpID")
 	if len(idStr) == 0 {
 		err = errors.New("No chirp ID param")
@@ -300,7 +583,10 @@ func (cfg *ApiConfig) PostUsersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rb, err := cfg.db.CreateUser(params.Email, params.Password)
-	if err != nil {
+	if errors.Is(err, chirpydb.ErrUserExists) {
+		respondWithError(w, 409, err.Error())
+		return
+	} else if err != nil {
 		respondWithError(w, 500, err.Error())
 		return
 	}
@@ -314,14 +600,9 @@ func (cfg *ApiConfig) PutUsersHandler(w http.ResponseWriter, r *http.Request) {
 		Email    string `json:"email"`
 	}
 
-	ts := r.Header.Get("Authorization")
-	if len(ts) < len("Bearer ") {
-		respondWithError(w, 401, "Invalid authorization header")
-		return
-	}
-	id, err := cfg.checkAuthorization(ts[len("Bearer "):], AccessIssuer)
+	id, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
 	if err != nil {
-		respondWithError(w, 401, err.Error())
+		respondWithAuthError(w, err)
 		return
 	}
 
@@ -332,9 +613,14 @@ func (cfg *ApiConfig) PutUsersHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 400, "Failed to decode request body")
 		return
 	}
-	var rb chirpydb.User
-
-	rb, err = cfg.db.UpdateUser(id, map[string]string{"email": params.Email, "password": params.Password})
+	rb, err := cfg.db.UpdateUser(id, map[string]string{"email": params.Email, "password": params.Password})
+	if errors.Is(err, chirpydb.ErrUserExists) {
+		respondWithError(w, 409, err.Error())
+		return
+	} else if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
 
 	respondWithJSON(w, 200, rb)
 }
@@ -366,29 +652,28 @@ func (cfg *ApiConfig) PostLoginHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 401, "Invalid email or password")
 		return
 	}
+	if rb.User.IsSuspended {
+		respondWithError(w, 403, errSuspended.Error())
+		return
+	}
 
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
-			Issuer:    AccessIssuer,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
-			Subject:   fmt.Sprint(rb.User.ID),
-		},
-	)
-	rToken := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
-			Issuer:    RefreshIssuer,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(60 * 24 * time.Hour)),
-			Subject:   fmt.Sprint(rb.User.ID),
-		},
-	)
+	// Each login starts a new family of refresh tokens
+	tokenID, err := newTokenID()
+	if err != nil {
+		log.Println("newTokenID()", err)
+		respondWithError(w, 500, "Token creation failed")
+		return
+	}
+	family, err := cfg.db.CreateTokenFamily(rb.User.ID, tokenID, r.UserAgent(), remoteIP(r))
+	if err != nil {
+		log.Println("CreateTokenFamily()", err)
+		respondWithError(w, 500, "Token creation failed")
+		return
+	}
 
-	rb.Token, err = token.SignedString([]byte(cfg.jwtSecret))
+	rb.Token, err = cfg.newAccessToken(rb.User, family.ID)
 	if err == nil {
-		rb.RefreshToken, err = rToken.SignedString([]byte(cfg.jwtSecret))
+		rb.RefreshToken, err = cfg.newRefreshToken(family)
 	}
 	if err != nil {
 		log.Println("token.SignedString()", err)
@@ -399,41 +684,67 @@ func (cfg *ApiConfig) PostLoginHandler(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, 200, rb)
 }
 
+// PostRefreshHandler exchanges a refresh token for a new access token and a
+// new refresh token. The old refresh token can't be used again: doing so
+// revokes every token descended from the same login.
 func (cfg *ApiConfig) PostRefreshHandler(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	ts := auth.BearerToken(r)
+	claims, id, err := cfg.parseToken(ts, RefreshIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
 	}
-	var err error
 	defer func() {
-		if err != nil {
-			respondWithError(w, 401, "Invalid authorization")
+		if errors.Is(err, auth.ErrRevoked) {
+			respondWithAuthError(w, err)
+		} else if err != nil {
+			respondWithError(w, 500, "Failed to refresh token")
 		}
 	}()
 
-	ts := r.Header.Get("Authorization")
-	if len(ts) < len("Bearer ") {
-		err = errors.New("Invalid authorization header")
+	// The new token carries the user's current role
+	user, err := cfg.db.GetUser(id)
+	if err != nil {
 		return
 	}
-	id, err := cfg.checkAuthorization(ts[len("Bearer "):], RefreshIssuer)
+	tokenID, err := newTokenID()
 	if err != nil {
 		return
 	}
 
-	var rb response
-	rToken := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
-			Issuer:    AccessIssuer,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(60 * 24 * time.Hour)),
-			Subject:   fmt.Sprint(id),
-		},
-	)
+	var family chirpydb.TokenFamily
+	if claims.Session == 0 {
+		// Tokens issued before rotation have no session. They are swapped for
+		// one that does, and can't be used again.
+		err = cfg.db.RevokeToken(chirpydb.TokenKey(ts), claims.ExpiresAt.Time)
+		if err == nil {
+			family, err = cfg.db.CreateTokenFamily(id, tokenID, r.UserAgent(), remoteIP(r))
+		}
+	} else {
+		family, err = cfg.db.RotateToken(claims.Session, claims.ID, tokenID)
+		if errors.Is(err, chirpydb.ErrTokenReused) {
+			log.Printf("Refresh token reused, revoked token family #%d of user #%d", family.ID, family.UserID)
+			err = auth.ErrRevoked
+		} else if errors.Is(err, chirpydb.ErrTokenFamilyRevoked) {
+			// The session was ended since the token was checked
+			err = errSessionEnded
+		}
+	}
+	if err != nil {
+		return
+	}
 
-	rb.Token, err = rToken.SignedString([]byte(cfg.jwtSecret))
+	var rb response
+	rb.Token, err = cfg.newAccessToken(user, family.ID)
+	if err == nil {
+		rb.RefreshToken, err = cfg.newRefreshToken(family)
+	}
 	if err != nil {
-		log.Println("(PostRefreshHandler) Creation of signed access token string failed")
+		log.Println("(PostRefreshHandler) Creation of signed token strings failed")
 		return
 	}
 
@@ -441,27 +752,38 @@ func (cfg *ApiConfig) PostRefreshHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (cfg *ApiConfig) PostRevokeHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+	ts := auth.BearerToken(r)
+	claims, _, err := cfg.parseToken(ts, RefreshIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
 	defer func() {
 		if err != nil {
-			respondWithError(w, 401, "Invalid authorization token")
+			respondWithError(w, 500, "Failed to revoke token")
 		} else {
 			respondWithJSON(w, 200, "OK")
 		}
 	}()
 
-	ts := r.Header.Get("Authorization")
-	if len(ts) < len("Bearer ") {
-		err = errors.New("Invalid authorization header")
-		return
+	// Revoking any token of a session ends the whole session
+	if claims.Session != 0 {
+		err = cfg.db.RevokeTokenFamily(claims.Session)
+	} else {
+		err = cfg.db.RevokeToken(chirpydb.TokenKey(ts), claims.ExpiresAt.Time)
 	}
-	ts = ts[len("Bearer "):]
-	_, err = cfg.checkAuthorization(ts, RefreshIssuer)
+}
+
+// RevocationsHandler reports the size of the token revocation list. Like the
+// janitor, it only counts revocations as expired once the leeway has passed.
+func (cfg *ApiConfig) RevocationsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := cfg.db.RevocationStats(time.Now().Add(-cfg.leeway))
 	if err != nil {
+		respondWithError(w, 500, "Failed to count revocations")
 		return
 	}
 
-	err = cfg.db.RevokeToken(ts)
+	respondWithJSON(w, 200, stats)
 }
 
 func (cfg *ApiConfig) PolkaWebhookHandler(w http.ResponseWriter, r *http.Request) {
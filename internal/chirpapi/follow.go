@@ -0,0 +1,128 @@
+package chirpapi
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/almushel/chirpy/internal/auth"
+	"github.com/almushel/chirpy/internal/chirpydb"
+)
+
+// followParams reads the authenticated user and the user in the URL of a
+// follow request
+func (cfg *ApiConfig) followParams(w http.ResponseWriter, r *http.Request) (followerID, followeeID int, ok bool) {
+	followerID, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	followeeID, err = strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid user ID")
+		return
+	}
+
+	return followerID, followeeID, true
+}
+
+func (cfg *ApiConfig) PostFollowHandler(w http.ResponseWriter, r *http.Request) {
+	followerID, followeeID, ok := cfg.followParams(w, r)
+	if !ok {
+		return
+	}
+	if followerID == followeeID {
+		respondWithError(w, 400, "Users can't follow themselves")
+		return
+	}
+
+	err := cfg.db.Follow(followerID, followeeID)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, "OK")
+}
+
+func (cfg *ApiConfig) DeleteFollowHandler(w http.ResponseWriter, r *http.Request) {
+	followerID, followeeID, ok := cfg.followParams(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.Unfollow(followerID, followeeID)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, "OK")
+}
+
+func (cfg *ApiConfig) GetFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid user ID")
+		return
+	}
+
+	rb, err := cfg.db.GetFollowers(id)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load followers")
+		return
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.Follow{}, rb...))
+}
+
+func (cfg *ApiConfig) GetFollowingHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid user ID")
+		return
+	}
+
+	rb, err := cfg.db.GetFollowing(id)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load followed users")
+		return
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.Follow{}, rb...))
+}
+
+// TimelineHandler lists chirps by the users the caller follows, newest first
+func (cfg *ApiConfig) TimelineHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	after, err := decodeCursor(query.Get("cursor"), true)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	rb, err := cfg.db.Timeline(id, after, limit+1)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load timeline")
+		return
+	}
+	if len(rb) > limit {
+		rb = rb[:limit]
+		setNextLink(w, r, "cursor", encodeCursor(rb[len(rb)-1].Cursor(), true))
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.Chirp{}, rb...))
+}
@@ -0,0 +1,93 @@
+package chirpapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/almushel/chirpy/internal/chirpydb"
+)
+
+const (
+	// DefaultTrendingWindow is how far back trending hashtags are counted
+	DefaultTrendingWindow = 24 * time.Hour
+	MaxTrendingWindow     = 30 * 24 * time.Hour
+	DefaultTrendingLimit  = 10
+)
+
+// GetHashtagHandler lists the chirps using a hashtag, newest first
+func (cfg *ApiConfig) GetHashtagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := chi.URLParam(r, "tag")
+	query := r.URL.Query()
+
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	after, err := decodeCursor(query.Get("cursor"), true)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	rb, err := cfg.db.ListHashtag(tag, after, limit+1)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load chirp database")
+		return
+	}
+	if len(rb) > limit {
+		rb = rb[:limit]
+		setNextLink(w, r, "cursor", encodeCursor(rb[len(rb)-1].Cursor(), true))
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.Chirp{}, rb...))
+}
+
+// TrendingHashtagsHandler lists the most used hashtags in a recent window,
+// given as a duration such as 1h or 7d
+func (cfg *ApiConfig) TrendingHashtagsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	window := DefaultTrendingWindow
+	if windowStr := query.Get("window"); len(windowStr) > 0 {
+		var err error
+		if days, ok := strings.CutSuffix(windowStr, "d"); ok {
+			var n int
+			n, err = strconv.Atoi(days)
+			// Bound the days before multiplying, since enough of them
+			// overflow into a window that looks valid
+			window = 0
+			if n > 0 && n <= int(MaxTrendingWindow/(24*time.Hour)) {
+				window = time.Duration(n) * 24 * time.Hour
+			}
+		} else {
+			window, err = time.ParseDuration(windowStr)
+		}
+		if err != nil || window <= 0 || window > MaxTrendingWindow {
+			respondWithError(w, 400, "Invalid window")
+			return
+		}
+	}
+
+	limit := DefaultTrendingLimit
+	if limitStr := query.Get("limit"); len(limitStr) > 0 {
+		var err error
+		limit, err = parseLimit(limitStr)
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+	}
+
+	rb, err := cfg.db.TrendingHashtags(time.Now().UTC().Add(-window), limit)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load chirp database")
+		return
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.HashtagCount{}, rb...))
+}
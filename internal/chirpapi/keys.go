@@ -0,0 +1,44 @@
+package chirpapi
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/almushel/chirpy/internal/auth"
+	"github.com/almushel/chirpy/internal/keyring"
+)
+
+// SetKeyring replaces the keyring tokens are signed and verified with
+func (cfg *ApiConfig) SetKeyring(kr *keyring.Keyring) {
+	cfg.keys = kr
+	cfg.newValidator()
+}
+
+// SetTokenValidation sets the audience of the tokens the server issues and
+// accepts, and how much clock skew their validity periods allow for
+func (cfg *ApiConfig) SetTokenValidation(audience string, leeway time.Duration) {
+	cfg.audience, cfg.leeway = audience, leeway
+	cfg.newValidator()
+}
+
+// SetLegacyTokenCutoff keeps accepting the tokens issued before audiences were
+// checked, which don't have one, if they were issued before cutoff. They are
+// swapped for tokens with an audience and a session when they are refreshed.
+func (cfg *ApiConfig) SetLegacyTokenCutoff(cutoff time.Time) {
+	cfg.legacyBefore = cutoff
+	cfg.newValidator()
+}
+
+func (cfg *ApiConfig) newValidator() {
+	cfg.tokens = auth.NewValidator(cfg.keys, cfg.audience, cfg.leeway)
+	cfg.tokens.AcceptLegacy(cfg.legacyBefore)
+}
+
+// JWKSHandler publishes the public keys that verify Chirpy's tokens, so other
+// services can check them without the signing secret
+func (cfg *ApiConfig) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	// Clients may cache the set, but should notice scheduled keys well
+	// before they activate
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, cfg.keys.JWKS())
+}
@@ -0,0 +1,188 @@
+package chirpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/almushel/chirpy/internal/auth"
+	"github.com/almushel/chirpy/internal/chirpydb"
+)
+
+// chirpResponse is a chirp as seen by a particular user. LikedByMe is only
+// set when the request is authenticated.
+type chirpResponse struct {
+	chirpydb.Chirp
+	LikedByMe *bool `json:"liked_by_me,omitempty"`
+}
+
+// optionalUser returns the user making the request if it carries a valid
+// access token. Requests without one are treated as anonymous.
+func (cfg *ApiConfig) optionalUser(r *http.Request) (int, bool) {
+	ts := auth.BearerToken(r)
+	if len(ts) == 0 {
+		return 0, false
+	}
+	id, err := cfg.checkAuthorization(ts, AccessIssuer)
+	return id, err == nil
+}
+
+// withLikes adds the liked_by_me flag to chirps for the requesting user
+func (cfg *ApiConfig) withLikes(r *http.Request, chirps []chirpydb.Chirp) ([]chirpResponse, error) {
+	result := make([]chirpResponse, len(chirps))
+	for i, chirp := range chirps {
+		result[i].Chirp = chirp
+	}
+
+	userID, ok := cfg.optionalUser(r)
+	if !ok {
+		return result, nil
+	}
+	ids := make([]int, len(chirps))
+	for i, chirp := range chirps {
+		ids[i] = chirp.ID
+	}
+	liked, err := cfg.db.LikedChirps(userID, ids)
+	if err != nil {
+		return result, err
+	}
+	for i := range result {
+		likedByMe := liked[result[i].ID]
+		result[i].LikedByMe = &likedByMe
+	}
+
+	return result, nil
+}
+
+// chirpAction reads the authenticated user and the chirp in the URL of a
+// like or rechirp request
+func (cfg *ApiConfig) chirpAction(w http.ResponseWriter, r *http.Request) (userID, chirpID int, ok bool) {
+	userID, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirpID, err = strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid chirp ID")
+		return
+	}
+
+	return userID, chirpID, true
+}
+
+func (cfg *ApiConfig) PostLikeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, chirpID, ok := cfg.chirpAction(w, r)
+	if !ok {
+		return
+	}
+
+	chirp, err := cfg.db.LikeChirp(chirpID, userID)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+
+	liked := true
+	respondWithJSON(w, 200, chirpResponse{Chirp: chirp, LikedByMe: &liked})
+}
+
+func (cfg *ApiConfig) DeleteLikeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, chirpID, ok := cfg.chirpAction(w, r)
+	if !ok {
+		return
+	}
+
+	chirp, err := cfg.db.UnlikeChirp(chirpID, userID)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+
+	liked := false
+	respondWithJSON(w, 200, chirpResponse{Chirp: chirp, LikedByMe: &liked})
+}
+
+func (cfg *ApiConfig) PostRechirpHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Quote string `json:"quote"`
+	}
+
+	userID, chirpID, ok := cfg.chirpAction(w, r)
+	if !ok {
+		return
+	}
+
+	// The quote is optional, so an empty body is allowed
+	params := new(parameters)
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, 400, "Failed to decode request body")
+		return
+	} else if len(params.Quote) > 140 {
+		respondWithError(w, 400, "Quote is too long")
+		return
+	}
+
+	// Quotes are filtered like chirps, but rechirps have no moderation queue,
+	// so quotes that would be held are rejected instead
+	quote, hold, err := cfg.moderate(params.Quote)
+	if err == nil && hold {
+		err = errBlockedWords
+	}
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirp, err := cfg.db.Rechirp(chirpID, userID, quote)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 201, chirp)
+}
+
+func (cfg *ApiConfig) DeleteRechirpHandler(w http.ResponseWriter, r *http.Request) {
+	userID, chirpID, ok := cfg.chirpAction(w, r)
+	if !ok {
+		return
+	}
+
+	chirp, err := cfg.db.DeleteRechirp(chirpID, userID)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, chirp)
+}
+
+// GetRechirpsHandler lists the rechirps of a chirp the caller can see
+func (cfg *ApiConfig) GetRechirpsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid chirp ID")
+		return
+	}
+
+	chirp, err := cfg.db.GetChirp(id)
+	if err != nil || !cfg.canView(r, chirp) {
+		respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", id))
+		return
+	}
+	rechirps, err := cfg.db.GetRechirps(id)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.Rechirp{}, rechirps...))
+}
@@ -0,0 +1,133 @@
+package chirpapi
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/almushel/chirpy/internal/auth"
+	"github.com/almushel/chirpy/internal/chirpydb"
+	"github.com/almushel/chirpy/internal/metrics"
+)
+
+// apiMetrics are the metrics exposed at /admin/metrics/prometheus
+type apiMetrics struct {
+	registry  *metrics.Registry
+	requests  *metrics.Counter
+	latency   *metrics.Histogram
+	dbLatency *metrics.Histogram
+}
+
+func (cfg *ApiConfig) initMetrics() {
+	reg := metrics.NewRegistry()
+	cfg.metrics = apiMetrics{
+		registry: reg,
+		requests: reg.NewCounter("chirpy_http_requests_total",
+			"HTTP requests served, by method, route and status code.", "method", "route", "code"),
+		latency: reg.NewHistogram("chirpy_http_request_duration_seconds",
+			"Time taken to serve HTTP requests, by method and route.", metrics.DefaultBuckets, "method", "route"),
+		dbLatency: reg.NewHistogram("chirpy_db_operation_duration_seconds",
+			"Time taken by database operations, by operation.", metrics.DefaultBuckets, "op"),
+	}
+	reg.CounterFunc("chirpy_fileserver_hits_total", "Requests for files under /app since the last reset.",
+		func() float64 { return float64(cfg.filerserverHits.Load()) })
+}
+
+func (cfg *ApiConfig) observeDB(op string, elapsed time.Duration) {
+	cfg.metrics.dbLatency.Observe(elapsed.Seconds(), op)
+}
+
+// statusRecorder remembers the status code a handler responded with. It
+// passes flushing and hijacking through for event streams and WebSockets.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response does not support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// MiddlewareMetrics records the count, status codes and latency of requests
+// by the route pattern they matched, so IDs in paths don't create new series
+func (cfg *ApiConfig) MiddlewareMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && len(rctx.RoutePattern()) > 0 {
+			route = rctx.RoutePattern()
+		}
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		cfg.metrics.requests.Inc(r.Method, route, strconv.Itoa(sr.status))
+		cfg.metrics.latency.Observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+// PrometheusHandler serves the metrics in the Prometheus text format
+func (cfg *ApiConfig) PrometheusHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.metrics.registry.Handler().ServeHTTP(w, r)
+}
+
+// SetScrapeToken sets a static bearer token that scrapers can read the
+// metrics with, so they don't need an admin's access token, which expires.
+// An empty token only lets admins read them.
+func (cfg *ApiConfig) SetScrapeToken(token string) {
+	cfg.scrapeToken = token
+}
+
+// RequireScraper only lets requests through that carry the scrape token or
+// an admin's access token
+func (cfg *ApiConfig) RequireScraper(next http.Handler) http.Handler {
+	admin := cfg.RequireRole(chirpydb.RoleAdmin)(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := auth.BearerToken(r)
+		if len(cfg.scrapeToken) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.scrapeToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		admin.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,241 @@
+package chirpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/almushel/chirpy/internal/chirpydb"
+	"github.com/almushel/chirpy/internal/moderation"
+)
+
+// MaxReportReason is the longest reason a user can give for a report
+const MaxReportReason = 500
+
+var errBlockedWords = errors.New("Chirp contains blocked words")
+
+// SetFilter replaces the filter new and edited chirps are checked against
+func (cfg *ApiConfig) SetFilter(f *moderation.Filter) {
+	cfg.filter = f
+}
+
+// moderate checks a chirp body against the filter and returns the body to
+// store. hold is set if the chirp has to wait for a moderator.
+func (cfg *ApiConfig) moderate(body string) (result string, hold bool, err error) {
+	check := cfg.filter.Check(body)
+	if !check.Blocked() {
+		return body, false, nil
+	}
+
+	switch cfg.filter.Action() {
+	case moderation.ActionReject:
+		return "", false, errBlockedWords
+	case moderation.ActionHold:
+		// Moderators review what the author actually wrote
+		return body, true, nil
+	}
+	return check.Body, false, nil
+}
+
+// canView reports whether the requester may see a chirp. Chirps that aren't
+// published are only visible to their author.
+func (cfg *ApiConfig) canView(r *http.Request, chirp chirpydb.Chirp) bool {
+	if chirp.Published() {
+		return true
+	}
+	id, ok := cfg.optionalUser(r)
+	return ok && id == chirp.AuthorID
+}
+
+var errSuspended = errors.New("Account is suspended")
+
+// PostReportHandler reports a chirp to the moderators
+func (cfg *ApiConfig) PostReportHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Reason string `json:"reason"`
+	}
+
+	userID, chirpID, ok := cfg.chirpAction(w, r)
+	if !ok {
+		return
+	}
+	params := new(parameters)
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, 400, "Failed to decode request body")
+		return
+	} else if len(params.Reason) > MaxReportReason {
+		respondWithError(w, 400, "Reason is too long")
+		return
+	}
+
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if err != nil || !chirp.Published() {
+		respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", chirpID))
+		return
+	}
+	if chirp.AuthorID == userID {
+		respondWithError(w, 400, "Can't report your own chirp")
+		return
+	}
+	report, err := cfg.db.ReportChirp(chirpID, userID, params.Reason)
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", chirpID))
+		return
+	}
+
+	respondWithJSON(w, 201, report)
+}
+
+// ModerationQueueHandler lists held and reported chirps, oldest first
+func (cfg *ApiConfig) ModerationQueueHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	var after int
+	if afterStr := query.Get("after"); len(afterStr) > 0 {
+		after, err = strconv.Atoi(afterStr)
+		if err != nil || after < 0 {
+			respondWithError(w, 400, "Invalid after")
+			return
+		}
+	}
+
+	items, err := cfg.db.ModerationQueue(after, limit+1)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load moderation queue")
+		return
+	}
+	if len(items) > limit {
+		items = items[:limit]
+		setNextLink(w, r, "after", strconv.Itoa(items[limit-1].Chirp.ID))
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.ModerationItem{}, items...))
+}
+
+// ModerateChirpHandler approves, hides or deletes a chirp
+func (cfg *ApiConfig) ModerateChirpHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid chirp ID")
+		return
+	}
+	params := new(parameters)
+	err = json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		respondWithError(w, 400, "Failed to decode request body")
+		return
+	}
+	switch params.Action {
+	case chirpydb.ModApprove, chirpydb.ModHide, chirpydb.ModDelete:
+	default:
+		respondWithError(w, 400, "action must be approve, hide or delete")
+		return
+	}
+	if _, err = cfg.db.GetChirp(chirpID); err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Chirp #%d not found", chirpID))
+		return
+	}
+
+	chirp, err := cfg.db.ModerateChirp(chirpID, moderatorID(r), params.Action, params.Note)
+	if err != nil {
+		respondWithError(w, 500, "Failed to moderate chirp")
+		return
+	}
+
+	respondWithJSON(w, 200, chirp)
+}
+
+func (cfg *ApiConfig) suspendUser(w http.ResponseWriter, r *http.Request, suspended bool) {
+	type parameters struct {
+		Note string `json:"note"`
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid user ID")
+		return
+	}
+	params := new(parameters)
+	err = json.NewDecoder(r.Body).Decode(params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, 400, "Failed to decode request body")
+		return
+	}
+	if suspended && userID == moderatorID(r) {
+		respondWithError(w, 400, "Can't suspend yourself")
+		return
+	}
+	target, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	// Moderators can only suspend users below them
+	if suspended && target.Role != chirpydb.RoleUser && !chirpydb.HasRole(actorRole(r), chirpydb.RoleAdmin) {
+		respondWithError(w, 403, "Only admins can suspend moderators and admins")
+		return
+	}
+
+	user, err := cfg.db.SuspendUser(userID, moderatorID(r), suspended, params.Note)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, user)
+}
+
+// PostSuspendHandler suspends a user, who can no longer log in or use their tokens
+func (cfg *ApiConfig) PostSuspendHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.suspendUser(w, r, true)
+}
+
+// DeleteSuspendHandler lifts a user's suspension
+func (cfg *ApiConfig) DeleteSuspendHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.suspendUser(w, r, false)
+}
+
+// AuditLogHandler lists moderator actions, newest first
+func (cfg *ApiConfig) AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	var before int
+	if beforeStr := query.Get("before"); len(beforeStr) > 0 {
+		before, err = strconv.Atoi(beforeStr)
+		if err != nil || before < 1 {
+			respondWithError(w, 400, "Invalid before")
+			return
+		}
+	}
+
+	entries, err := cfg.db.AuditLog(before, limit+1)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load audit log")
+		return
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		setNextLink(w, r, "before", strconv.Itoa(entries[limit-1].ID))
+	}
+
+	respondWithJSON(w, 200, append([]chirpydb.AuditEntry{}, entries...))
+}
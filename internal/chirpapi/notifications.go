@@ -0,0 +1,94 @@
+package chirpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/almushel/chirpy/internal/auth"
+	"github.com/almushel/chirpy/internal/chirpydb"
+)
+
+// GetNotificationsHandler lists the caller's notifications, newest first.
+// unread=true leaves out the ones that have been read.
+func (cfg *ApiConfig) GetNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		UnreadCount   int                     `json:"unread_count"`
+		Notifications []chirpydb.Notification `json:"notifications"`
+	}
+
+	id, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	q := chirpydb.NotificationQuery{UserID: id, UnreadOnly: query.Get("unread") == "true"}
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if beforeStr := query.Get("before"); len(beforeStr) > 0 {
+		q.Before, err = strconv.Atoi(beforeStr)
+		if err != nil || q.Before < 1 {
+			respondWithError(w, 400, "Invalid before")
+			return
+		}
+	}
+
+	rb := response{Notifications: []chirpydb.Notification{}}
+	rb.UnreadCount, err = cfg.db.UnreadNotifications(id)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load notifications")
+		return
+	}
+	q.Limit = limit + 1
+	notifications, err := cfg.db.GetNotifications(q)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load notifications")
+		return
+	}
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		setNextLink(w, r, "before", strconv.Itoa(notifications[limit-1].ID))
+	}
+	rb.Notifications = append(rb.Notifications, notifications...)
+
+	respondWithJSON(w, 200, rb)
+}
+
+// PostNotificationsReadHandler marks the notifications listed in the body as
+// read, or all of the caller's notifications if there is no list
+func (cfg *ApiConfig) PostNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IDs []int `json:"ids"`
+	}
+	type response struct {
+		UnreadCount int `json:"unread_count"`
+	}
+
+	id, err := cfg.checkAuthorization(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	params := new(parameters)
+	err = json.NewDecoder(r.Body).Decode(params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, 400, "Failed to decode request body")
+		return
+	}
+
+	unread, err := cfg.db.MarkNotificationsRead(id, params.IDs)
+	if err != nil {
+		respondWithError(w, 500, "Failed to update notifications")
+		return
+	}
+
+	respondWithJSON(w, 200, response{UnreadCount: unread})
+}
@@ -0,0 +1,76 @@
+package chirpapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/almushel/chirpy/internal/chirpydb"
+)
+
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+// pageCursor is the JSON form of an opaque pagination cursor
+type pageCursor struct {
+	CreatedAt int64 `json:"t"`
+	ID        int   `json:"id"`
+	Desc      bool  `json:"desc,omitempty"`
+}
+
+func encodeCursor(c chirpydb.ChirpCursor, desc bool) string {
+	buff, _ := json.Marshal(pageCursor{
+		CreatedAt: c.CreatedAt.UnixNano(),
+		ID:        c.ID,
+		Desc:      desc,
+	})
+	return base64.RawURLEncoding.EncodeToString(buff)
+}
+
+// decodeCursor parses a cursor produced by encodeCursor. An empty string is
+// the start of the list. Cursors can't be reused with the opposite sort order.
+func decodeCursor(s string, desc bool) (*chirpydb.ChirpCursor, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	var pc pageCursor
+	buff, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(buff, &pc)
+	}
+	if err != nil || pc.Desc != desc {
+		return nil, errors.New("Invalid cursor")
+	}
+
+	return &chirpydb.ChirpCursor{CreatedAt: time.Unix(0, pc.CreatedAt).UTC(), ID: pc.ID}, nil
+}
+
+func parseLimit(s string) (int, error) {
+	if len(s) == 0 {
+		return DefaultPageLimit, nil
+	}
+
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > MaxPageLimit {
+		return 0, errors.New("limit must be between 1 and " + strconv.Itoa(MaxPageLimit))
+	}
+
+	return limit, nil
+}
+
+// setNextLink points the client at the next page with a Link header that
+// repeats the current request with one query parameter changed
+func setNextLink(w http.ResponseWriter, r *http.Request, key, value string) {
+	next := *r.URL
+	query := next.Query()
+	query.Set(key, value)
+	next.RawQuery = query.Encode()
+
+	w.Header().Set("Link", "<"+next.String()+`>; rel="next"`)
+}
@@ -0,0 +1,90 @@
+package chirpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/almushel/chirpy/internal/auth"
+	"github.com/almushel/chirpy/internal/chirpydb"
+)
+
+type actorKey struct{}
+
+// actor is the user a role-protected request was authorized for
+type actor struct {
+	id   int
+	role string
+}
+
+// RequireRole only lets requests through whose access token belongs to a
+// user who currently has at least the given role. A user's new role applies
+// to the tokens they already have.
+func (cfg *ApiConfig) RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, userRole, err := cfg.checkClaims(auth.BearerToken(r), AccessIssuer)
+			if err != nil {
+				respondWithAuthError(w, err)
+				return
+			}
+			if !chirpydb.HasRole(userRole, role) {
+				respondWithError(w, 403, "Requires the "+role+" role")
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), actorKey{}, actor{id: id, role: userRole})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// moderatorID is the ID of the user making a request that passed RequireRole
+func moderatorID(r *http.Request) int {
+	a, _ := r.Context().Value(actorKey{}).(actor)
+	return a.id
+}
+
+func actorRole(r *http.Request) string {
+	a, _ := r.Context().Value(actorKey{}).(actor)
+	return a.role
+}
+
+// PutRoleHandler changes a user's role
+func (cfg *ApiConfig) PutRoleHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid user ID")
+		return
+	}
+	params := new(parameters)
+	err = json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		respondWithError(w, 400, "Failed to decode request body")
+		return
+	}
+	if !chirpydb.ValidRole(params.Role) {
+		respondWithError(w, 400, "role must be user, moderator or admin")
+		return
+	}
+	if userID == moderatorID(r) && params.Role != chirpydb.RoleAdmin {
+		// Otherwise the last admin could lock everyone out
+		respondWithError(w, 400, "Can't remove your own admin role")
+		return
+	}
+
+	user, err := cfg.db.SetRole(userID, moderatorID(r), params.Role)
+	if err != nil {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, user)
+}
@@ -0,0 +1,127 @@
+package chirpapi
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/almushel/chirpy/internal/auth"
+)
+
+// errSessionEnded rejects the tokens of a session that was ended, which were
+// revoked along with it
+var errSessionEnded = fmt.Errorf("%w: session has ended", auth.ErrRevoked)
+
+// remoteIP is the address a request came from, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sessionResponse is a login as its user sees it. LastUsed is when its tokens
+// were last refreshed.
+type sessionResponse struct {
+	ID        int       `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+	Current   bool      `json:"current"`
+}
+
+// sessionAuth authorizes a request with an access token and returns its user
+// and the session the token belongs to
+func (cfg *ApiConfig) sessionAuth(w http.ResponseWriter, r *http.Request) (userID, sessionID int, ok bool) {
+	claims, userID, err := cfg.parseToken(auth.BearerToken(r), AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	return userID, claims.Session, true
+}
+
+// GetSessionsHandler lists the caller's active sessions, oldest first
+func (cfg *ApiConfig) GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, sessionID, ok := cfg.sessionAuth(w, r)
+	if !ok {
+		return
+	}
+
+	families, err := cfg.db.ListTokenFamilies(userID)
+	if err != nil {
+		respondWithError(w, 500, "Failed to load sessions")
+		return
+	}
+	rb := []sessionResponse{}
+	for _, family := range families {
+		// Sessions whose last refresh token has expired can't be used anymore
+		if time.Since(family.RotatedAt) > RefreshTokenLifetime {
+			continue
+		}
+		rb = append(rb, sessionResponse{
+			ID:        family.ID,
+			UserAgent: family.UserAgent,
+			IP:        family.IP,
+			CreatedAt: family.CreatedAt,
+			LastUsed:  family.RotatedAt,
+			Current:   family.ID == sessionID,
+		})
+	}
+
+	respondWithJSON(w, 200, rb)
+}
+
+// DeleteSessionHandler ends one of the caller's sessions. Its refresh and
+// access tokens stop working immediately.
+func (cfg *ApiConfig) DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := cfg.sessionAuth(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		respondWithError(w, 404, "Invalid session ID")
+		return
+	}
+
+	family, err := cfg.db.GetTokenFamily(id)
+	if err != nil || family.UserID != userID || family.Revoked() {
+		respondWithError(w, 404, fmt.Sprintf("Session #%d not found", id))
+		return
+	}
+	err = cfg.db.RevokeTokenFamily(id)
+	if err != nil {
+		respondWithError(w, 500, "Failed to end session")
+		return
+	}
+
+	respondWithJSON(w, 200, "OK")
+}
+
+// DeleteSessionsHandler logs the caller out everywhere, including the session
+// making the request and any tokens issued before sessions existed
+func (cfg *ApiConfig) DeleteSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Ended int `json:"ended"`
+	}
+
+	userID, _, ok := cfg.sessionAuth(w, r)
+	if !ok {
+		return
+	}
+	ended, err := cfg.db.RevokeTokenFamilies(userID)
+	if err != nil {
+		respondWithError(w, 500, "Failed to end sessions")
+		return
+	}
+
+	respondWithJSON(w, 200, response{Ended: ended})
+}
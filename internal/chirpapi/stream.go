@@ -0,0 +1,106 @@
+package chirpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/almushel/chirpy/internal/chirpydb"
+)
+
+// StreamHeartbeat is how often an idle event stream sends a comment to keep
+// proxies from closing the connection
+var StreamHeartbeat = 15 * time.Second
+
+// CloseStreams ends every open event stream so the server can shut down
+func (cfg *ApiConfig) CloseStreams() {
+	cfg.closeStreams.Do(func() { close(cfg.done) })
+}
+
+func writeEvent(w http.ResponseWriter, e chirpydb.Event) error {
+	data, err := json.Marshal(e.Chirp)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// StreamChirpsHandler sends chirps as they are created and deleted using
+// Server-Sent Events. author_id limits the stream to one author, and a client
+// that reconnects with Last-Event-ID is sent the events it missed.
+func (cfg *ApiConfig) StreamChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	var authorID int
+	var lastID int64
+	var err error
+
+	if authorIDStr := r.URL.Query().Get("author_id"); len(authorIDStr) > 0 {
+		authorID, err = strconv.Atoi(authorIDStr)
+		if err != nil {
+			respondWithError(w, 400, "Invalid author_id")
+			return
+		}
+	}
+	if lastIDStr := r.Header.Get("Last-Event-ID"); len(lastIDStr) > 0 {
+		lastID, err = strconv.ParseInt(lastIDStr, 10, 64)
+		if err != nil {
+			respondWithError(w, 400, "Invalid Last-Event-ID")
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, 500, "Streaming is not supported")
+		return
+	}
+
+	sub, missed := cfg.db.Events().Subscribe(lastID)
+	defer cfg.db.Events().Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+
+	send := func(e chirpydb.Event) bool {
+		// Notifications are private, so they are only sent over the WebSocket API
+		if e.Type == chirpydb.EventNotification || (authorID != 0 && e.Chirp.AuthorID != authorID) {
+			return true
+		}
+		return writeEvent(w, e) == nil
+	}
+	for _, e := range missed {
+		if !send(e) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				// Fell behind; the client reconnects and catches up
+				return
+			}
+			if !send(e) {
+				return
+			}
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-cfg.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
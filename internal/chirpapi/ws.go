@@ -0,0 +1,250 @@
+package chirpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/almushel/chirpy/internal/auth"
+	"github.com/almushel/chirpy/internal/chirpydb"
+)
+
+const (
+	// Channels a WebSocket client can subscribe to. An author's chirps are
+	// on "author:<id>".
+	ChannelFirehose      = "firehose"
+	ChannelNotifications = "notifications"
+	channelAuthorPrefix  = "author:"
+
+	wsWriteWait  = 10 * time.Second
+	wsMaxMessage = 4096
+)
+
+// WSPingInterval is how often the server pings WebSocket clients. A client
+// that doesn't answer within two intervals is disconnected.
+var WSPingInterval = 30 * time.Second
+
+var upgrader = websocket.Upgrader{
+	// Clients authenticate with a token rather than cookies, so any origin is
+	// allowed, as with the CORS headers on the rest of the API
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsMessage is every message sent over the WebSocket API, in either direction
+type wsMessage struct {
+	// Type is subscribe, unsubscribe or ping from the client, and subscribed,
+	// unsubscribed, pong, event or error from the server
+	Type    string `json:"type"`
+	Channel string `json:"channel,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	ID           int64                  `json:"id,omitempty"`
+	Event        string                 `json:"event,omitempty"`
+	Chirp        *chirpydb.Chirp        `json:"chirp,omitempty"`
+	Notification *chirpydb.Notification `json:"notification,omitempty"`
+}
+
+type wsClient struct {
+	userID int
+
+	mux      sync.Mutex
+	channels map[string]bool
+}
+
+func validChannel(channel string) bool {
+	if channel == ChannelFirehose || channel == ChannelNotifications {
+		return true
+	}
+	id, ok := strings.CutPrefix(channel, channelAuthorPrefix)
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(id)
+	return err == nil
+}
+
+// handle answers a message from the client
+func (c *wsClient) handle(msg wsMessage) wsMessage {
+	switch msg.Type {
+	case "ping":
+		return wsMessage{Type: "pong"}
+	case "subscribe", "unsubscribe":
+		if !validChannel(msg.Channel) {
+			return wsMessage{Type: "error", Channel: msg.Channel, Error: "Unknown channel"}
+		}
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		if msg.Type == "subscribe" {
+			c.channels[msg.Channel] = true
+		} else {
+			delete(c.channels, msg.Channel)
+		}
+		return wsMessage{Type: msg.Type + "d", Channel: msg.Channel}
+	}
+	return wsMessage{Type: "error", Error: "Unknown message type"}
+}
+
+// route returns a message for every subscribed channel an event belongs to
+func (c *wsClient) route(e chirpydb.Event) []wsMessage {
+	var result []wsMessage
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if e.Type == chirpydb.EventNotification {
+		if c.channels[ChannelNotifications] && e.Notification.UserID == c.userID {
+			n := e.Notification
+			result = append(result, wsMessage{Type: "event", Channel: ChannelNotifications, ID: e.ID, Event: e.Type, Notification: &n})
+		}
+		return result
+	}
+
+	author := channelAuthorPrefix + strconv.Itoa(e.Chirp.AuthorID)
+	for _, channel := range []string{ChannelFirehose, author} {
+		if c.channels[channel] {
+			chirp := e.Chirp
+			result = append(result, wsMessage{Type: "event", Channel: channel, ID: e.ID, Event: e.Type, Chirp: &chirp})
+		}
+	}
+	return result
+}
+
+// WebSocketHandler serves the real-time API. The connection is authenticated
+// with an access token, either in the Authorization header or, for browsers
+// that can't set headers on a WebSocket, the access_token query parameter.
+// Clients then subscribe to channels with messages like
+//
+//	{"type": "subscribe", "channel": "author:3"}
+//
+// A client that can't keep up with its events is disconnected and should
+// reconnect and fetch what it missed over HTTP. The connection is closed with
+// a policy violation when the access token expires, and at the next ping
+// after the user is suspended or their session ends, so the client should
+// reconnect with a fresh token.
+func (cfg *ApiConfig) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	ts := auth.BearerToken(r)
+	if len(ts) == 0 {
+		ts = r.URL.Query().Get("access_token")
+	}
+	claims, id, err := cfg.parseToken(ts, AccessIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already responded
+		return
+	}
+	defer conn.Close()
+
+	client := &wsClient{userID: id, channels: make(map[string]bool)}
+	sub, _ := cfg.db.Events().Subscribe(0)
+	defer cfg.db.Events().Unsubscribe(sub)
+
+	// The reader hands replies to the writer, which owns the connection.
+	// Replies are small and rare, so a client that floods requests without
+	// reading the answers is disconnected rather than buffered.
+	replies := make(chan wsMessage, 16)
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- readWebSocket(conn, client, replies)
+	}()
+
+	ping := time.NewTicker(WSPingInterval)
+	defer ping.Stop()
+	expired := time.NewTimer(time.Until(claims.ExpiresAt.Time))
+	defer expired.Stop()
+
+	write := func(msg wsMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(msg)
+	}
+	closeWith := func(code int, reason string) {
+		msg := websocket.FormatCloseMessage(code, reason)
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+	}
+
+	for {
+		select {
+		case msg := <-replies:
+			err = write(msg)
+		case e, ok := <-sub.C:
+			if !ok {
+				closeWith(websocket.CloseTryAgainLater, "Too slow to keep up with events")
+				return
+			}
+			for _, msg := range client.route(e) {
+				if err = write(msg); err != nil {
+					break
+				}
+			}
+		case <-ping.C:
+			// The token is checked again so revoking it closes the connection
+			if _, _, err = cfg.parseToken(ts, AccessIssuer); err != nil {
+				closeWith(websocket.ClosePolicyViolation, err.Error())
+				return
+			}
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		case <-expired.C:
+			closeWith(websocket.ClosePolicyViolation, auth.ErrExpired.Error())
+			return
+		case err = <-readDone:
+			if errors.Is(err, errTooManyRequests) {
+				closeWith(websocket.ClosePolicyViolation, err.Error())
+			}
+			return
+		case <-cfg.done:
+			closeWith(websocket.CloseGoingAway, "Server is shutting down")
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var errTooManyRequests = errors.New("Too many unanswered requests")
+
+// readWebSocket reads client messages until the connection fails or the
+// client stops answering pings
+func readWebSocket(conn *websocket.Conn, client *wsClient, replies chan<- wsMessage) error {
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(2 * WSPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * WSPingInterval))
+	})
+
+	for {
+		var msg, reply wsMessage
+		err := conn.ReadJSON(&msg)
+		if err == nil {
+			reply = client.handle(msg)
+		} else if isJSONError(err) {
+			reply = wsMessage{Type: "error", Error: "Invalid message"}
+		} else {
+			return err
+		}
+
+		select {
+		case replies <- reply:
+		default:
+			return errTooManyRequests
+		}
+	}
+}
+
+// isJSONError reports whether a read failed because the message wasn't valid
+// JSON, rather than because of the connection
+func isJSONError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
@@ -3,324 +3,725 @@ package chirpydb
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	InReplyTo  int `json:"in_reply_to,omitempty"`
+	ReplyCount int `json:"reply_count"`
+
+	LikeCount    int `json:"like_count"`
+	RechirpCount int `json:"rechirp_count"`
+
+	Entities []Entity `json:"entities,omitempty"`
+
+	// Status is empty for published chirps
+	Status string `json:"status,omitempty"`
+}
+
+// ChirpHeld is the status of a chirp waiting for a moderator. Held chirps are
+// left out of every listing, and don't notify anyone, until they are published.
+const ChirpHeld = "held"
+
+// Published reports whether c is publicly visible
+func (c Chirp) Published() bool {
+	return c.Status == ""
+}
+
+// ChirpRevision is one version of an edited chirp's body
+type ChirpRevision struct {
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type User struct {
-	ID          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	ID          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	IsSuspended bool      `json:"is_suspended"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type dbUser struct {
 	User
 	PWH []byte `json:"pwh"`
+	// TokensValidAfter is when the user last logged out everywhere
+	TokensValidAfter time.Time `json:"tokens_valid_after"`
 }
 
 type DB struct {
-	path string
-	mux  *sync.RWMutex
-
-	chirpID, userID int
+	path    string
+	mux     *sync.RWMutex
+	backups int
+
+	// dbs is the resident copy of the database that all reads are served
+	// from. dirty is set when it has changes that haven't reached the file.
+	dbs    DBStructure
+	dirty  atomic.Bool
+	index  *chirpIndex
+	search *searchIndex
+	// followers is DBStructure.Follows inverted, keyed by the followed user
+	followers map[int]map[int]time.Time
+	handles   handleIndex
+	events    *Broker
+
+	flushMux      sync.Mutex
+	flushInterval time.Duration
+	done          chan struct{}
+	closed        sync.WaitGroup
+	closeOnce     sync.Once
 }
 
 type DBStructure struct {
-	Chirps      map[int]Chirp
-	Users       map[int]dbUser
-	Emails      map[string]int
-	Revocations map[string]time.Time
+	SchemaVersion int `json:"schema_version"`
+
+	Chirps map[int]Chirp
+	Users  map[int]dbUser
+	Emails map[string]int
+	// Revocations is keyed by TokenKey
+	Revocations map[string]Revocation
+
+	// ChirpHistory holds the previous versions of edited chirps, oldest first
+	ChirpHistory map[int][]ChirpRevision
+
+	// Follows maps a user ID to the users they follow and when they started
+	Follows map[int]map[int]time.Time
+
+	// Likes and Rechirps are keyed by chirp ID, then by user ID
+	Likes    map[int]map[int]time.Time
+	Rechirps map[int]map[int]Rechirp
+
+	// Notifications holds each user's notifications, oldest first
+	Notifications map[int][]Notification
+
+	// Reports holds the open reports on each chirp, oldest first
+	Reports map[int][]Report
+	// Audit is every moderator action, oldest first
+	Audit []AuditEntry
+
+	// TokenFamilies tracks the refresh tokens issued since each login
+	TokenFamilies map[int]TokenFamily
+
+	NextChirpID        int
+	NextUserID         int
+	NextNotificationID int
+	NextReportID       int
+	NextAuditID        int
+	NextTokenFamilyID  int
+
+	// outbox holds the notifications recorded by the current Update, which
+	// are published once it succeeds
+	outbox []Notification
+}
+
+// Options configures a JSON database opened with NewDBWithOptions
+type Options struct {
+	// Backups is the number of previous snapshots kept as path.1 ... path.N.
+	// If the database file is corrupt on open, the newest valid one is restored.
+	Backups int
+
+	// FlushInterval enables write-behind mode: changes are batched in memory
+	// and written to disk at most once per interval, and on Close. When zero,
+	// every Update is written to disk before it returns.
+	FlushInterval time.Duration
 }
 
 func NewDB(path string) (*DB, error) {
+	return NewDBWithOptions(path, Options{Backups: DefaultBackups})
+}
+
+func NewDBWithOptions(path string, opts Options) (*DB, error) {
 	result := new(DB)
 	result.mux = new(sync.RWMutex)
-	result.chirpID = 1
-	result.userID = 1
+	result.backups = opts.Backups
+	result.flushInterval = opts.FlushInterval
+	result.events = newBroker()
 	err := result.initDB(path)
+	if err != nil {
+		return result, err
+	}
 
-	return result, err
+	if result.flushInterval > 0 {
+		result.done = make(chan struct{})
+		result.closed.Add(1)
+		go result.flushLoop()
+	}
+
+	return result, nil
 }
 
 func (db *DB) initDB(path string) error {
-	db.mux = new(sync.RWMutex)
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
 	db.path = path
-	_, err := os.Stat(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		dbs := new(DBStructure)
-		buff, err := json.Marshal(dbs)
+	err := checkDBFile(db.path)
+	if err != nil {
+		_, backupErr := os.Stat(backupPath(db.path, 1))
+		if errors.Is(err, os.ErrNotExist) && (db.backups == 0 || errors.Is(backupErr, os.ErrNotExist)) {
+			err = db.writeDB(DBStructure{
+				SchemaVersion:      jsonSchemaVersion(),
+				NextChirpID:        1,
+				NextUserID:         1,
+				NextNotificationID: 1,
+				NextReportID:       1,
+				NextAuditID:        1,
+				NextTokenFamilyID:  1,
+			})
+		} else {
+			err = recoverDB(db.path, db.backups, err)
+		}
 		if err != nil {
 			return err
 		}
-		return os.WriteFile(db.path, buff, 0666)
 	}
 
-	return err
+	_, err = MigrateDB(db.path, false)
+	if err != nil {
+		return err
+	}
+
+	db.dbs, err = db.loadDB()
+	if err != nil {
+		return err
+	}
+	db.index = newChirpIndex(db.dbs.Chirps)
+	db.search = newSearchIndex()
+	for _, chirp := range db.dbs.Chirps {
+		if chirp.Published() {
+			db.search.add(chirp)
+		}
+	}
+	db.followers = followers(db.dbs.Follows)
+	db.handles = newHandleIndex(db.dbs.Emails)
+
+	return nil
 }
 
+// loadDB reads the database file. The caller must hold db.mux.
 func (db *DB) loadDB() (DBStructure, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-
-	var dbs DBStructure
-	buff, err := os.ReadFile(db.path)
+	dbs, err := readDBFile(db.path)
 	if err != nil {
 		return dbs, err
 	}
-	err = json.Unmarshal(buff, &dbs)
-	return dbs, err
+
+	if dbs.Chirps == nil {
+		dbs.Chirps = make(map[int]Chirp)
+	}
+	if dbs.Users == nil {
+		dbs.Users = make(map[int]dbUser)
+	}
+	if dbs.Emails == nil {
+		dbs.Emails = make(map[string]int)
+	}
+	if dbs.Revocations == nil {
+		dbs.Revocations = make(map[string]Revocation)
+	}
+	if dbs.ChirpHistory == nil {
+		dbs.ChirpHistory = make(map[int][]ChirpRevision)
+	}
+	if dbs.Follows == nil {
+		dbs.Follows = make(map[int]map[int]time.Time)
+	}
+	if dbs.Likes == nil {
+		dbs.Likes = make(map[int]map[int]time.Time)
+	}
+	if dbs.Rechirps == nil {
+		dbs.Rechirps = make(map[int]map[int]Rechirp)
+	}
+	if dbs.Notifications == nil {
+		dbs.Notifications = make(map[int][]Notification)
+	}
+	if dbs.Reports == nil {
+		dbs.Reports = make(map[int][]Report)
+	}
+	if dbs.TokenFamilies == nil {
+		dbs.TokenFamilies = make(map[int]TokenFamily)
+	}
+
+	return dbs, nil
 }
 
+// writeDB replaces the database file with dbs
 func (db *DB) writeDB(dbs DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
 	buff, err := json.Marshal(dbs)
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(db.path, buff, 0)
-	return err
+	return db.writeFile(buff)
 }
 
-func (db *DB) CreateChirp(msg string, authorID int) (Chirp, error) {
-	var result Chirp
-
-	dbs, err := db.loadDB()
+func (db *DB) writeFile(buff []byte) error {
+	err := rotateBackups(db.path, db.backups)
 	if err != nil {
-		return result, err
+		return err
 	}
+	return writeFileAtomic(db.path, buff)
+}
 
-	if len(dbs.Chirps) == 0 {
-		dbs.Chirps = make(map[int]Chirp)
-	}
-	result = Chirp{
-		ID:       db.chirpID,
-		AuthorID: authorID,
-		Body:     msg,
+// flush writes the resident database to disk if it has unwritten changes.
+// The file is written outside of db.mux so readers and writers aren't blocked
+// on disk I/O; flushMux keeps snapshots reaching the disk in order.
+func (db *DB) flush() error {
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	db.mux.RLock()
+	if !db.dirty.Swap(false) {
+		db.mux.RUnlock()
+		return nil
 	}
-	dbs.Chirps[result.ID] = result
-	db.chirpID++
+	buff, err := json.Marshal(db.dbs)
+	db.mux.RUnlock()
 
-	err = db.writeDB(dbs)
+	if err == nil {
+		err = db.writeFile(buff)
+	}
 	if err != nil {
-		return result, err
+		db.dirty.Store(true)
 	}
 
-	return result, nil
+	return err
 }
 
-func (db *DB) GetChirp(id int) (Chirp, error) {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
+func (db *DB) flushLoop() {
+	defer db.closed.Done()
+
+	ticker := time.NewTicker(db.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := db.flush()
+			if err != nil {
+				log.Println("Failed to flush database:", err)
+			}
+		case <-db.done:
+			return
+		}
 	}
+}
+
+// View calls fn with the database under a read lock. fn must not modify it.
+func (db *DB) View(fn func(*DBStructure) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(&db.dbs)
+}
 
-	result, ok := dbs.Chirps[id]
-	if !ok {
-		return result, errors.New("Invalid chirp ID")
+// Update calls fn with the database while holding the write lock for the
+// whole read-modify-write cycle. fn must not modify the database if it
+// returns an error. In synchronous mode the change is on disk when Update
+// returns; in write-behind mode it is written by the next flush.
+func (db *DB) Update(fn func(*DBStructure) error) error {
+	db.mux.Lock()
+	err := fn(&db.dbs)
+	if err == nil {
+		db.dirty.Store(true)
 	}
+	outbox := db.dbs.outbox
+	db.dbs.outbox = nil
+	db.mux.Unlock()
 
-	return result, nil
+	if err == nil {
+		db.events.publishNotifications(outbox)
+	}
+	if err != nil || db.flushInterval > 0 {
+		return err
+	}
+	return db.flush()
 }
 
-func (db *DB) DeleteChirp(id int) (err error) {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return
+// CreateChirp adds a new chirp. inReplyTo is the ID of the chirp it replies
+// to, or 0 if it starts a new conversation.
+func (db *DB) CreateChirp(msg string, authorID, inReplyTo int) (Chirp, error) {
+	result, err := db.createChirp(msg, authorID, inReplyTo, "")
+	if err == nil {
+		db.events.publish(EventChirpCreated, result)
 	}
 
-	delete(dbs.Chirps, id)
-	err = db.writeDB(dbs)
+	return result, err
+}
+
+// HoldChirp adds a chirp that waits for a moderator before it is published
+func (db *DB) HoldChirp(msg string, authorID, inReplyTo int) (Chirp, error) {
+	return db.createChirp(msg, authorID, inReplyTo, ChirpHeld)
+}
+
+func (db *DB) createChirp(msg string, authorID, inReplyTo int, status string) (Chirp, error) {
+	var result Chirp
+
+	err := db.Update(func(dbs *DBStructure) error {
+		var parent Chirp
+		if inReplyTo != 0 {
+			var ok bool
+			parent, ok = dbs.Chirps[inReplyTo]
+			if !ok || !parent.Published() {
+				return errors.New("Parent chirp does not exist")
+			}
+		}
+
+		now := time.Now().UTC()
+		result = Chirp{
+			ID:        dbs.NextChirpID,
+			AuthorID:  authorID,
+			Body:      msg,
+			CreatedAt: now,
+			UpdatedAt: now,
+			InReplyTo: inReplyTo,
+			Entities:  parseEntities(msg, db.resolveMention),
+			Status:    status,
+		}
+		dbs.Chirps[result.ID] = result
+		dbs.NextChirpID++
+		db.index.add(result)
+		if !result.Published() {
+			return nil
+		}
+
+		if inReplyTo != 0 {
+			parent.ReplyCount++
+			dbs.Chirps[parent.ID] = parent
+		}
+		db.search.add(result)
+		for _, n := range chirpNotifications(result, parent.AuthorID) {
+			dbs.notify(n)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *DB) GetChirp(id int) (Chirp, error) {
+	var result Chirp
+
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		result, ok = dbs.Chirps[id]
+		if !ok {
+			return errors.New("Invalid chirp ID")
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// UpdateChirp replaces the body of a chirp, keeping the old body in its history
+func (db *DB) UpdateChirp(id int, body string) (Chirp, error) {
+	var result Chirp
+
+	err := db.Update(func(dbs *DBStructure) error {
+		old, ok := dbs.Chirps[id]
+		if !ok {
+			return errors.New("Invalid chirp ID")
+		}
+
+		dbs.ChirpHistory[id] = append(dbs.ChirpHistory[id], ChirpRevision{
+			Body:      old.Body,
+			CreatedAt: old.UpdatedAt,
+		})
+		result = old
+		result.Body = body
+		result.UpdatedAt = time.Now().UTC()
+		result.Entities = parseEntities(body, db.resolveMention)
+		dbs.Chirps[id] = result
+		if result.Published() {
+			db.index.retag(old, result)
+			db.search.update(old, result)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// GetChirpHistory returns every version of a chirp, oldest first.
+// The last revision is the chirp's current body.
+func (db *DB) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	var result []ChirpRevision
+
+	err := db.View(func(dbs *DBStructure) error {
+		chirp, ok := dbs.Chirps[id]
+		if !ok {
+			return errors.New("Invalid chirp ID")
+		}
+
+		result = append(result, dbs.ChirpHistory[id]...)
+		result = append(result, ChirpRevision{Body: chirp.Body, CreatedAt: chirp.UpdatedAt})
+		return nil
+	})
+
+	return result, err
+}
+
+// DeleteChirp removes a chirp. Its replies move up to its parent, or become
+// top-level chirps if it had none, so the rest of the conversation survives.
+func (db *DB) DeleteChirp(id int) error {
+	var chirp Chirp
+	var ok bool
+
+	err := db.Update(func(dbs *DBStructure) error {
+		chirp, ok = dbs.Chirps[id]
+		if ok {
+			db.deleteChirp(dbs, chirp)
+		}
+		return nil
+	})
+	if err == nil && ok && chirp.Published() {
+		db.events.publish(EventChirpDeleted, chirp)
+	}
 
 	return err
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
+// deleteChirp removes a chirp inside an Update
+func (db *DB) deleteChirp(dbs *DBStructure, chirp Chirp) {
+	replies := db.index.replies[chirp.ID]
+	moved := 0
+	for _, replyID := range replies {
+		reply := dbs.Chirps[replyID]
+		reply.InReplyTo = chirp.InReplyTo
+		dbs.Chirps[replyID] = reply
+		if reply.Published() {
+			moved++
+		}
+	}
+	if chirp.InReplyTo != 0 {
+		parent := dbs.Chirps[chirp.InReplyTo]
+		parent.ReplyCount += moved
+		if chirp.Published() {
+			parent.ReplyCount--
+		}
+		dbs.Chirps[parent.ID] = parent
+		db.index.replies[parent.ID] = append(db.index.replies[parent.ID], replies...)
+	}
+
+	delete(dbs.Chirps, chirp.ID)
+	delete(dbs.ChirpHistory, chirp.ID)
+	delete(dbs.Likes, chirp.ID)
+	delete(dbs.Rechirps, chirp.ID)
+	delete(dbs.Reports, chirp.ID)
+	db.index.remove(chirp)
+	if chirp.Published() {
+		db.search.remove(chirp)
+	}
+}
+
+func (db *DB) SearchChirps(q SearchQuery) ([]Chirp, error) {
 	var chirps []Chirp
-	dbs, err := db.loadDB()
+
+	ids, err := db.search.search(q)
 	if err != nil {
 		return chirps, err
 	}
 
-	for i := 1; i < db.chirpID; i++ {
-		chirp, ok := dbs.Chirps[i]
-		if ok {
+	err = db.View(func(dbs *DBStructure) error {
+		for _, id := range ids {
+			if chirp, ok := dbs.Chirps[id]; ok {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
+
+	return chirps, err
+}
+
+func (db *DB) ListChirps(q ChirpQuery) ([]Chirp, error) {
+	var chirps []Chirp
+
+	err := db.View(func(dbs *DBStructure) error {
+		for _, key := range db.index.page(q) {
+			chirps = append(chirps, dbs.Chirps[key.ID])
+		}
+		return nil
+	})
+
+	return chirps, err
+}
+
+func (db *DB) GetChirps() ([]Chirp, error) {
+	var chirps []Chirp
+
+	err := db.View(func(dbs *DBStructure) error {
+		for _, chirp := range dbs.Chirps {
 			chirps = append(chirps, chirp)
 		}
-	}
+		sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
+		return nil
+	})
 
-	return chirps, nil
+	return chirps, err
 }
 
+// ErrUserExists is returned when creating a user, or changing a user's email,
+// with an email another user already has
+var ErrUserExists = errors.New("User already exists")
+
 func (db *DB) CreateUser(email, password string) (User, error) {
 	var result dbUser
 
-	dbs, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	if len(dbs.Users) == 0 {
-		dbs.Users = make(map[int]dbUser)
-	}
-	if len(dbs.Emails) == 0 {
-		dbs.Emails = make(map[string]int)
-	}
+	// Hash outside of the transaction so slow bcrypt rounds don't block other writers
 	pwh, err := bcrypt.GenerateFromPassword([]byte(password), 0)
 	if err != nil {
 		return User{}, err
 	}
-	result = dbUser{
-		User: User{ID: db.userID, Email: email},
-		PWH:  pwh,
-	}
-	_, exists := dbs.Emails[email]
-	if exists {
-		return User{}, errors.New("User already exists for " + email)
-	}
-	dbs.Emails[email] = result.ID
-	dbs.Users[result.ID] = result
-	db.userID++
 
-	err = db.writeDB(dbs)
+	err = db.Update(func(dbs *DBStructure) error {
+		_, exists := dbs.Emails[email]
+		if exists {
+			return fmt.Errorf("%w for %s", ErrUserExists, email)
+		}
+		now := time.Now().UTC()
+		result = dbUser{
+			User: User{ID: dbs.NextUserID, Email: email, Role: RoleUser, CreatedAt: now, UpdatedAt: now},
+			PWH:  pwh,
+		}
+		dbs.Emails[email] = result.ID
+		db.handles.add(email, result.ID)
+		dbs.Users[result.ID] = result
+		dbs.NextUserID++
+		return nil
+	})
 	if err != nil {
-		return result.User, err
+		return User{}, err
 	}
 
 	return result.User, nil
 }
 
 func (db *DB) UpdateUser(id int, properties map[string]string) (User, error) {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-	user, ok := dbs.Users[id]
-	if !ok {
-		return User{}, errors.New("User id does not exist")
-	}
+	var result User
+	var pwh []byte
+	var err error
 
-	for key, prop := range properties {
-		switch key {
-		case "password":
-			user.PWH, err = bcrypt.GenerateFromPassword([]byte(prop), 0)
-			if err != nil {
-				return User{}, nil
-			}
-		case "email":
-			if prop != user.Email {
-				delete(dbs.Emails, user.Email)
-				dbs.Emails[prop] = user.ID
-				user.Email = prop
-			}
-		case "is_chirpy_red":
-			user.IsChirpyRed = (prop == "true")
+	if password, ok := properties["password"]; ok {
+		pwh, err = bcrypt.GenerateFromPassword([]byte(password), 0)
+		if err != nil {
+			return result, err
 		}
 	}
 
-	dbs.Users[id] = user
-	db.writeDB(dbs)
-
-	return user.User, nil
-}
+	err = db.Update(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[id]
+		if !ok {
+			return errors.New("User id does not exist")
+		}
 
-func (db *DB) GetUsers() ([]User, error) {
-	var result []User
-	dbs, err := db.loadDB()
-	if err != nil {
-		return result, err
-	}
+		for key, prop := range properties {
+			switch key {
+			case "password":
+				user.PWH = pwh
+			case "email":
+				if prop != user.Email {
+					if _, exists := dbs.Emails[prop]; exists {
+						return fmt.Errorf("%w for %s", ErrUserExists, prop)
+					}
+					delete(dbs.Emails, user.Email)
+					db.handles.remove(user.Email, user.ID)
+					dbs.Emails[prop] = user.ID
+					db.handles.add(prop, user.ID)
+					user.Email = prop
+				}
+			case "is_chirpy_red":
+				if prop == "true" && !user.IsChirpyRed {
+					dbs.notify(Notification{UserID: user.ID, Type: NotifyChirpyRed})
+				}
+				user.IsChirpyRed = (prop == "true")
+			}
+		}
 
-	for _, u := range dbs.Users {
-		result = append(result, u.User)
-	}
+		user.UpdatedAt = time.Now().UTC()
+		dbs.Users[id] = user
+		result = user.User
+		return nil
+	})
 
-	return result, nil
+	return result, err
 }
 
-func (db *DB) UserLogin(email, password string) (User, error) {
+func (db *DB) GetUser(id int) (User, error) {
 	var result User
-	dbs, err := db.loadDB()
-	if err != nil {
-		return result, err
-	}
-	id, ok := dbs.Emails[email]
-	if !ok {
-		return result, errors.New("Email does not exist")
-	}
-	user := dbs.Users[id]
 
-	err = bcrypt.CompareHashAndPassword(user.PWH, []byte(password))
-	if err != nil {
-		return result, err
-	}
+	err := db.View(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[id]
+		if !ok {
+			return errors.New("User id does not exist")
+		}
+		result = user.User
+		return nil
+	})
 
-	result = user.User
-	return result, nil
+	return result, err
 }
 
-func (db *DB) RevokeToken(token string) error {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	if len(dbs.Revocations) == 0 {
-		dbs.Revocations = make(map[string]time.Time)
-	}
+func (db *DB) GetUsers() ([]User, error) {
+	var result []User
 
-	_, ok := dbs.Revocations[token]
-	if ok {
-		// Token has already been revoked
+	err := db.View(func(dbs *DBStructure) error {
+		for _, u := range dbs.Users {
+			result = append(result, u.User)
+		}
 		return nil
-	}
-	dbs.Revocations[token] = time.Now()
-
-	err = db.writeDB(dbs)
-	if err != nil {
-		return err
-	}
+	})
 
-	return nil
+	return result, err
 }
 
-func (db *DB) GetTokenRevocation(token string) (time.Time, error) {
-	var result time.Time
-	dbs, err := db.loadDB()
+func (db *DB) UserLogin(email, password string) (User, error) {
+	var user dbUser
+
+	err := db.View(func(dbs *DBStructure) error {
+		id, ok := dbs.Emails[email]
+		if !ok {
+			return errors.New("Email does not exist")
+		}
+		user = dbs.Users[id]
+		return nil
+	})
 	if err != nil {
-		return result, err
+		return User{}, err
 	}
 
-	result, ok := dbs.Revocations[token]
-	if !ok {
-		return result, errors.New("Token has not been revoked")
+	err = bcrypt.CompareHashAndPassword(user.PWH, []byte(password))
+	if err != nil {
+		return User{}, err
 	}
 
-	return result, nil
+	return user.User, nil
 }
 
-func (db *DB) IsTokenRevoked(token string) bool {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return false
-	}
-	_, ok := dbs.Revocations[token]
-	if !ok {
-		return false
-	}
-
-	return true
+// Close ends event subscriptions, stops background flushing and writes any
+// pending changes to disk
+func (db *DB) Close() error {
+	var err error
+	db.closeOnce.Do(func() {
+		db.events.Close()
+		if db.done != nil {
+			close(db.done)
+			db.closed.Wait()
+		}
+		err = db.flush()
+	})
+	return err
 }
@@ -0,0 +1,1756 @@
+package chirpydb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores opens an empty store for each backend in a temporary directory
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	dir := t.TempDir()
+
+	jsonDB, err := NewDB(filepath.Join(dir, "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteDB, err := NewSQLiteDB(filepath.Join(dir, "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		jsonDB.Close()
+		sqliteDB.Close()
+	})
+
+	return map[string]Store{"json": jsonDB, "sqlite": sqliteDB}
+}
+
+func TestStore(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("user@email.com", "12345")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.CreateUser("user@email.com", "12345"); !errors.Is(err, ErrUserExists) {
+				t.Fatalf("Expected %v for a duplicate user, got %v", ErrUserExists, err)
+			}
+			other, err := db.CreateUser("other@email.com", "12345")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.UpdateUser(other.ID, map[string]string{"email": "user@email.com"}); !errors.Is(err, ErrUserExists) {
+				t.Fatalf("Expected %v for taking another user's email, got %v", ErrUserExists, err)
+			}
+			user, err = db.UpdateUser(user.ID, map[string]string{"email": "user2@email.com", "is_chirpy_red": "true"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.UserLogin("user2@email.com", "12345"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.UserLogin("user@email.com", "12345"); err == nil {
+				t.Fatal("Logged in with old email")
+			}
+
+			for _, body := range []string{"first", "second", "third"} {
+				if _, err = db.CreateChirp(body, user.ID, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = db.DeleteChirp(2); err != nil {
+				t.Fatal(err)
+			}
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != 2 || chirps[0].Body != "first" || chirps[1].Body != "third" {
+				t.Fatalf("Unexpected chirps: %v", chirps)
+			}
+			if _, err = db.GetChirp(2); err == nil {
+				t.Fatal("Got deleted chirp")
+			}
+
+			if db.IsTokenRevoked("token") {
+				t.Fatal("Token revoked before RevokeToken")
+			}
+			if err = db.RevokeToken("token", time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if !db.IsTokenRevoked("token") {
+				t.Fatal("Token not revoked after RevokeToken")
+			}
+		})
+	}
+}
+
+func TestRecoverCorruptDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if _, err = db.CreateChirp(body, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// Simulate a crash that left the primary file truncated
+	if err = os.WriteFile(path, []byte(`{"Chirps":{"1":`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The newest backup is the snapshot taken before "second" was written
+	chirp, err := db.GetChirp(1)
+	if err != nil || chirp.Body != "first" {
+		t.Fatalf("Unexpected chirp after recovery: %v (%v)", chirp, err)
+	}
+	if _, err = db.GetChirp(2); err == nil {
+		t.Fatal("Recovered chirp written after the newest backup")
+	}
+
+	corrupt, _ := filepath.Glob(path + ".corrupt-*")
+	if len(corrupt) != 1 {
+		t.Fatal("Corrupt database file was not kept")
+	}
+}
+
+func TestBackupRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDBWithOptions(path, Options{Backups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err = db.CreateChirp("chirp", 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, _ := filepath.Glob(path + ".[0-9]*")
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, found %v", backups)
+	}
+	for _, b := range backups {
+		if _, err = readDBFile(b); err != nil {
+			t.Fatalf("Backup %s is not a valid database: %s", b, err)
+		}
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	const workers, perWorker = 8, 25
+
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			errs := make(chan error, workers*perWorker)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < perWorker; i++ {
+						_, err := db.CreateChirp(fmt.Sprintf("worker %d chirp %d", w, i), w+1, 0)
+						if err == nil {
+							err = db.RevokeToken(fmt.Sprintf("token-%d-%d", w, i), time.Now().Add(time.Hour))
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != workers*perWorker {
+				t.Fatalf("Expected %d chirps, found %d", workers*perWorker, len(chirps))
+			}
+			seen := make(map[int]bool)
+			for _, c := range chirps {
+				if seen[c.ID] {
+					t.Fatalf("Duplicate chirp ID %d", c.ID)
+				}
+				seen[c.ID] = true
+			}
+			for w := 0; w < workers; w++ {
+				for i := 0; i < perWorker; i++ {
+					if !db.IsTokenRevoked(fmt.Sprintf("token-%d-%d", w, i)) {
+						t.Fatalf("Lost revocation of token-%d-%d", w, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIDsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateChirp("first", 1, 0)
+	db.CreateChirp("second", 1, 0)
+	db.DeleteChirp(2)
+	user, err := db.CreateUser("user@email.com", "12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirp, err := db.CreateChirp("third", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 3 {
+		t.Fatalf("Expected chirp ID 3 after restart, got %d", chirp.ID)
+	}
+	user2, err := db.CreateUser("user2@email.com", "12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user2.ID != user.ID+1 {
+		t.Fatalf("Expected user ID %d after restart, got %d", user.ID+1, user2.ID)
+	}
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 || chirps[0].ID != 1 || chirps[1].ID != 3 {
+		t.Fatalf("Unexpected chirps after restart: %v", chirps)
+	}
+}
+
+func TestIDsFromLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"Chirps":{"1":{"id":1,"author_id":1,"body":"old"},"7":{"id":7,"author_id":1,"body":"older"}}}`
+	if err := os.WriteFile(path, []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirp, err := db.CreateChirp("new", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 8 {
+		t.Fatalf("Expected chirp ID 8, got %d", chirp.ID)
+	}
+}
+
+func TestReadsServedFromMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.CreateChirp("first", 1, 0)
+	db.RevokeToken("token", time.Now().Add(time.Hour))
+
+	// Reads must not touch the file at all once the database is open
+	RemoveDB(path)
+	if _, err = db.GetChirp(1); err != nil {
+		t.Fatal(err)
+	}
+	if !db.IsTokenRevoked("token") {
+		t.Fatal("Revocation not found after database file was removed")
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDBWithOptions(path, Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateChirp("first", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dbs, err := readDBFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbs.Chirps) != 0 {
+		t.Fatal("Write-behind database wrote to disk before flushing")
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dbs, err = readDBFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbs.Chirps) != 1 {
+		t.Fatal("Pending changes were not flushed on Close")
+	}
+}
+
+func benchmarkDB(b *testing.B, opts Options) *DB {
+	b.Helper()
+	db, err := NewDBWithOptions(filepath.Join(b.TempDir(), "database.json"), opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	err = db.Update(func(dbs *DBStructure) error {
+		for i := 1; i <= 10000; i++ {
+			dbs.Chirps[i] = Chirp{ID: i, AuthorID: i % 100, Body: "This is a benchmark chirp!"}
+			dbs.Revocations[fmt.Sprint("token-", i)] = Revocation{RevokedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+		}
+		dbs.NextChirpID = 10001
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return db
+}
+
+func BenchmarkGetChirps(b *testing.B) {
+	db := benchmarkDB(b, Options{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.GetChirps()
+	}
+}
+
+func BenchmarkIsTokenRevoked(b *testing.B) {
+	db := benchmarkDB(b, Options{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.IsTokenRevoked("token-5000")
+	}
+}
+
+func BenchmarkCreateChirp(b *testing.B) {
+	for name, opts := range map[string]Options{
+		"sync":         {},
+		"write-behind": {FlushInterval: 100 * time.Millisecond},
+	} {
+		b.Run(name, func(b *testing.B) {
+			db := benchmarkDB(b, opts)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db.CreateChirp("This is a benchmark chirp!", 1, 0)
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := []byte(`{"Chirps":{"3":{"id":3,"author_id":1,"body":"old #News for @old"}},"Users":{"1":{"id":1,"email":"old@example.com"}},` +
+		`"Revocations":{"` + legacyJWT + `":"2024-12-01T00:00:00Z","opaque":"2024-12-01T00:00:00Z"}}`)
+	if err := os.WriteFile(path, legacy, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := MigrateDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != jsonSchemaVersion() {
+		t.Fatalf("Expected %d pending migrations, got %v", jsonSchemaVersion(), pending)
+	}
+	if buff, _ := os.ReadFile(path); string(buff) != string(legacy) {
+		t.Fatal("Dry run modified the database")
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if buff, _ := os.ReadFile(schemaBackupPath(path, 0)); string(buff) != string(legacy) {
+		t.Fatal("No backup of the database was taken before migrating")
+	}
+	db.View(func(dbs *DBStructure) error {
+		if dbs.SchemaVersion != jsonSchemaVersion() {
+			t.Fatalf("Expected schema version %d, got %d", jsonSchemaVersion(), dbs.SchemaVersion)
+		}
+		return nil
+	})
+	if pending, _ = MigrateDB(path, true); len(pending) != 0 {
+		t.Fatalf("Migrations still pending after open: %v", pending)
+	}
+	if user, err := db.GetUser(1); err != nil || user.Role != RoleUser {
+		t.Fatalf("Existing user wasn't given a role: %+v (%v)", user, err)
+	}
+	checkLegacyEntities(t, db)
+	checkLegacyRevocations(t, db)
+}
+
+// checkLegacyEntities checks that chirp 3, "old #News for @old", was parsed
+// when it was migrated
+func checkLegacyEntities(t *testing.T, db Store) {
+	t.Helper()
+
+	chirp, err := db.GetChirp(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirp.Entities) != 2 || chirp.Entities[0].Text != "news" || chirp.Entities[1].UserID != 1 {
+		t.Fatalf("Existing chirp wasn't parsed: %+v", chirp.Entities)
+	}
+	chirps, err := db.ListHashtag("news", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].ID != 3 {
+		t.Fatalf("Existing chirp missing from its hashtag: %+v", chirps)
+	}
+}
+
+// legacyJWT is a token that expires at the start of 2025, revoked at the
+// start of December 2024 in legacy databases
+const legacyJWT = "eyJhbGciOiJIUzI1NiJ9.eyJleHAiOjE3MzU2ODk2MDB9.signature"
+
+func checkLegacyRevocations(t *testing.T, db Store) {
+	t.Helper()
+	revokedAt := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	revocation, err := db.GetTokenRevocation(TokenKey(legacyJWT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revocation.RevokedAt.Equal(revokedAt) || !revocation.ExpiresAt.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected revocation %+v", revocation)
+	}
+	// Tokens without a readable expiry are kept as long as any token lasted
+	revocation, err = db.GetTokenRevocation(TokenKey("opaque"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revocation.ExpiresAt.Equal(revokedAt.Add(legacyTokenLifetime)) {
+		t.Fatalf("Unexpected revocation %+v", revocation)
+	}
+	if db.IsTokenRevoked(legacyJWT) {
+		t.Fatal("Revocation still stored under the token")
+	}
+}
+
+func TestMigrateSQLiteRevocations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+	sqlDB, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range sqliteMigrations[:13] {
+		if _, err = sqlDB.Exec(m.stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = sqlDB.Exec("PRAGMA user_version = 13")
+	if err == nil {
+		revokedAt := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+		_, err = sqlDB.Exec("INSERT INTO revocations (token, revoked_at) VALUES (?, ?), (?, ?)",
+			legacyJWT, revokedAt, "opaque", revokedAt)
+	}
+	sqlDB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkLegacyRevocations(t, db)
+}
+
+func TestRevocations(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			db.RevokeToken(TokenKey("expired"), now.Add(-time.Minute))
+			db.RevokeToken(TokenKey("valid"), now.Add(time.Hour))
+			db.RevokeToken(TokenKey("valid"), now.Add(2*time.Hour))
+
+			stats, err := db.RevocationStats(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats != (RevocationStats{Total: 2, Expired: 1}) {
+				t.Fatalf("Unexpected stats %+v", stats)
+			}
+			revocation, _ := db.GetTokenRevocation(TokenKey("valid"))
+			if !revocation.ExpiresAt.Equal(now.Add(time.Hour).UTC()) {
+				t.Fatal("Revoking a token again changed its revocation")
+			}
+
+			n, err := db.PruneRevocations(now)
+			if err != nil || n != 1 {
+				t.Fatalf("Expected 1 revocation pruned, got %d (%v)", n, err)
+			}
+			if db.IsTokenRevoked(TokenKey("expired")) || !db.IsTokenRevoked(TokenKey("valid")) {
+				t.Fatal("Pruned the wrong revocations")
+			}
+			if n, _ = db.PruneRevocations(now); n != 0 {
+				t.Fatalf("Pruned %d revocations twice", n)
+			}
+		})
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			db.RevokeToken(TokenKey("expired"), now.Add(-time.Hour))
+			db.RevokeToken(TokenKey("within leeway"), now.Add(-time.Second))
+
+			done := make(chan struct{})
+			go RunJanitor(db, 10*time.Millisecond, 24*time.Hour, time.Minute, done)
+			defer close(done)
+			for deadline := time.Now().Add(5 * time.Second); db.IsTokenRevoked(TokenKey("expired")); {
+				if time.Now().After(deadline) {
+					t.Fatal("Janitor didn't prune expired revocation")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			// Tokens are still accepted for the leeway after they expire
+			if !db.IsTokenRevoked(TokenKey("within leeway")) {
+				t.Fatal("Janitor pruned revocation within the leeway")
+			}
+		})
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	future := fmt.Sprintf(`{"schema_version":%d}`, jsonSchemaVersion()+1)
+	if err := os.WriteFile(path, []byte(future), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDB(path); err == nil {
+		t.Fatal("Opened a database with a newer schema version")
+	}
+}
+
+func TestChirpHistory(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			chirp, err := db.CreateChirp("first draft", 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.CreatedAt.IsZero() || !chirp.UpdatedAt.Equal(chirp.CreatedAt) {
+				t.Fatalf("Unexpected timestamps on new chirp: %v", chirp)
+			}
+			db.UpdateChirp(chirp.ID, "second draft")
+			edited, err := db.UpdateChirp(chirp.ID, "final")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !edited.CreatedAt.Equal(chirp.CreatedAt) || !edited.UpdatedAt.After(chirp.CreatedAt) {
+				t.Fatalf("Unexpected timestamps on edited chirp: %v", edited)
+			}
+
+			history, err := db.GetChirpHistory(chirp.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 3 || history[0].Body != "first draft" || history[2].Body != "final" {
+				t.Fatalf("Unexpected history: %v", history)
+			}
+			if !history[0].CreatedAt.Equal(chirp.CreatedAt) {
+				t.Fatal("First revision should carry the chirp's creation time")
+			}
+
+			db.DeleteChirp(chirp.ID)
+			if _, err = db.GetChirpHistory(chirp.ID); err == nil {
+				t.Fatal("Got history of deleted chirp")
+			}
+		})
+	}
+}
+
+func TestListChirps(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 1; i <= 10; i++ {
+				if _, err := db.CreateChirp(fmt.Sprint("chirp ", i), i%2+1, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Walk every page while chirps are added and removed in between
+			var seen []int
+			q := ChirpQuery{Limit: 3}
+			for {
+				page, err := db.ListChirps(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) == 0 {
+					break
+				}
+				for _, c := range page {
+					seen = append(seen, c.ID)
+				}
+				last := page[len(page)-1].Cursor()
+				q.After = &last
+
+				if len(seen) == 3 {
+					db.DeleteChirp(2)
+					db.CreateChirp("late chirp", 1, 0)
+				}
+			}
+			expected := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+			if fmt.Sprint(seen) != fmt.Sprint(expected) {
+				t.Fatalf("Expected pages to contain %v, got %v", expected, seen)
+			}
+
+			page, err := db.ListChirps(ChirpQuery{AuthorID: 1, Desc: true, Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) != 2 || page[0].ID != 11 || page[1].ID != 10 {
+				t.Fatalf("Unexpected newest chirps by author 1: %v", page)
+			}
+			after := page[1].Cursor()
+			page, err = db.ListChirps(ChirpQuery{AuthorID: 1, Desc: true, After: &after})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) != 3 || page[0].ID != 8 || page[2].ID != 4 {
+				t.Fatalf("Unexpected second page of chirps by author 1: %v", page)
+			}
+		})
+	}
+}
+
+func TestMigrateSQLiteEntities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+	sqlDB, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range sqliteMigrations[:6] {
+		if _, err = sqlDB.Exec(m.stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = sqlDB.Exec("PRAGMA user_version = 6")
+	if err == nil {
+		_, err = sqlDB.Exec("INSERT INTO users (pwh) VALUES (x'00')")
+	}
+	if err == nil {
+		_, err = sqlDB.Exec("INSERT INTO emails (email, user_id) VALUES ('old@example.com', 1)")
+	}
+	for i := 1; i <= 3 && err == nil; i++ {
+		_, err = sqlDB.Exec("INSERT INTO chirps (id, author_id, body) VALUES (?, 1, ?)", i, fmt.Sprint("chirp ", i))
+	}
+	if err == nil {
+		_, err = sqlDB.Exec("UPDATE chirps SET body = 'old #News for @old' WHERE id = 3")
+	}
+	sqlDB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkLegacyEntities(t, db)
+}
+
+func TestMigrateSQLitePagination(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+	sqlDB, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sqlDB.Exec(sqliteMigrations[0].stmt + "PRAGMA user_version = 1;")
+	if err == nil {
+		_, err = sqlDB.Exec("INSERT INTO users (pwh) VALUES (x'00')")
+	}
+	for i := 1; i <= 5 && err == nil; i++ {
+		_, err = sqlDB.Exec("INSERT INTO chirps (author_id, body) VALUES (1, ?)", fmt.Sprint("chirp ", i))
+	}
+	sqlDB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.CreateChirp("chirp 6", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, desc := range []bool{false, true} {
+		var seen []int
+		q := ChirpQuery{Desc: desc, Limit: 2}
+		for len(seen) <= 6 {
+			page, err := db.ListChirps(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) == 0 {
+				break
+			}
+			for _, c := range page {
+				seen = append(seen, c.ID)
+			}
+			last := page[len(page)-1].Cursor()
+			q.After = &last
+		}
+
+		expected := []int{1, 2, 3, 4, 5, 6}
+		if desc {
+			expected = []int{6, 5, 4, 3, 2, 1}
+		}
+		if fmt.Sprint(seen) != fmt.Sprint(expected) {
+			t.Fatalf("Expected pages (desc %v) to contain %v, got %v", desc, expected, seen)
+		}
+	}
+}
+
+func TestSearchChirps(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			bodies := []struct {
+				author int
+				body   string
+			}{
+				{1, "Learning Go web servers today"},         // 1
+				{2, "Servers in Go are fun, Go Go Go"},       // 2
+				{1, "My server crashed. Web scale problems"}, // 3
+				{2, "Nothing to see here"},                   // 4
+			}
+			for _, b := range bodies {
+				if _, err := db.CreateChirp(b.body, b.author, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			search := func(q SearchQuery) string {
+				t.Helper()
+				chirps, err := db.SearchChirps(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []int
+				for _, c := range chirps {
+					ids = append(ids, c.ID)
+				}
+				return fmt.Sprint(ids)
+			}
+
+			cases := []struct {
+				query    SearchQuery
+				expected string
+			}{
+				{SearchQuery{Query: "go"}, "[2 1]"},
+				{SearchQuery{Query: "server*"}, "[3 2 1]"},
+				{SearchQuery{Query: `"web servers"`}, "[1]"},
+				{SearchQuery{Query: `"servers web"`}, "[]"},
+				{SearchQuery{Query: "web server*"}, "[3 1]"},
+				{SearchQuery{Query: "server*", AuthorID: 2}, "[2]"},
+				{SearchQuery{Query: "server*", Limit: 1, Offset: 1}, "[2]"},
+				{SearchQuery{Query: "WEB"}, "[3 1]"},
+			}
+			for _, c := range cases {
+				if got := search(c.query); got != c.expected {
+					t.Errorf("Search %+v: expected %s, got %s", c.query, c.expected, got)
+				}
+			}
+
+			db.DeleteChirp(2)
+			db.UpdateChirp(1, "Learning Rust today")
+			if got := search(SearchQuery{Query: "go"}); got != "[]" {
+				t.Errorf("Search found deleted or edited chirps: %s", got)
+			}
+			if got := search(SearchQuery{Query: "rust"}); got != "[1]" {
+				t.Errorf("Search didn't find edited chirp: %s", got)
+			}
+			if _, err := db.SearchChirps(SearchQuery{Query: " * "}); err == nil {
+				t.Error("Searched with an empty query")
+			}
+		})
+	}
+}
+
+func TestThreads(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// 1
+			// ├── 2
+			// │   ├── 4
+			// │   └── 5
+			// └── 3
+			parents := []int{0, 1, 1, 2, 2}
+			for _, parent := range parents {
+				if _, err := db.CreateChirp("chirp", 1, parent); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.CreateChirp("orphan", 1, 100); err == nil {
+				t.Fatal("Replied to a chirp that doesn't exist")
+			}
+
+			var shape func(thread ChirpThread) string
+			shape = func(thread ChirpThread) string {
+				result := fmt.Sprintf("%d/%d", thread.ID, thread.ReplyCount)
+				for _, reply := range thread.Replies {
+					result += " (" + shape(reply) + ")"
+				}
+				return result
+			}
+
+			thread, err := db.GetThread(5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := shape(thread); got != "1/2 (2/2 (4/0) (5/0)) (3/0)" {
+				t.Fatalf("Unexpected thread: %s", got)
+			}
+
+			// A hidden chirp is left out of the threads of the chirps below it
+			if _, err = db.ModerateChirp(2, 1, ModHide, ""); err != nil {
+				t.Fatal(err)
+			}
+			// but not from its own, which only its author can see
+			for id, expected := range map[int]string{5: "5/0", 1: "1/1 (3/0)", 2: "1/1 (2/2 (4/0) (5/0)) (3/0)"} {
+				thread, err = db.GetThread(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := shape(thread); got != expected {
+					t.Fatalf("Unexpected thread of #%d with a hidden chirp: %s", id, got)
+				}
+			}
+			if _, err = db.ModerateChirp(2, 1, ModApprove, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// Replies to a deleted chirp move up to its parent
+			if err = db.DeleteChirp(2); err != nil {
+				t.Fatal(err)
+			}
+			thread, err = db.GetThread(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := shape(thread); got != "1/3 (3/0) (4/0) (5/0)" {
+				t.Fatalf("Unexpected thread after deleting a reply: %s", got)
+			}
+
+			// and become top-level chirps when it had no parent
+			if err = db.DeleteChirp(1); err != nil {
+				t.Fatal(err)
+			}
+			thread, err = db.GetThread(4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := shape(thread); got != "4/0" {
+				t.Fatalf("Unexpected thread after deleting the root: %s", got)
+			}
+		})
+	}
+}
+
+func TestFollowTimeline(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				if _, err := db.CreateUser(email, "password"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Chirps 1-6 are by users 1, 2, 3, 1, 2, 3
+			for i := 0; i < 6; i++ {
+				if _, err := db.CreateChirp("chirp", i%3+1, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := db.Follow(1, 1); err == nil {
+				t.Fatal("Followed self")
+			}
+			if err := db.Follow(1, 100); err == nil {
+				t.Fatal("Followed a user that doesn't exist")
+			}
+			for _, followee := range []int{2, 3, 2} {
+				if err := db.Follow(1, followee); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Follow(2, 3); err != nil {
+				t.Fatal(err)
+			}
+
+			userIDs := func(follows []Follow, err error) string {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result []int
+				for _, f := range follows {
+					result = append(result, f.UserID)
+				}
+				return fmt.Sprint(result)
+			}
+			if got := userIDs(db.GetFollowing(1)); got != "[2 3]" {
+				t.Fatalf("Unexpected following: %s", got)
+			}
+			if got := userIDs(db.GetFollowers(3)); got != "[1 2]" {
+				t.Fatalf("Unexpected followers: %s", got)
+			}
+
+			ids := func(chirps []Chirp, err error) string {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result []int
+				for _, c := range chirps {
+					result = append(result, c.ID)
+				}
+				return fmt.Sprint(result)
+			}
+			page, err := db.Timeline(1, nil, 3)
+			if got := ids(page, err); got != "[6 5 3]" {
+				t.Fatalf("Unexpected timeline: %s", got)
+			}
+			after := page[len(page)-1].Cursor()
+			if got := ids(db.Timeline(1, &after, 3)); got != "[2]" {
+				t.Fatalf("Unexpected second timeline page: %s", got)
+			}
+
+			if err = db.Unfollow(1, 3); err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(db.Timeline(1, nil, 0)); got != "[5 2]" {
+				t.Fatalf("Unexpected timeline after unfollowing: %s", got)
+			}
+			if got := userIDs(db.GetFollowers(3)); got != "[2]" {
+				t.Fatalf("Unexpected followers after unfollowing: %s", got)
+			}
+			if got := ids(db.Timeline(3, nil, 0)); got != "[]" {
+				t.Fatalf("Unexpected timeline for a user following nobody: %s", got)
+			}
+		})
+	}
+}
+
+func TestLikesAndRechirps(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"a@example.com", "b@example.com"} {
+				if _, err := db.CreateUser(email, "password"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := db.CreateChirp("chirp", 1, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := db.LikeChirp(100, 1); err == nil {
+				t.Fatal("Liked a chirp that doesn't exist")
+			}
+			for _, user := range []int{1, 2, 2} {
+				if _, err := db.LikeChirp(1, user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			chirp, err := db.UnlikeChirp(1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.LikeCount != 1 {
+				t.Fatalf("Expected 1 like, got %d", chirp.LikeCount)
+			}
+			liked, err := db.LikedChirps(2, []int{1, 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !liked[1] || liked[2] {
+				t.Fatalf("Unexpected liked chirps: %v", liked)
+			}
+
+			if _, err = db.Rechirp(1, 2, "first"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.Rechirp(1, 1, ""); err != nil {
+				t.Fatal(err)
+			}
+			// Rechirping again replaces the quote
+			chirp, err = db.Rechirp(1, 2, "second")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.RechirpCount != 2 {
+				t.Fatalf("Expected 2 rechirps, got %d", chirp.RechirpCount)
+			}
+			rechirps, err := db.GetRechirps(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rechirps) != 2 || rechirps[0].UserID != 2 || rechirps[0].Quote != "second" {
+				t.Fatalf("Unexpected rechirps: %+v", rechirps)
+			}
+			chirp, err = db.DeleteRechirp(1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.RechirpCount != 1 {
+				t.Fatalf("Expected 1 rechirp after deleting one, got %d", chirp.RechirpCount)
+			}
+
+			chirp, err = db.GetChirp(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.LikeCount != 1 || chirp.RechirpCount != 1 {
+				t.Fatalf("Counts not stored: %+v", chirp)
+			}
+
+			// A hidden chirp can't be unliked or unrechirped any more than it
+			// can be liked, so the response can't reveal it
+			if _, err = db.ModerateChirp(1, 1, ModHide, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.UnlikeChirp(1, 2); err == nil {
+				t.Fatal("Unliked a hidden chirp")
+			}
+			if _, err = db.DeleteRechirp(1, 2); err == nil {
+				t.Fatal("Deleted the rechirp of a hidden chirp")
+			}
+			if chirp, err = db.ModerateChirp(1, 1, ModApprove, ""); err != nil {
+				t.Fatal(err)
+			}
+			if chirp.LikeCount != 1 || chirp.RechirpCount != 1 {
+				t.Fatalf("Counts changed while the chirp was hidden: %+v", chirp)
+			}
+
+			// Likes go with the chirp when it is deleted
+			if err = db.DeleteChirp(1); err != nil {
+				t.Fatal(err)
+			}
+			liked, err = db.LikedChirps(2, []int{1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if liked[1] {
+				t.Fatal("Like survived deleting the chirp")
+			}
+		})
+	}
+}
+
+func TestParseEntities(t *testing.T) {
+	users := map[string]int{"alice": 1, "bob@example.com": 2}
+	resolve := func(mention string) int { return users[mention] }
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"no entities here", "[]"},
+		{"#Go and #go_lang", "[hashtag:go@0-3 hashtag:go_lang@8-16]"},
+		{"hi @alice.", "[mention:alice=1@3-9]"},
+		{"cc @bob@example.com, @carol", "[mention:bob@example.com=2@3-19]"},
+		{"email bob@example.com and a#b", "[]"},
+		{"#123 is not a tag but #1st is", "[hashtag:1st@22-26]"},
+		{"#Über!", "[hashtag:über@0-6]"},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, e := range parseEntities(tt.body, resolve) {
+			s := e.Type + ":" + e.Text
+			if e.UserID != 0 {
+				s += fmt.Sprintf("=%d", e.UserID)
+			}
+			got = append(got, fmt.Sprintf("%s@%d-%d", s, e.Start, e.End))
+		}
+		if fmt.Sprint(got) != tt.want {
+			t.Errorf("parseEntities(%q) = %v, want %s", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestHashtags(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"alice@example.com", "bob@example.com", "bob@example.org"} {
+				if _, err := db.CreateUser(email, "password"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			bodies := []string{
+				"#go is fun @alice",
+				"more #Go and #sql",
+				"#sql #sql #sql",
+				"ambiguous @bob and exact @bob@example.org",
+			}
+			for _, body := range bodies {
+				if _, err := db.CreateChirp(body, 1, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			chirp, err := db.GetChirp(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirp.Entities) != 2 || chirp.Entities[1].UserID != 1 {
+				t.Fatalf("Unexpected entities: %+v", chirp.Entities)
+			}
+			chirp, err = db.GetChirp(4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirp.Entities) != 1 || chirp.Entities[0].UserID != 3 {
+				t.Fatalf("Unexpected mentions: %+v", chirp.Entities)
+			}
+
+			// Changing an email changes the handle the user is mentioned by
+			if _, err = db.UpdateUser(3, map[string]string{"email": "robert@example.org"}); err != nil {
+				t.Fatal(err)
+			}
+			chirp, err = db.UpdateChirp(4, "now @bob and @Robert")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirp.Entities) != 2 || chirp.Entities[0].UserID != 2 || chirp.Entities[1].UserID != 3 {
+				t.Fatalf("Unexpected mentions after changing email: %+v", chirp.Entities)
+			}
+
+			ids := func(chirps []Chirp, err error) string {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result []int
+				for _, c := range chirps {
+					result = append(result, c.ID)
+				}
+				return fmt.Sprint(result)
+			}
+			if got := ids(db.ListHashtag("GO", nil, 0)); got != "[2 1]" {
+				t.Fatalf("Unexpected #go chirps: %s", got)
+			}
+
+			trending, err := db.TrendingHashtags(time.Now().Add(-time.Hour), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(trending) != "[{go 2} {sql 2}]" {
+				t.Fatalf("Unexpected trending hashtags: %v", trending)
+			}
+			trending, err = db.TrendingHashtags(time.Now().Add(time.Hour), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(trending) != 0 {
+				t.Fatalf("Chirps outside the window are trending: %v", trending)
+			}
+
+			// Editing a chirp updates its hashtags
+			if _, err = db.UpdateChirp(2, "no more tags"); err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(db.ListHashtag("go", nil, 0)); got != "[1]" {
+				t.Fatalf("Unexpected #go chirps after editing: %s", got)
+			}
+			if err = db.DeleteChirp(1); err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(db.ListHashtag("go", nil, 0)); got != "[]" {
+				t.Fatalf("Unexpected #go chirps after deleting: %s", got)
+			}
+		})
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"alice@example.com", "bob@example.com"} {
+				if _, err := db.CreateUser(email, "password"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Everything bob does to alice notifies her, nothing she does to herself does
+			steps := []func() error{
+				func() error { _, err := db.CreateChirp("hello @bob", 1, 0); return err },
+				func() error { _, err := db.CreateChirp("hi @alice", 2, 1); return err },
+				func() error { _, err := db.CreateChirp("talking to myself @alice", 1, 1); return err },
+				func() error { return db.Follow(2, 1) },
+				func() error { _, err := db.LikeChirp(1, 2); return err },
+				// Liking again while the first like is unread doesn't notify twice
+				func() error { _, err := db.UnlikeChirp(1, 2); return err },
+				func() error { _, err := db.LikeChirp(1, 2); return err },
+				func() error { _, err := db.LikeChirp(1, 1); return err },
+				func() error { _, err := db.UpdateUser(1, map[string]string{"is_chirpy_red": "true"}); return err },
+			}
+			for _, step := range steps {
+				if err := step(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			types := func(notifications []Notification, err error) string {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result []string
+				for _, n := range notifications {
+					result = append(result, n.Type)
+				}
+				return fmt.Sprint(result)
+			}
+			all, err := db.GetNotifications(NotificationQuery{UserID: 1})
+			if got := types(all, err); got != "[chirpy_red like follow reply]" {
+				t.Fatalf("Unexpected notifications: %s", got)
+			}
+			if all[3].ActorID != 2 || all[3].ChirpID != 2 {
+				t.Fatalf("Unexpected reply notification: %+v", all[3])
+			}
+			if got := types(db.GetNotifications(NotificationQuery{UserID: 2})); got != "[mention]" {
+				t.Fatalf("Unexpected notifications for bob: %s", got)
+			}
+
+			page, err := db.GetNotifications(NotificationQuery{UserID: 1, Before: all[1].ID, Limit: 1})
+			if got := types(page, err); got != "[follow]" {
+				t.Fatalf("Unexpected page of notifications: %s", got)
+			}
+
+			unread, err := db.MarkNotificationsRead(1, []int{all[0].ID, all[1].ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unread != 2 {
+				t.Fatalf("Expected 2 unread notifications, got %d", unread)
+			}
+			if got := types(db.GetNotifications(NotificationQuery{UserID: 1, UnreadOnly: true})); got != "[follow reply]" {
+				t.Fatalf("Unexpected unread notifications: %s", got)
+			}
+			if unread, err = db.MarkNotificationsRead(1, nil); err != nil || unread != 0 {
+				t.Fatalf("Expected no unread notifications, got %d (%v)", unread, err)
+			}
+			if unread, err = db.UnreadNotifications(2); err != nil || unread != 1 {
+				t.Fatalf("Marking alice's notifications changed bob's: %d (%v)", unread, err)
+			}
+
+			// Once the like has been read, liking again notifies again
+			db.UnlikeChirp(1, 2)
+			db.LikeChirp(1, 2)
+			if got := types(db.GetNotifications(NotificationQuery{UserID: 1, UnreadOnly: true})); got != "[like]" {
+				t.Fatalf("Unexpected notifications after liking again: %s", got)
+			}
+		})
+	}
+}
+
+func TestEvents(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			sub, missed := db.Events().Subscribe(0)
+			defer db.Events().Unsubscribe(sub)
+			if len(missed) != 0 {
+				t.Fatalf("New subscription missed events: %v", missed)
+			}
+
+			for i := 0; i < 2; i++ {
+				if _, err := db.CreateChirp("chirp", 1, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.DeleteChirp(1); err != nil {
+				t.Fatal(err)
+			}
+			// Deleting a chirp that doesn't exist isn't an event
+			if err := db.DeleteChirp(1); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			var first, last int64
+			for i := 0; i < 3; i++ {
+				e := <-sub.C
+				if i == 0 {
+					first = e.ID
+				}
+				last = e.ID
+				got = append(got, fmt.Sprintf("%d:%s:%d", e.ID-first, e.Type, e.Chirp.ID))
+			}
+			if fmt.Sprint(got) != "[0:chirp.created:1 1:chirp.created:2 2:chirp.deleted:1]" {
+				t.Fatalf("Unexpected events: %v", got)
+			}
+			select {
+			case e := <-sub.C:
+				t.Fatalf("Unexpected event: %+v", e)
+			default:
+			}
+
+			// A subscriber that reconnects catches up from the last event it saw
+			resumed, missed := db.Events().Subscribe(first)
+			db.Events().Unsubscribe(resumed)
+			if len(missed) != 2 || missed[0].ID != first+1 {
+				t.Fatalf("Unexpected missed events: %+v", missed)
+			}
+
+			// IDs don't start over when the store is opened again, so a client
+			// that reconnects to it isn't told it has seen the new events
+			if reopened := newBroker(); reopened.nextID <= last {
+				t.Fatalf("Event IDs started over at %d after %d", reopened.nextID, last)
+			}
+
+			// and one that falls behind is dropped
+			slow, _ := db.Events().Subscribe(0)
+			for i := 0; i <= subscriberBuffer; i++ {
+				if _, err := db.CreateChirp("chirp", 1, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for range slow.C {
+			}
+		})
+	}
+}
+
+func TestHeldChirps(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"alice@example.com", "bob@example.com"} {
+				if _, err := db.CreateUser(email, "password"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.CreateChirp("hello #go", 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			sub, _ := db.Events().Subscribe(0)
+			defer db.Events().Unsubscribe(sub)
+
+			held, err := db.HoldChirp("hi @alice #go", 2, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held.Status != ChirpHeld || held.Published() {
+				t.Fatalf("Expected a held chirp, got %+v", held)
+			}
+			if chirp, err := db.GetChirp(held.ID); err != nil || chirp.Status != ChirpHeld {
+				t.Fatalf("Held chirp wasn't stored: %+v (%v)", chirp, err)
+			}
+			if _, err = db.HoldChirp("reply", 1, held.ID); err == nil {
+				t.Fatal("Replied to a held chirp")
+			}
+			if _, err = db.LikeChirp(held.ID, 1); err == nil {
+				t.Fatal("Liked a held chirp")
+			}
+
+			// Held chirps are left out of everything public
+			if unread, _ := db.UnreadNotifications(1); unread != 0 {
+				t.Fatalf("Held chirp sent %d notifications", unread)
+			}
+			parent, _ := db.GetChirp(1)
+			if parent.ReplyCount != 0 {
+				t.Fatalf("Held chirp counted as a reply: %+v", parent)
+			}
+			ids := func(chirps []Chirp, err error) string {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result []int
+				for _, c := range chirps {
+					result = append(result, c.ID)
+				}
+				return fmt.Sprint(result)
+			}
+			if got := ids(db.ListChirps(ChirpQuery{})); got != "[1]" {
+				t.Fatalf("Unexpected chirps: %s", got)
+			}
+			if got := ids(db.ListHashtag("go", nil, 0)); got != "[1]" {
+				t.Fatalf("Unexpected #go chirps: %s", got)
+			}
+			if err = db.Follow(1, 2); err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(db.Timeline(1, nil, 0)); got != "[]" {
+				t.Fatalf("Unexpected timeline: %s", got)
+			}
+			if thread, err := db.GetThread(1); err != nil || len(thread.Replies) != 0 {
+				t.Fatalf("Unexpected thread: %+v (%v)", thread, err)
+			}
+			// The held chirp is still in its own thread, which only its author can see
+			if thread, err := db.GetThread(held.ID); err != nil || thread.ID != 1 || len(thread.Replies) != 1 || thread.Replies[0].ID != held.ID {
+				t.Fatalf("Held chirp missing from its own thread: %+v (%v)", thread, err)
+			}
+
+			if err = db.DeleteChirp(held.ID); err != nil {
+				t.Fatal(err)
+			}
+			if parent, _ = db.GetChirp(1); parent.ReplyCount != 0 {
+				t.Fatalf("Deleting a held chirp changed its parent: %+v", parent)
+			}
+			for len(sub.C) > 0 {
+				if e := <-sub.C; e.Type != EventNotification {
+					t.Fatalf("Unexpected event: %+v", e)
+				}
+			}
+		})
+	}
+}
+
+func TestModeration(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"alice@example.com", "bob@example.com", "mod@example.com"} {
+				if _, err := db.CreateUser(email, "password"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.CreateChirp("hello", 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.HoldChirp("hi @alice", 2, 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.CreateChirp("rude", 2, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.ReportChirp(2, 1, "held"); err == nil {
+				t.Fatal("Reported a held chirp")
+			}
+			first, err := db.ReportChirp(3, 1, "rude")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, err := db.ReportChirp(3, 1, "very rude"); err != nil || again.ID != first.ID || again.Reason != "rude" {
+				t.Fatalf("Reporting twice made a new report: %+v (%v)", again, err)
+			}
+			if _, err = db.ReportChirp(3, 3, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			queue := func(after, limit int) string {
+				items, err := db.ModerationQueue(after, limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var result []string
+				for _, item := range items {
+					result = append(result, fmt.Sprintf("%d:%d", item.Chirp.ID, len(item.Reports)))
+				}
+				return fmt.Sprint(result)
+			}
+			if got := queue(0, 0); got != "[2:0 3:2]" {
+				t.Fatalf("Unexpected queue: %s", got)
+			}
+			if got := queue(2, 1); got != "[3:2]" {
+				t.Fatalf("Unexpected page of the queue: %s", got)
+			}
+
+			// Approving the held reply publishes it and sends its notification
+			chirp, err := db.ModerateChirp(2, 3, ModApprove, "")
+			if err != nil || !chirp.Published() {
+				t.Fatalf("Failed to approve chirp: %+v (%v)", chirp, err)
+			}
+			if parent, _ := db.GetChirp(1); parent.ReplyCount != 1 {
+				t.Fatalf("Approved reply wasn't counted: %+v", parent)
+			}
+			if unread, _ := db.UnreadNotifications(1); unread != 1 {
+				t.Fatalf("Expected a reply notification, got %d", unread)
+			}
+
+			// Hiding takes a chirp out of listings and closes its reports
+			if chirp, err = db.ModerateChirp(3, 3, ModHide, "rude"); err != nil || chirp.Status != ChirpHidden {
+				t.Fatalf("Failed to hide chirp: %+v (%v)", chirp, err)
+			}
+			chirps, _ := db.ListChirps(ChirpQuery{})
+			if len(chirps) != 2 {
+				t.Fatalf("Expected 2 listed chirps, got %v", chirps)
+			}
+			if got := queue(0, 0); got != "[]" {
+				t.Fatalf("Unexpected queue: %s", got)
+			}
+			if _, err = db.ModerateChirp(3, 3, "ban", ""); err == nil {
+				t.Fatal("Applied an unknown action")
+			}
+
+			if _, err = db.ModerateChirp(2, 3, ModDelete, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.GetChirp(2); err == nil {
+				t.Fatal("Moderator deleted chirp still exists")
+			}
+			if parent, _ := db.GetChirp(1); parent.ReplyCount != 0 {
+				t.Fatalf("Deleted reply still counted: %+v", parent)
+			}
+
+			user, err := db.SuspendUser(2, 3, true, "spam")
+			if err != nil || !user.IsSuspended {
+				t.Fatalf("Failed to suspend user: %+v (%v)", user, err)
+			}
+			if user, err = db.GetUser(2); err != nil || !user.IsSuspended {
+				t.Fatalf("Suspension wasn't stored: %+v (%v)", user, err)
+			}
+
+			log, err := db.AuditLog(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actions []string
+			for _, e := range log {
+				actions = append(actions, fmt.Sprintf("%s:%d:%d", e.Action, e.ChirpID, e.UserID))
+			}
+			if fmt.Sprint(actions) != "[suspend:0:2 delete:2:2 hide:3:2 approve:2:2]" {
+				t.Fatalf("Unexpected audit log: %v", actions)
+			}
+			if page, _ := db.AuditLog(log[1].ID, 1); len(page) != 1 || page[0].ID != log[2].ID {
+				t.Fatalf("Unexpected page of the audit log: %+v", page)
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	tests := []struct {
+		role, required string
+		want           bool
+	}{
+		{RoleUser, RoleUser, true},
+		{RoleUser, RoleModerator, false},
+		{RoleModerator, RoleModerator, true},
+		{RoleModerator, RoleAdmin, false},
+		{RoleAdmin, RoleModerator, true},
+		{"", RoleUser, true},
+		{"", RoleModerator, false},
+		{"root", RoleAdmin, false},
+	}
+	for _, test := range tests {
+		if got := HasRole(test.role, test.required); got != test.want {
+			t.Errorf("HasRole(%q, %q) = %v, want %v", test.role, test.required, got, test.want)
+		}
+	}
+
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("user@example.com", "password")
+			if err != nil || user.Role != RoleUser {
+				t.Fatalf("New user isn't a user: %+v (%v)", user, err)
+			}
+			if _, err = db.SetRole(user.ID, 0, "root"); err == nil {
+				t.Fatal("Set an unknown role")
+			}
+			if _, err = db.SetRole(user.ID, 0, RoleModerator); err != nil {
+				t.Fatal(err)
+			}
+			if user, err = db.GetUser(user.ID); err != nil || user.Role != RoleModerator {
+				t.Fatalf("Role wasn't stored: %+v (%v)", user, err)
+			}
+			if users, _ := db.GetUsers(); len(users) != 1 || users[0].Role != RoleModerator {
+				t.Fatalf("Unexpected users: %+v", users)
+			}
+			log, _ := db.AuditLog(0, 0)
+			if len(log) != 1 || log[0].Action != ModSetRole || log[0].Note != RoleModerator {
+				t.Fatalf("Unexpected audit log: %+v", log)
+			}
+		})
+	}
+}
+
+func TestTimed(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var ops []string
+			db := Timed(store, func(op string, elapsed time.Duration) {
+				if elapsed < 0 {
+					t.Errorf("Negative duration for %s", op)
+				}
+				ops = append(ops, op)
+			})
+
+			user, err := db.CreateUser("timed@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.GetUser(user.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.GetChirp(12345); err == nil {
+				t.Fatal("Got missing chirp")
+			}
+			if db.Events() != store.Events() {
+				t.Fatal("Timed store has a different broker")
+			}
+
+			want := []string{"create_user", "get_user", "get_chirp"}
+			if !slices.Equal(ops, want) {
+				t.Fatalf("Expected %v, got %v", want, ops)
+			}
+		})
+	}
+}
+
+func TestTokenFamilies(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("tokens@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.CreateTokenFamily(user.ID+1, "a", "", ""); err == nil {
+				t.Fatal("Created token family for missing user")
+			}
+
+			family, err := db.CreateTokenFamily(user.ID, "a", "test-agent", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if family.UserID != user.ID || family.TokenID != "a" || family.UserAgent != "test-agent" || family.IP != "127.0.0.1" || family.Revoked() {
+				t.Fatalf("Unexpected family %+v", family)
+			}
+
+			family, err = db.RotateToken(family.ID, "a", "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if family.TokenID != "b" {
+				t.Fatalf("Expected token b, got %s", family.TokenID)
+			}
+
+			// Rotating a replaced token revokes the family
+			family, err = db.RotateToken(family.ID, "a", "c")
+			if !errors.Is(err, ErrTokenReused) {
+				t.Fatalf("Expected ErrTokenReused, got %v", err)
+			}
+			if !family.Revoked() {
+				t.Fatal("Family wasn't revoked")
+			}
+			if _, err = db.RotateToken(family.ID, "b", "c"); err == nil {
+				t.Fatal("Rotated token of revoked family")
+			}
+			stored, err := db.GetTokenFamily(family.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stored.Revoked() || stored.TokenID != "b" {
+				t.Fatalf("Unexpected stored family %+v", stored)
+			}
+
+			other, err := db.CreateTokenFamily(user.ID, "x", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other.ID == family.ID {
+				t.Fatal("Token families share an ID")
+			}
+			if err = db.RevokeTokenFamily(other.ID); err != nil {
+				t.Fatal(err)
+			}
+			revoked, _ := db.GetTokenFamily(other.ID)
+			if err = db.RevokeTokenFamily(other.ID); err != nil {
+				t.Fatal(err)
+			}
+			again, _ := db.GetTokenFamily(other.ID)
+			if !revoked.Revoked() || !again.RevokedAt.Equal(revoked.RevokedAt) {
+				t.Fatalf("Unexpected revocation times %v, %v", revoked.RevokedAt, again.RevokedAt)
+			}
+			if err = db.RevokeTokenFamily(other.ID + 100); err == nil {
+				t.Fatal("Revoked missing token family")
+			}
+
+			first, _ := db.CreateTokenFamily(user.ID, "y", "", "")
+			second, _ := db.CreateTokenFamily(user.ID, "z", "", "")
+			active, err := db.ListTokenFamilies(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(active) != 2 || active[0].ID != first.ID || active[1].ID != second.ID {
+				t.Fatalf("Unexpected active families %+v", active)
+			}
+			if after, err := db.TokensValidAfter(user.ID); err != nil || !after.IsZero() {
+				t.Fatalf("Unexpected token cutoff %v (%v)", after, err)
+			}
+			n, err := db.RevokeTokenFamilies(user.ID)
+			if err != nil || n != 2 {
+				t.Fatalf("Expected 2 families revoked, got %d (%v)", n, err)
+			}
+			// Tokens without a family are cut off too
+			if after, err := db.TokensValidAfter(user.ID); err != nil || after.Before(second.CreatedAt) {
+				t.Fatalf("Unexpected token cutoff %v (%v)", after, err)
+			}
+			if _, err = db.TokensValidAfter(user.ID + 1); err == nil {
+				t.Fatal("Got token cutoff of missing user")
+			}
+			if active, _ = db.ListTokenFamilies(user.ID); len(active) != 0 {
+				t.Fatalf("Families still active: %+v", active)
+			}
+
+			// Families are pruned once their last token was issued long enough ago
+			if n, err = db.PruneTokenFamilies(family.CreatedAt.Add(-time.Minute)); err != nil || n != 0 {
+				t.Fatalf("Pruned %d recent families (%v)", n, err)
+			}
+			recent, _ := db.CreateTokenFamily(user.ID, "w", "", "")
+			if n, err = db.PruneTokenFamilies(recent.RotatedAt); err != nil || n != 4 {
+				t.Fatalf("Expected 4 families pruned, got %d (%v)", n, err)
+			}
+			if _, err = db.GetTokenFamily(family.ID); err == nil {
+				t.Fatal("Pruned family still stored")
+			}
+			if active, _ = db.ListTokenFamilies(user.ID); len(active) != 1 || active[0].ID != recent.ID {
+				t.Fatalf("Pruned the wrong families: %+v", active)
+			}
+		})
+	}
+}
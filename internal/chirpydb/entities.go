@@ -0,0 +1,333 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	EntityHashtag = "hashtag"
+	EntityMention = "mention"
+)
+
+// Entity is a #hashtag or @mention found in a chirp's body. Start and End are
+// the byte offsets of the entity in the body, including the # or @.
+type Entity struct {
+	Type  string `json:"type"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	// Text is the lower case tag for hashtags, and the email or handle as
+	// written for mentions
+	Text string `json:"text"`
+	// UserID is the mentioned user
+	UserID int `json:"user_id,omitempty"`
+}
+
+// HashtagCount is the number of chirps that used a hashtag
+type HashtagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+func isMentionRune(r rune) bool {
+	return isWordRune(r) || strings.ContainsRune(".+-@", r)
+}
+
+// parseEntities finds the hashtags and mentions in a chirp body. resolve
+// returns the ID of the user a mention refers to, or 0 if there is none, in
+// which case the mention is left out.
+func parseEntities(body string, resolve func(mention string) int) []Entity {
+	var result []Entity
+
+	prev := ' '
+	for i := 0; i < len(body); {
+		r, size := utf8.DecodeRuneInString(body[i:])
+		start := i
+		i += size
+		if (r != '#' && r != '@') || isWordRune(prev) {
+			prev = r
+			continue
+		}
+		prev = r
+
+		match := isWordRune
+		if r == '@' {
+			match = isMentionRune
+		}
+		end := i
+		for end < len(body) {
+			next, nextSize := utf8.DecodeRuneInString(body[end:])
+			if !match(next) {
+				break
+			}
+			end += nextSize
+		}
+		// Don't include punctuation that ends a sentence
+		text := strings.TrimRight(body[i:end], ".-@")
+		if len(text) == 0 {
+			continue
+		}
+
+		switch {
+		case r == '#' && strings.IndexFunc(text, unicode.IsLetter) >= 0:
+			result = append(result, Entity{Type: EntityHashtag, Start: start, End: i + len(text), Text: strings.ToLower(text)})
+		case r == '@':
+			if id := resolve(text); id != 0 {
+				result = append(result, Entity{Type: EntityMention, Start: start, End: i + len(text), Text: text, UserID: id})
+			}
+		}
+		prev, _ = utf8.DecodeLastRuneInString(text)
+		i += len(text)
+	}
+
+	return result
+}
+
+// Hashtags returns the distinct hashtags of a chirp
+func (c Chirp) Hashtags() []string {
+	var result []string
+	for _, e := range c.Entities {
+		if e.Type == EntityHashtag && !slices.Contains(result, e.Text) {
+			result = append(result, e.Text)
+		}
+	}
+	return result
+}
+
+// handle is the part of an email address before the @, which users can be
+// mentioned by
+func handle(email string) string {
+	name, _, _ := strings.Cut(email, "@")
+	return name
+}
+
+// handleIndex is DBStructure.Emails keyed by lowercase handle instead, so
+// mentions by handle don't have to scan every user
+type handleIndex map[string]map[int]bool
+
+func newHandleIndex(emails map[string]int) handleIndex {
+	result := make(handleIndex)
+	for email, id := range emails {
+		result.add(email, id)
+	}
+	return result
+}
+
+func (idx handleIndex) add(email string, id int) {
+	h := strings.ToLower(handle(email))
+	if idx[h] == nil {
+		idx[h] = make(map[int]bool)
+	}
+	idx[h][id] = true
+}
+
+func (idx handleIndex) remove(email string, id int) {
+	h := strings.ToLower(handle(email))
+	delete(idx[h], id)
+	if len(idx[h]) == 0 {
+		delete(idx, h)
+	}
+}
+
+// resolveMention finds a user by email, or by handle if exactly one user has
+// it. The caller must hold db.mux.
+func (db *DB) resolveMention(mention string) int {
+	return db.handles.resolve(db.dbs.Emails, mention)
+}
+
+// resolve finds a user by email in emails, which the index was built from, or
+// by handle
+func (idx handleIndex) resolve(emails map[string]int, mention string) int {
+	if strings.Contains(mention, "@") {
+		return emails[mention]
+	}
+
+	ids := idx[strings.ToLower(mention)]
+	if len(ids) != 1 {
+		return 0
+	}
+	for id := range ids {
+		return id
+	}
+	return 0
+}
+
+// sortedTrending orders hashtag counts from most to least used
+func sortedTrending(counts map[string]int, limit int) []HashtagCount {
+	var result []HashtagCount
+	for tag, count := range counts {
+		result = append(result, HashtagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Tag < result[j].Tag
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// ListHashtag returns chirps tagged with tag, newest first
+func (db *DB) ListHashtag(tag string, after *ChirpCursor, limit int) ([]Chirp, error) {
+	var chirps []Chirp
+
+	err := db.View(func(dbs *DBStructure) error {
+		keys := db.index.byTag[strings.ToLower(tag)]
+		end := len(keys)
+		if after != nil {
+			end = sort.Search(len(keys), func(i int) bool { return !keys[i].before(*after) })
+		}
+		for i := end - 1; i >= 0 && (limit == 0 || len(chirps) < limit); i-- {
+			chirps = append(chirps, dbs.Chirps[keys[i].ID])
+		}
+		return nil
+	})
+
+	return chirps, err
+}
+
+// TrendingHashtags counts the chirps posted since a time that used each
+// hashtag, and returns the limit most used
+func (db *DB) TrendingHashtags(since time.Time, limit int) ([]HashtagCount, error) {
+	counts := make(map[string]int)
+
+	err := db.View(func(dbs *DBStructure) error {
+		keys := db.index.all
+		for i := len(keys) - 1; i >= 0 && !keys[i].CreatedAt.Before(since); i-- {
+			for _, tag := range dbs.Chirps[keys[i].ID].Hashtags() {
+				counts[tag]++
+			}
+		}
+		return nil
+	})
+
+	return sortedTrending(counts, limit), err
+}
+
+// resolveSQLiteMention is resolveMention for the SQLite store
+func resolveSQLiteMention(tx *sql.Tx, mention string) int {
+	var id int
+
+	if strings.Contains(mention, "@") {
+		tx.QueryRow("SELECT user_id FROM emails WHERE email = ?", mention).Scan(&id)
+		return id
+	}
+
+	// _ is a wildcard in LIKE patterns, and LIKE is case insensitive for ASCII
+	pattern := strings.ReplaceAll(mention, "_", `\_`) + "@%"
+	rows, err := tx.Query(`SELECT user_id FROM emails WHERE email LIKE ? ESCAPE '\' LIMIT 2`, pattern)
+	if err != nil {
+		return 0
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if id != 0 {
+			return 0
+		}
+		rows.Scan(&id)
+	}
+	return id
+}
+
+// setSQLiteEntities parses the body of a chirp and stores its entities and
+// hashtags
+func setSQLiteEntities(tx *sql.Tx, chirp *Chirp) error {
+	chirp.Entities = parseEntities(chirp.Body, func(mention string) int {
+		return resolveSQLiteMention(tx, mention)
+	})
+
+	entities, err := json.Marshal(chirp.Entities)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE chirps SET entities = ? WHERE id = ?", entities, chirp.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM hashtags WHERE chirp_id = ?", chirp.ID)
+	if err != nil {
+		return err
+	}
+	for _, tag := range chirp.Hashtags() {
+		_, err = tx.Exec("INSERT INTO hashtags (tag, chirp_id) VALUES (?, ?)", tag, chirp.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) ListHashtag(tag string, after *ChirpCursor, limit int) ([]Chirp, error) {
+	var chirps []Chirp
+
+	query := "SELECT " + chirpColumns + " FROM chirps WHERE status = '' AND id IN (SELECT chirp_id FROM hashtags WHERE tag = ?)"
+	args := []any{strings.ToLower(tag)}
+	if after != nil {
+		query += " AND (created_at, id) < (?, ?)"
+		args = append(args, after.CreatedAt.UTC(), after.ID)
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return chirps, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return chirps, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (db *SQLiteDB) TrendingHashtags(since time.Time, limit int) ([]HashtagCount, error) {
+	var result []HashtagCount
+
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.db.Query(`
+		SELECT h.tag, count(*) AS uses FROM hashtags h JOIN chirps c ON c.id = h.chirp_id
+		WHERE c.created_at >= ? AND c.status = ''
+		GROUP BY h.tag ORDER BY uses DESC, h.tag LIMIT ?`, since.UTC(), limit)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hc HashtagCount
+		err = rows.Scan(&hc.Tag, &hc.Count)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, hc)
+	}
+
+	return result, rows.Err()
+}
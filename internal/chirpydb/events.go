@@ -0,0 +1,153 @@
+package chirpydb
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventChirpCreated = "chirp.created"
+	EventChirpDeleted = "chirp.deleted"
+	EventNotification = "notification"
+
+	// EventHistory is the number of recent events kept for subscribers that
+	// reconnect and want to catch up
+	EventHistory = 1000
+	// subscriberBuffer is the number of events a subscriber may fall behind
+	// by before it is dropped
+	subscriberBuffer = 64
+)
+
+// Event is a change to the chirps in a store, or a new notification for one
+// user. IDs increase by one with every event. They start from the time the
+// store was opened in microseconds, so they keep increasing when it is opened
+// again and a client that saw events before then catches up from the start of
+// the history.
+type Event struct {
+	ID           int64
+	Type         string
+	Chirp        Chirp
+	Notification Notification
+}
+
+// Subscription receives events published after it was created. C is closed
+// when the subscriber falls too far behind or the broker is closed.
+type Subscription struct {
+	C  <-chan Event
+	ch chan Event
+}
+
+// Broker delivers chirp events from a store to its subscribers
+type Broker struct {
+	mux     sync.Mutex
+	nextID  int64
+	history []Event
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+func newBroker() *Broker {
+	return &Broker{
+		nextID: time.Now().UnixMicro(),
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe starts a subscription. If lastID is non-zero, the events after
+// it that are still in the history are returned so the subscriber can catch
+// up before reading from the subscription.
+func (b *Broker) Subscribe(lastID int64) (*Subscription, []Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	ch := make(chan Event, subscriberBuffer)
+	sub := &Subscription{C: ch, ch: ch}
+	if b.closed {
+		close(ch)
+		return sub, nil
+	}
+	b.subs[sub] = struct{}{}
+
+	var missed []Event
+	if lastID > 0 {
+		for _, e := range b.history {
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	return sub, missed
+}
+
+// Unsubscribe ends a subscription
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Close ends every subscription
+func (b *Broker) Close() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+func (b *Broker) publish(typ string, chirp Chirp) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.publishLocked(Event{Type: typ, Chirp: chirp})
+}
+
+func (b *Broker) publishNotifications(notifications []Notification) {
+	if len(notifications) == 0 {
+		return
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for _, n := range notifications {
+		b.publishLocked(Event{Type: EventNotification, Notification: n})
+	}
+}
+
+func (b *Broker) publishLocked(e Event) {
+	e.ID = b.nextID
+	b.nextID++
+	if len(b.history) == EventHistory {
+		copy(b.history, b.history[1:])
+		b.history = b.history[:EventHistory-1]
+	}
+	b.history = append(b.history, e)
+
+	for sub := range b.subs {
+		select {
+		case sub.ch <- e:
+		default:
+			// Don't let a slow subscriber hold up the store. It can
+			// reconnect and catch up from the history.
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+func (db *DB) Events() *Broker {
+	return db.events
+}
+
+func (db *SQLiteDB) Events() *Broker {
+	return db.events
+}
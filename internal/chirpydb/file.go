@@ -0,0 +1,199 @@
+package chirpydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultBackups is the number of previous database snapshots kept by NewDB
+const DefaultBackups = 3
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// RemoveDB deletes the database at path along with its backups and, for
+// SQLite, its journal files
+func RemoveDB(path string) error {
+	backups, _ := filepath.Glob(path + ".[0-9]*")
+	schemaBackups, _ := filepath.Glob(path + ".schema-v*")
+	for _, b := range append(backups, schemaBackups...) {
+		os.Remove(b)
+	}
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic replaces path with data so that a crash at any point leaves
+// either the old or the new contents on disk, never a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	perm := fs.FileMode(0666)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory entry change (e.g. a rename) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if errors.Is(err, os.ErrInvalid) || errors.Is(err, os.ErrPermission) {
+		// Some platforms can't fsync directories
+		return nil
+	}
+	return err
+}
+
+// rotateBackups shifts path.1 through path.n-1 up by one and copies the
+// current contents of path to path.1. The oldest snapshot is dropped.
+func rotateBackups(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	for i := n - 1; i > 0; i-- {
+		err := os.Rename(backupPath(path, i), backupPath(path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	dst := backupPath(path, 1)
+	os.Remove(dst)
+	if os.Link(path, dst) == nil {
+		return nil
+	}
+
+	// Hard links aren't supported everywhere, so fall back to a copy
+	return copyFile(path, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkDBFile returns an error if the file at path isn't a database of any
+// schema version. Older versions can't be read as a DBStructure until they
+// have been migrated.
+func checkDBFile(path string) error {
+	var doc jsonDocument
+	buff, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buff, &doc)
+}
+
+func readDBFile(path string) (DBStructure, error) {
+	var dbs DBStructure
+	buff, err := os.ReadFile(path)
+	if err != nil {
+		return dbs, err
+	}
+	err = json.Unmarshal(buff, &dbs)
+	return dbs, err
+}
+
+// recoverDB replaces a missing or corrupt database file with the newest
+// backup that can still be loaded. The corrupt file is kept for inspection.
+func recoverDB(path string, backups int, cause error) error {
+	for i := 1; i <= backups; i++ {
+		src := backupPath(path, i)
+		buff, err := os.ReadFile(src)
+		if err != nil {
+			continue
+		}
+		var doc jsonDocument
+		if json.Unmarshal(buff, &doc) != nil {
+			continue
+		}
+
+		if _, err := os.Stat(path); err == nil {
+			corrupt := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+			err = os.Rename(path, corrupt)
+			if err != nil {
+				return err
+			}
+			log.Printf("Moved unreadable database %s to %s", path, corrupt)
+		}
+
+		err = writeFileAtomic(path, buff)
+		if err != nil {
+			return err
+		}
+		log.Printf("Recovered database %s from %s (%s)", path, src, cause)
+		return nil
+	}
+
+	return fmt.Errorf("Database %s is unreadable and no valid backup was found: %w", path, cause)
+}
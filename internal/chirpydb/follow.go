@@ -0,0 +1,294 @@
+package chirpydb
+
+import (
+	"container/heap"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Follow is one side of a follow relationship: the other user and when the
+// relationship started
+type Follow struct {
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func sortFollows(follows []Follow) {
+	sort.Slice(follows, func(i, j int) bool {
+		if !follows[i].CreatedAt.Equal(follows[j].CreatedAt) {
+			return follows[i].CreatedAt.Before(follows[j].CreatedAt)
+		}
+		return follows[i].UserID < follows[j].UserID
+	})
+}
+
+// followers inverts the follow graph so both directions can be listed
+func followers(follows map[int]map[int]time.Time) map[int]map[int]time.Time {
+	result := make(map[int]map[int]time.Time)
+	for follower, following := range follows {
+		for followee, since := range following {
+			if result[followee] == nil {
+				result[followee] = make(map[int]time.Time)
+			}
+			result[followee][follower] = since
+		}
+	}
+	return result
+}
+
+// cursorHeap holds the next chirp of each followed author, newest on top
+type cursorHeap []authorCursor
+
+type authorCursor struct {
+	keys []ChirpCursor
+	pos  int
+}
+
+func (h cursorHeap) Len() int { return len(h) }
+func (h cursorHeap) Less(i, j int) bool {
+	return h[j].keys[h[j].pos].before(h[i].keys[h[i].pos])
+}
+func (h cursorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)   { *h = append(*h, x.(authorCursor)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// merge returns up to limit of the newest chirps by any of authors that come
+// after the cursor. Each author's chirps are already in order, so this is a
+// k-way merge rather than a scan of every chirp.
+func (idx *chirpIndex) merge(authors []int, after *ChirpCursor, limit int) []ChirpCursor {
+	var h cursorHeap
+	for _, author := range authors {
+		keys := idx.byAuthor[author]
+		end := len(keys)
+		if after != nil {
+			end = sort.Search(len(keys), func(i int) bool { return !keys[i].before(*after) })
+		}
+		if end > 0 {
+			h = append(h, authorCursor{keys: keys, pos: end - 1})
+		}
+	}
+	heap.Init(&h)
+
+	var result []ChirpCursor
+	for h.Len() > 0 && (limit == 0 || len(result) < limit) {
+		top := &h[0]
+		result = append(result, top.keys[top.pos])
+		if top.pos == 0 {
+			heap.Pop(&h)
+		} else {
+			top.pos--
+			heap.Fix(&h, 0)
+		}
+	}
+
+	return result
+}
+
+func (db *DB) Follow(followerID, followeeID int) error {
+	if followerID == followeeID {
+		return errors.New("Users can't follow themselves")
+	}
+
+	return db.Update(func(dbs *DBStructure) error {
+		if _, ok := dbs.Users[followeeID]; !ok {
+			return errors.New("User id does not exist")
+		}
+		if _, ok := dbs.Follows[followerID][followeeID]; ok {
+			return nil
+		}
+
+		since := time.Now().UTC()
+		if dbs.Follows[followerID] == nil {
+			dbs.Follows[followerID] = make(map[int]time.Time)
+		}
+		dbs.Follows[followerID][followeeID] = since
+		if db.followers[followeeID] == nil {
+			db.followers[followeeID] = make(map[int]time.Time)
+		}
+		db.followers[followeeID][followerID] = since
+		dbs.notify(Notification{UserID: followeeID, Type: NotifyFollow, ActorID: followerID})
+		return nil
+	})
+}
+
+func (db *DB) Unfollow(followerID, followeeID int) error {
+	return db.Update(func(dbs *DBStructure) error {
+		delete(dbs.Follows[followerID], followeeID)
+		if len(dbs.Follows[followerID]) == 0 {
+			delete(dbs.Follows, followerID)
+		}
+		delete(db.followers[followeeID], followerID)
+		if len(db.followers[followeeID]) == 0 {
+			delete(db.followers, followeeID)
+		}
+		return nil
+	})
+}
+
+// GetFollowers returns the users following id, oldest relationship first
+func (db *DB) GetFollowers(id int) ([]Follow, error) {
+	var result []Follow
+
+	err := db.View(func(dbs *DBStructure) error {
+		for follower, since := range db.followers[id] {
+			result = append(result, Follow{UserID: follower, CreatedAt: since})
+		}
+		return nil
+	})
+	sortFollows(result)
+
+	return result, err
+}
+
+// GetFollowing returns the users id follows, oldest relationship first
+func (db *DB) GetFollowing(id int) ([]Follow, error) {
+	var result []Follow
+
+	err := db.View(func(dbs *DBStructure) error {
+		for followee, since := range dbs.Follows[id] {
+			result = append(result, Follow{UserID: followee, CreatedAt: since})
+		}
+		return nil
+	})
+	sortFollows(result)
+
+	return result, err
+}
+
+// Timeline returns chirps by the users userID follows, newest first. Pass
+// the cursor of the last chirp of the previous page to get the next one.
+func (db *DB) Timeline(userID int, after *ChirpCursor, limit int) ([]Chirp, error) {
+	var chirps []Chirp
+
+	err := db.View(func(dbs *DBStructure) error {
+		var authors []int
+		for followee := range dbs.Follows[userID] {
+			authors = append(authors, followee)
+		}
+		for _, key := range db.index.merge(authors, after, limit) {
+			chirps = append(chirps, dbs.Chirps[key.ID])
+		}
+		return nil
+	})
+
+	return chirps, err
+}
+
+func (db *SQLiteDB) Follow(followerID, followeeID int) error {
+	if followerID == followeeID {
+		return errors.New("Users can't follow themselves")
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", followeeID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("User id does not exist")
+	}
+
+	res, err := tx.Exec("INSERT OR IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)",
+		followerID, followeeID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	var outbox []Notification
+	if n, _ := res.RowsAffected(); n > 0 {
+		err = notifySQLite(tx, &outbox, Notification{UserID: followeeID, Type: NotifyFollow, ActorID: followerID})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		db.events.publishNotifications(outbox)
+	}
+	return err
+}
+
+func (db *SQLiteDB) Unfollow(followerID, followeeID int) error {
+	_, err := db.db.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerID, followeeID)
+	return err
+}
+
+func (db *SQLiteDB) queryFollows(query string, id int) ([]Follow, error) {
+	var result []Follow
+
+	rows, err := db.db.Query(query, id)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f Follow
+		err = rows.Scan(&f.UserID, &f.CreatedAt)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, f)
+	}
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) GetFollowers(id int) ([]Follow, error) {
+	return db.queryFollows(`
+		SELECT follower_id, created_at FROM follows
+		WHERE followee_id = ? ORDER BY created_at, follower_id`, id)
+}
+
+func (db *SQLiteDB) GetFollowing(id int) ([]Follow, error) {
+	return db.queryFollows(`
+		SELECT followee_id, created_at FROM follows
+		WHERE follower_id = ? ORDER BY created_at, followee_id`, id)
+}
+
+func (db *SQLiteDB) Timeline(userID int, after *ChirpCursor, limit int) ([]Chirp, error) {
+	var chirps []Chirp
+	var rows *sql.Rows
+	var err error
+
+	query := "SELECT " + chirpColumns + " FROM chirps WHERE status = '' AND author_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)"
+	args := []any{userID}
+	if after != nil {
+		query += " AND (created_at, id) < (?, ?)"
+		args = append(args, after.CreatedAt.UTC(), after.ID)
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err = db.db.Query(query, args...)
+	if err != nil {
+		return chirps, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return chirps, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, rows.Err()
+}
@@ -0,0 +1,206 @@
+package chirpydb
+
+import (
+	"sort"
+	"time"
+)
+
+// ChirpCursor is a position in the chronological order of chirps. Chirps are
+// ordered by creation time, with ties broken by ID.
+type ChirpCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+// Cursor returns the position of c in chronological order
+func (c Chirp) Cursor() ChirpCursor {
+	return ChirpCursor{CreatedAt: c.CreatedAt, ID: c.ID}
+}
+
+func (c ChirpCursor) before(o ChirpCursor) bool {
+	if !c.CreatedAt.Equal(o.CreatedAt) {
+		return c.CreatedAt.Before(o.CreatedAt)
+	}
+	return c.ID < o.ID
+}
+
+// ChirpQuery selects one page of chirps
+type ChirpQuery struct {
+	// AuthorID limits the page to one author's chirps when non-zero
+	AuthorID int
+	// Desc lists the newest chirps first
+	Desc bool
+	// After skips every chirp up to and including this position, in the
+	// direction of the query. Pass the cursor of the last chirp of the
+	// previous page to get the next one.
+	After *ChirpCursor
+	// Limit is the maximum number of chirps returned, or 0 for no limit
+	Limit int
+}
+
+// chirpIndex keeps the resident JSON database's published chirps in
+// chronological order, overall and per author, so a page can be found with a
+// binary search instead of sorting every chirp.
+type chirpIndex struct {
+	all      []ChirpCursor
+	byAuthor map[int][]ChirpCursor
+	// replies maps a chirp ID to the IDs of its direct replies, published or not
+	replies map[int][]int
+	// byTag holds the chirps using each hashtag
+	byTag map[string][]ChirpCursor
+}
+
+func newChirpIndex(chirps map[int]Chirp) *chirpIndex {
+	idx := &chirpIndex{
+		byAuthor: make(map[int][]ChirpCursor),
+		replies:  make(map[int][]int),
+		byTag:    make(map[string][]ChirpCursor),
+	}
+	for _, c := range chirps {
+		if c.InReplyTo != 0 {
+			idx.replies[c.InReplyTo] = append(idx.replies[c.InReplyTo], c.ID)
+		}
+		if !c.Published() {
+			continue
+		}
+		idx.all = append(idx.all, c.Cursor())
+		idx.byAuthor[c.AuthorID] = append(idx.byAuthor[c.AuthorID], c.Cursor())
+		for _, tag := range c.Hashtags() {
+			idx.byTag[tag] = append(idx.byTag[tag], c.Cursor())
+		}
+	}
+
+	sortCursors(idx.all)
+	for _, keys := range idx.byAuthor {
+		sortCursors(keys)
+	}
+	for _, keys := range idx.byTag {
+		sortCursors(keys)
+	}
+
+	return idx
+}
+
+func sortCursors(keys []ChirpCursor) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].before(keys[j]) })
+}
+
+func (idx *chirpIndex) add(c Chirp) {
+	if c.InReplyTo != 0 {
+		idx.replies[c.InReplyTo] = append(idx.replies[c.InReplyTo], c.ID)
+	}
+	if c.Published() {
+		idx.show(c)
+	}
+}
+
+// show lists a chirp that has been published
+func (idx *chirpIndex) show(c Chirp) {
+	idx.all = insertCursor(idx.all, c.Cursor())
+	idx.byAuthor[c.AuthorID] = insertCursor(idx.byAuthor[c.AuthorID], c.Cursor())
+	idx.addTags(c)
+}
+
+// hide stops listing a chirp without forgetting its place in the conversation
+func (idx *chirpIndex) hide(c Chirp) {
+	idx.all = removeCursor(idx.all, c.Cursor())
+	idx.byAuthor[c.AuthorID] = removeCursor(idx.byAuthor[c.AuthorID], c.Cursor())
+	if len(idx.byAuthor[c.AuthorID]) == 0 {
+		delete(idx.byAuthor, c.AuthorID)
+	}
+	idx.removeTags(c)
+}
+
+func (idx *chirpIndex) addTags(c Chirp) {
+	for _, tag := range c.Hashtags() {
+		idx.byTag[tag] = insertCursor(idx.byTag[tag], c.Cursor())
+	}
+}
+
+func (idx *chirpIndex) removeTags(c Chirp) {
+	for _, tag := range c.Hashtags() {
+		idx.byTag[tag] = removeCursor(idx.byTag[tag], c.Cursor())
+		if len(idx.byTag[tag]) == 0 {
+			delete(idx.byTag, tag)
+		}
+	}
+}
+
+// retag updates the hashtags of a chirp that was edited from old to c
+func (idx *chirpIndex) retag(old, c Chirp) {
+	idx.removeTags(old)
+	idx.addTags(c)
+}
+
+// remove drops c from the index. Its replies must already have been moved.
+func (idx *chirpIndex) remove(c Chirp) {
+	if c.Published() {
+		idx.hide(c)
+	}
+
+	if c.InReplyTo != 0 {
+		siblings := idx.replies[c.InReplyTo]
+		for i, id := range siblings {
+			if id == c.ID {
+				siblings = append(siblings[:i], siblings[i+1:]...)
+				break
+			}
+		}
+		idx.replies[c.InReplyTo] = siblings
+		if len(siblings) == 0 {
+			delete(idx.replies, c.InReplyTo)
+		}
+	}
+	delete(idx.replies, c.ID)
+}
+
+func insertCursor(keys []ChirpCursor, k ChirpCursor) []ChirpCursor {
+	// New chirps almost always belong at the end
+	if len(keys) == 0 || keys[len(keys)-1].before(k) {
+		return append(keys, k)
+	}
+
+	i := sort.Search(len(keys), func(i int) bool { return k.before(keys[i]) })
+	keys = append(keys, ChirpCursor{})
+	copy(keys[i+1:], keys[i:])
+	keys[i] = k
+	return keys
+}
+
+func removeCursor(keys []ChirpCursor, k ChirpCursor) []ChirpCursor {
+	i := sort.Search(len(keys), func(i int) bool { return !keys[i].before(k) })
+	if i < len(keys) && keys[i].ID == k.ID {
+		keys = append(keys[:i], keys[i+1:]...)
+	}
+	return keys
+}
+
+// page returns the positions of the chirps selected by q
+func (idx *chirpIndex) page(q ChirpQuery) []ChirpCursor {
+	keys := idx.all
+	if q.AuthorID != 0 {
+		keys = idx.byAuthor[q.AuthorID]
+	}
+
+	var result []ChirpCursor
+	if q.Desc {
+		end := len(keys)
+		if q.After != nil {
+			end = sort.Search(len(keys), func(i int) bool { return !keys[i].before(*q.After) })
+		}
+		for i := end - 1; i >= 0 && (q.Limit == 0 || len(result) < q.Limit); i-- {
+			result = append(result, keys[i])
+		}
+		return result
+	}
+
+	start := 0
+	if q.After != nil {
+		start = sort.Search(len(keys), func(i int) bool { return q.After.before(keys[i]) })
+	}
+	end := len(keys)
+	if q.Limit > 0 {
+		end = min(end, start+q.Limit)
+	}
+	return append(result, keys[start:end]...)
+}
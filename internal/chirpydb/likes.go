@@ -0,0 +1,336 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rechirp is a user sharing someone's chirp, optionally with their own
+// comment on it
+type Rechirp struct {
+	UserID    int       `json:"user_id"`
+	Quote     string    `json:"quote,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LikeChirp records that userID likes a chirp and returns the chirp with its
+// new like count. Liking a chirp twice has no effect, and neither does liking
+// it again after unliking it while its author hasn't read the first like.
+func (db *DB) LikeChirp(chirpID, userID int) (Chirp, error) {
+	var result Chirp
+
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		result, ok = dbs.Chirps[chirpID]
+		if !ok || !result.Published() {
+			return errors.New("Invalid chirp ID")
+		}
+		if _, ok = dbs.Likes[chirpID][userID]; ok {
+			return nil
+		}
+
+		if dbs.Likes[chirpID] == nil {
+			dbs.Likes[chirpID] = make(map[int]time.Time)
+		}
+		dbs.Likes[chirpID][userID] = time.Now().UTC()
+		result.LikeCount++
+		dbs.Chirps[chirpID] = result
+		n := Notification{UserID: result.AuthorID, Type: NotifyLike, ActorID: userID, ChirpID: chirpID}
+		if !dbs.unread(n) {
+			dbs.notify(n)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// UnlikeChirp removes userID's like from a chirp and returns the chirp with
+// its new like count. It only works while the chirp is published, as
+// LikeChirp does, so it can't reveal a chirp that was hidden since.
+func (db *DB) UnlikeChirp(chirpID, userID int) (Chirp, error) {
+	var result Chirp
+
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		result, ok = dbs.Chirps[chirpID]
+		if !ok || !result.Published() {
+			return errors.New("Invalid chirp ID")
+		}
+		if _, ok = dbs.Likes[chirpID][userID]; !ok {
+			return nil
+		}
+
+		delete(dbs.Likes[chirpID], userID)
+		if len(dbs.Likes[chirpID]) == 0 {
+			delete(dbs.Likes, chirpID)
+		}
+		result.LikeCount--
+		dbs.Chirps[chirpID] = result
+		return nil
+	})
+
+	return result, err
+}
+
+// LikedChirps reports which of chirpIDs userID has liked
+func (db *DB) LikedChirps(userID int, chirpIDs []int) (map[int]bool, error) {
+	result := make(map[int]bool)
+
+	err := db.View(func(dbs *DBStructure) error {
+		for _, id := range chirpIDs {
+			if _, ok := dbs.Likes[id][userID]; ok {
+				result[id] = true
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// Rechirp records that userID shared a chirp and returns the chirp with its
+// new rechirp count. Rechirping a chirp again replaces the quote.
+func (db *DB) Rechirp(chirpID, userID int, quote string) (Chirp, error) {
+	var result Chirp
+
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		result, ok = dbs.Chirps[chirpID]
+		if !ok || !result.Published() {
+			return errors.New("Invalid chirp ID")
+		}
+
+		if dbs.Rechirps[chirpID] == nil {
+			dbs.Rechirps[chirpID] = make(map[int]Rechirp)
+		}
+		rechirp, ok := dbs.Rechirps[chirpID][userID]
+		if !ok {
+			rechirp = Rechirp{UserID: userID, CreatedAt: time.Now().UTC()}
+			result.RechirpCount++
+			dbs.Chirps[chirpID] = result
+		}
+		rechirp.Quote = quote
+		dbs.Rechirps[chirpID][userID] = rechirp
+		return nil
+	})
+
+	return result, err
+}
+
+// DeleteRechirp removes userID's rechirp of a chirp and returns the chirp with
+// its new rechirp count. It only works while the chirp is published, as
+// UnlikeChirp does.
+func (db *DB) DeleteRechirp(chirpID, userID int) (Chirp, error) {
+	var result Chirp
+
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		result, ok = dbs.Chirps[chirpID]
+		if !ok || !result.Published() {
+			return errors.New("Invalid chirp ID")
+		}
+		if _, ok = dbs.Rechirps[chirpID][userID]; !ok {
+			return nil
+		}
+
+		delete(dbs.Rechirps[chirpID], userID)
+		if len(dbs.Rechirps[chirpID]) == 0 {
+			delete(dbs.Rechirps, chirpID)
+		}
+		result.RechirpCount--
+		dbs.Chirps[chirpID] = result
+		return nil
+	})
+
+	return result, err
+}
+
+// GetRechirps returns the rechirps of a chirp, oldest first
+func (db *DB) GetRechirps(chirpID int) ([]Rechirp, error) {
+	var result []Rechirp
+
+	err := db.View(func(dbs *DBStructure) error {
+		if _, ok := dbs.Chirps[chirpID]; !ok {
+			return errors.New("Invalid chirp ID")
+		}
+		for _, rechirp := range dbs.Rechirps[chirpID] {
+			result = append(result, rechirp)
+		}
+		return nil
+	})
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return result[i].UserID < result[j].UserID
+	})
+
+	return result, err
+}
+
+// updateCounter runs stmt and, if it changed a row, adjusts a counter column
+// of the chirp by delta and calls changed in the same transaction. It returns
+// the chirp as it is afterwards.
+func (db *SQLiteDB) updateCounter(chirpID int, column string, delta int, changed func(tx *sql.Tx, chirp Chirp) error, stmt string, args ...any) (Chirp, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := db.getChirp(tx, chirpID)
+	if err != nil {
+		return result, err
+	}
+	if !result.Published() {
+		return result, errors.New("Invalid chirp ID")
+	}
+
+	res, err := tx.Exec(stmt, args...)
+	if err != nil {
+		return result, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		_, err = tx.Exec("UPDATE chirps SET "+column+" = "+column+" + ? WHERE id = ?", delta, chirpID)
+		if err != nil {
+			return result, err
+		}
+		result, err = db.getChirp(tx, chirpID)
+		if err != nil {
+			return result, err
+		}
+		if changed != nil {
+			err = changed(tx, result)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, tx.Commit()
+}
+
+func (db *SQLiteDB) LikeChirp(chirpID, userID int) (Chirp, error) {
+	var outbox []Notification
+	notifyAuthor := func(tx *sql.Tx, chirp Chirp) error {
+		n := Notification{UserID: chirp.AuthorID, Type: NotifyLike, ActorID: userID, ChirpID: chirpID}
+		unread, err := unreadSQLite(tx, n)
+		if err != nil || unread {
+			return err
+		}
+		return notifySQLite(tx, &outbox, n)
+	}
+	result, err := db.updateCounter(chirpID, "like_count", 1, notifyAuthor,
+		"INSERT OR IGNORE INTO likes (chirp_id, user_id, created_at) VALUES (?, ?, ?)",
+		chirpID, userID, time.Now().UTC())
+	if err == nil {
+		db.events.publishNotifications(outbox)
+	}
+
+	return result, err
+}
+
+func (db *SQLiteDB) UnlikeChirp(chirpID, userID int) (Chirp, error) {
+	return db.updateCounter(chirpID, "like_count", -1, nil,
+		"DELETE FROM likes WHERE chirp_id = ? AND user_id = ?", chirpID, userID)
+}
+
+func (db *SQLiteDB) LikedChirps(userID int, chirpIDs []int) (map[int]bool, error) {
+	result := make(map[int]bool)
+	if len(chirpIDs) == 0 {
+		return result, nil
+	}
+
+	args := []any{userID}
+	for _, id := range chirpIDs {
+		args = append(args, id)
+	}
+	placeholders := strings.Repeat(", ?", len(chirpIDs))[2:]
+	rows, err := db.db.Query("SELECT chirp_id FROM likes WHERE user_id = ? AND chirp_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return result, err
+		}
+		result[id] = true
+	}
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) Rechirp(chirpID, userID int, quote string) (Chirp, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := db.getChirp(tx, chirpID)
+	if err != nil {
+		return result, err
+	}
+	if !result.Published() {
+		return result, errors.New("Invalid chirp ID")
+	}
+
+	res, err := tx.Exec("UPDATE rechirps SET quote = ? WHERE chirp_id = ? AND user_id = ?", quote, chirpID, userID)
+	if err != nil {
+		return result, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec("INSERT INTO rechirps (chirp_id, user_id, quote, created_at) VALUES (?, ?, ?, ?)",
+			chirpID, userID, quote, time.Now().UTC())
+		if err != nil {
+			return result, err
+		}
+		_, err = tx.Exec("UPDATE chirps SET rechirp_count = rechirp_count + 1 WHERE id = ?", chirpID)
+		if err != nil {
+			return result, err
+		}
+		result.RechirpCount++
+	}
+
+	return result, tx.Commit()
+}
+
+func (db *SQLiteDB) DeleteRechirp(chirpID, userID int) (Chirp, error) {
+	return db.updateCounter(chirpID, "rechirp_count", -1, nil,
+		"DELETE FROM rechirps WHERE chirp_id = ? AND user_id = ?", chirpID, userID)
+}
+
+func (db *SQLiteDB) GetRechirps(chirpID int) ([]Rechirp, error) {
+	var result []Rechirp
+	var rows *sql.Rows
+
+	_, err := db.GetChirp(chirpID)
+	if err != nil {
+		return result, err
+	}
+
+	rows, err = db.db.Query("SELECT user_id, quote, created_at FROM rechirps WHERE chirp_id = ? ORDER BY created_at, user_id", chirpID)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rechirp Rechirp
+		err = rows.Scan(&rechirp.UserID, &rechirp.Quote, &rechirp.CreatedAt)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, rechirp)
+	}
+
+	return result, rows.Err()
+}
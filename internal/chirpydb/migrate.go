@@ -0,0 +1,654 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Migration describes one step in the schema history of a database.
+// Version is the schema version the database is at after it has run.
+type Migration struct {
+	Version     int
+	Description string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("v%d: %s", m.Version, m.Description)
+}
+
+// jsonDocument is the raw form of database.json that migrations operate on,
+// since DBStructure only describes the newest schema.
+type jsonDocument map[string]json.RawMessage
+
+type jsonMigration struct {
+	Migration
+	up func(doc jsonDocument) error
+}
+
+// jsonMigrations must be kept in order. Append new migrations to the end and
+// never change one that has been released.
+var jsonMigrations = []jsonMigration{
+	{
+		Migration{1, "Store chirp and user ID counters"},
+		func(doc jsonDocument) error {
+			for collection, counter := range map[string]string{"Chirps": "NextChirpID", "Users": "NextUserID"} {
+				next, err := nextKey(doc, collection)
+				if err != nil {
+					return err
+				}
+				doc[counter], _ = json.Marshal(next)
+			}
+			return nil
+		},
+	},
+	{
+		Migration{2, "Add created_at and updated_at to chirps and users"},
+		func(doc jsonDocument) error {
+			// The real creation times are unknown, so use the time of the migration
+			now, _ := json.Marshal(time.Now().UTC())
+			for _, collection := range []string{"Chirps", "Users"} {
+				err := setDefaults(doc, collection, map[string]json.RawMessage{
+					"created_at": now,
+					"updated_at": now,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration{3, "Store notification ID counter"},
+		func(doc jsonDocument) error {
+			doc["NextNotificationID"], _ = json.Marshal(1)
+			return nil
+		},
+	},
+	{
+		Migration{4, "Store report and audit ID counters"},
+		func(doc jsonDocument) error {
+			doc["NextReportID"], _ = json.Marshal(1)
+			doc["NextAuditID"], _ = json.Marshal(1)
+			return nil
+		},
+	},
+	{
+		Migration{5, "Add roles to users"},
+		func(doc jsonDocument) error {
+			role, _ := json.Marshal(RoleUser)
+			return setDefaults(doc, "Users", map[string]json.RawMessage{"role": role})
+		},
+	},
+	{
+		Migration{6, "Store token family ID counter"},
+		func(doc jsonDocument) error {
+			doc["NextTokenFamilyID"], _ = json.Marshal(1)
+			return nil
+		},
+	},
+	{
+		Migration{7, "Key revocations by token hash and store their expiry"},
+		func(doc jsonDocument) error {
+			var legacy map[string]time.Time
+			raw, ok := doc["Revocations"]
+			if !ok {
+				return nil
+			}
+			err := json.Unmarshal(raw, &legacy)
+			if err != nil {
+				return err
+			}
+
+			revocations := make(map[string]Revocation, len(legacy))
+			for token, revokedAt := range legacy {
+				key, revocation := legacyRevocation(token, revokedAt)
+				revocations[key] = revocation
+			}
+			doc["Revocations"], err = json.Marshal(revocations)
+			return err
+		},
+	},
+	{
+		Migration{8, "Parse hashtags and mentions in existing chirps"},
+		func(doc jsonDocument) error {
+			var users map[string]struct {
+				ID    int    `json:"id"`
+				Email string `json:"email"`
+			}
+			var chirps map[string]map[string]json.RawMessage
+
+			raw, ok := doc["Chirps"]
+			if !ok {
+				return nil
+			}
+			err := json.Unmarshal(raw, &chirps)
+			if err != nil {
+				return err
+			}
+			if raw, ok = doc["Users"]; ok {
+				err = json.Unmarshal(raw, &users)
+				if err != nil {
+					return err
+				}
+			}
+
+			emails := make(map[string]int)
+			for _, user := range users {
+				emails[user.Email] = user.ID
+			}
+			handles := newHandleIndex(emails)
+			resolve := func(mention string) int { return handles.resolve(emails, mention) }
+			for _, chirp := range chirps {
+				if _, ok := chirp["entities"]; ok {
+					continue
+				}
+				var body string
+				err = json.Unmarshal(chirp["body"], &body)
+				if err != nil {
+					return err
+				}
+				if entities := parseEntities(body, resolve); len(entities) > 0 {
+					chirp["entities"], _ = json.Marshal(entities)
+				}
+			}
+
+			doc["Chirps"], err = json.Marshal(chirps)
+			return err
+		},
+	},
+}
+
+// jsonSchemaVersion is the schema version of databases written by this package
+func jsonSchemaVersion() int {
+	return len(jsonMigrations)
+}
+
+func init() {
+	for i, m := range jsonMigrations {
+		if m.Version != i+1 {
+			panic(fmt.Sprintf("chirpydb: JSON migration %q is out of order", m.Description))
+		}
+	}
+}
+
+// nextKey returns one more than the largest integer key of a collection
+func nextKey(doc jsonDocument, collection string) (int, error) {
+	var items map[string]json.RawMessage
+	next := 1
+
+	raw, ok := doc[collection]
+	if !ok {
+		return next, nil
+	}
+	err := json.Unmarshal(raw, &items)
+	if err != nil {
+		return next, err
+	}
+	for key := range items {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return next, fmt.Errorf("Invalid %s key %q", collection, key)
+		}
+		next = max(next, id+1)
+	}
+
+	return next, nil
+}
+
+// setDefaults adds fields to every object in a collection that doesn't have them
+func setDefaults(doc jsonDocument, collection string, fields map[string]json.RawMessage) error {
+	var items map[string]map[string]json.RawMessage
+
+	raw, ok := doc[collection]
+	if !ok {
+		return nil
+	}
+	err := json.Unmarshal(raw, &items)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		for field, value := range fields {
+			if _, ok := item[field]; !ok {
+				item[field] = value
+			}
+		}
+	}
+
+	doc[collection], err = json.Marshal(items)
+	return err
+}
+
+func schemaBackupPath(path string, version int) string {
+	return fmt.Sprintf("%s.schema-v%d", path, version)
+}
+
+// MigrateDB brings the JSON database at path up to the current schema version
+// and returns the migrations it ran. The original file is copied to
+// path.schema-vN before it is changed. With dryRun, the migrations are run
+// and checked in memory but nothing is written.
+func MigrateDB(path string, dryRun bool) ([]Migration, error) {
+	var applied []Migration
+
+	buff, err := os.ReadFile(path)
+	if err != nil {
+		return applied, err
+	}
+	var doc jsonDocument
+	err = json.Unmarshal(buff, &doc)
+	if err != nil {
+		return applied, err
+	}
+
+	version := 0
+	if raw, ok := doc["schema_version"]; ok {
+		err = json.Unmarshal(raw, &version)
+		if err != nil {
+			return applied, err
+		}
+	}
+	if version > jsonSchemaVersion() {
+		return applied, fmt.Errorf("Database schema version %d is newer than supported version %d", version, jsonSchemaVersion())
+	}
+
+	for _, m := range jsonMigrations[version:] {
+		err = m.up(doc)
+		if err != nil {
+			return applied, fmt.Errorf("Migration %s failed: %w", m, err)
+		}
+		doc["schema_version"], _ = json.Marshal(m.Version)
+		applied = append(applied, m.Migration)
+	}
+	if len(applied) == 0 {
+		return applied, nil
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return applied, err
+	}
+	var dbs DBStructure
+	err = json.Unmarshal(migrated, &dbs)
+	if err != nil {
+		return applied, fmt.Errorf("Migrated database does not load: %w", err)
+	}
+	if dryRun {
+		return applied, nil
+	}
+
+	backup := schemaBackupPath(path, version)
+	err = copyFile(path, backup)
+	if err != nil {
+		return applied, err
+	}
+	err = writeFileAtomic(path, migrated)
+	if err != nil {
+		return applied, err
+	}
+	log.Printf("Migrated database %s from schema v%d to v%d (backup at %s)", path, version, jsonSchemaVersion(), backup)
+
+	return applied, nil
+}
+
+type sqliteMigration struct {
+	Migration
+	stmt string
+}
+
+// sqliteMigrations must be kept in order. The schema version of a SQLite
+// database is stored in PRAGMA user_version.
+var sqliteMigrations = []sqliteMigration{
+	{
+		Migration{1, "Create chirps, users, emails and revocations tables"},
+		`
+		CREATE TABLE IF NOT EXISTS chirps (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			author_id INTEGER NOT NULL,
+			body      TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps (author_id);
+
+		CREATE TABLE IF NOT EXISTS users (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			pwh           BLOB NOT NULL,
+			is_chirpy_red INTEGER NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE IF NOT EXISTS emails (
+			email   TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL UNIQUE REFERENCES users (id) ON DELETE CASCADE
+		);
+
+		CREATE TABLE IF NOT EXISTS revocations (
+			token      TEXT PRIMARY KEY,
+			revoked_at DATETIME NOT NULL
+		);`,
+	},
+	{
+		Migration{2, "Add created_at and updated_at to chirps and users, and chirp edit history"},
+		`
+		ALTER TABLE chirps ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+		ALTER TABLE chirps ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+		ALTER TABLE users ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+		ALTER TABLE users ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+		UPDATE chirps SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP;
+		UPDATE users SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP;
+
+		CREATE TABLE chirp_history (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+			body       TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX chirp_history_chirp_id ON chirp_history (chirp_id);`,
+	},
+	{
+		Migration{3, "Index chirps by creation time for pagination"},
+		`
+		CREATE INDEX chirps_created_at ON chirps (created_at, id);
+		DROP INDEX chirps_author_id;
+		CREATE INDEX chirps_author_id_created_at ON chirps (author_id, created_at, id);`,
+	},
+	{
+		Migration{4, "Add replies to chirps"},
+		`
+		ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER REFERENCES chirps (id);
+		ALTER TABLE chirps ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+		CREATE INDEX chirps_in_reply_to ON chirps (in_reply_to);`,
+	},
+	{
+		Migration{5, "Add follows"},
+		`
+		CREATE TABLE follows (
+			follower_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			followee_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			created_at  DATETIME NOT NULL,
+			PRIMARY KEY (follower_id, followee_id)
+		);
+		CREATE INDEX follows_followee_id ON follows (followee_id);`,
+	},
+	{
+		Migration{6, "Add likes and rechirps"},
+		`
+		ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE chirps ADD COLUMN rechirp_count INTEGER NOT NULL DEFAULT 0;
+
+		CREATE TABLE likes (
+			chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+			user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (chirp_id, user_id)
+		);
+
+		CREATE TABLE rechirps (
+			chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+			user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			quote      TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (chirp_id, user_id)
+		);`,
+	},
+	{
+		Migration{7, "Add hashtag and mention entities to chirps"},
+		`
+		ALTER TABLE chirps ADD COLUMN entities TEXT NOT NULL DEFAULT 'null';
+
+		CREATE TABLE hashtags (
+			tag      TEXT NOT NULL,
+			chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+			PRIMARY KEY (tag, chirp_id)
+		);
+		CREATE INDEX hashtags_chirp_id ON hashtags (chirp_id);`,
+	},
+	{
+		Migration{8, "Add notifications"},
+		`
+		CREATE TABLE notifications (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			type       TEXT NOT NULL,
+			actor_id   INTEGER,
+			chirp_id   INTEGER,
+			created_at DATETIME NOT NULL,
+			read       INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX notifications_user_id ON notifications (user_id, read, id);`,
+	},
+	{
+		Migration{9, "Add chirp status"},
+		`ALTER TABLE chirps ADD COLUMN status TEXT NOT NULL DEFAULT '';`,
+	},
+	{
+		Migration{10, "Add reports, suspensions and the moderation audit log"},
+		`
+		ALTER TABLE users ADD COLUMN suspended INTEGER NOT NULL DEFAULT 0;
+		CREATE TABLE reports (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			chirp_id    INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+			reporter_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			reason      TEXT NOT NULL DEFAULT '',
+			created_at  DATETIME NOT NULL,
+			UNIQUE (chirp_id, reporter_id)
+		);
+		CREATE TABLE audit_log (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			moderator_id INTEGER NOT NULL,
+			action       TEXT NOT NULL,
+			chirp_id     INTEGER,
+			user_id      INTEGER NOT NULL,
+			note         TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL
+		);`,
+	},
+	{
+		Migration{11, "Add roles to users"},
+		`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+	},
+	{
+		Migration{12, "Add refresh token families"},
+		`
+		CREATE TABLE token_families (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			token_id   TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			rotated_at DATETIME NOT NULL,
+			revoked_at DATETIME
+		);`,
+	},
+	{
+		Migration{13, "Add the user agent and IP address of token families"},
+		`
+		ALTER TABLE token_families ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+		ALTER TABLE token_families ADD COLUMN ip TEXT NOT NULL DEFAULT '';`,
+	},
+	{
+		Migration{14, "Key revocations by token hash and store their expiry"},
+		`
+		CREATE TABLE token_revocations (
+			token_hash TEXT PRIMARY KEY,
+			revoked_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		);
+		CREATE INDEX token_revocations_expires_at ON token_revocations (expires_at);`,
+	},
+	{
+		// Migration 2 backfilled times with CURRENT_TIMESTAMP, which doesn't
+		// compare as text with the times the driver writes, so cursors skipped
+		// or repeated those chirps
+		Migration{15, "Store backfilled chirp and user times in the driver's format"},
+		`
+		UPDATE chirps SET created_at = created_at || '+00:00' WHERE length(created_at) = 19;
+		UPDATE chirps SET updated_at = updated_at || '+00:00' WHERE length(updated_at) = 19;
+		UPDATE users SET created_at = created_at || '+00:00' WHERE length(created_at) = 19;
+		UPDATE users SET updated_at = updated_at || '+00:00' WHERE length(updated_at) = 19;`,
+	},
+	{
+		Migration{16, "Add the time tokens without a session were revoked to users"},
+		`ALTER TABLE users ADD COLUMN tokens_valid_after DATETIME;`,
+	},
+	{
+		// The schema doesn't change, so it is all done by migrateEntities
+		Migration{17, "Parse hashtags and mentions in existing chirps"},
+		``,
+	},
+}
+
+// sqliteMigrationFuncs are the parts of migrations that SQL can't express,
+// keyed by version. Each runs after its migration's statements.
+var sqliteMigrationFuncs = map[int]func(tx *sql.Tx) error{
+	14: migrateRevocationKeys,
+	17: migrateEntities,
+}
+
+// migrateRevocationKeys moves revocations stored with the whole token to
+// token_revocations
+func migrateRevocationKeys(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT token, revoked_at FROM revocations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	revocations := make(map[string]Revocation)
+	for rows.Next() {
+		var token string
+		var revokedAt time.Time
+		if err = rows.Scan(&token, &revokedAt); err != nil {
+			return err
+		}
+		key, revocation := legacyRevocation(token, revokedAt.UTC())
+		revocations[key] = revocation
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for key, r := range revocations {
+		_, err = tx.Exec("INSERT INTO token_revocations (token_hash, revoked_at, expires_at) VALUES (?, ?, ?)",
+			key, r.RevokedAt, r.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DROP TABLE revocations")
+	return err
+}
+
+// migrateEntities parses the chirps posted before entities were, storing
+// their entities and hashtags
+func migrateEntities(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, body FROM chirps WHERE entities = 'null'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var chirps []Chirp
+	for rows.Next() {
+		var chirp Chirp
+		if err = rows.Scan(&chirp.ID, &chirp.Body); err != nil {
+			return err
+		}
+		chirps = append(chirps, chirp)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for i := range chirps {
+		err = setSQLiteEntities(tx, &chirps[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	for i, m := range sqliteMigrations {
+		if m.Version != i+1 {
+			panic(fmt.Sprintf("chirpydb: SQLite migration %q is out of order", m.Description))
+		}
+	}
+}
+
+// MigrateSQLiteDB brings the SQLite database at path up to the current schema
+// version and returns the migrations it ran. A copy of an existing database is
+// written to path.schema-vN first. With dryRun, the migrations are run in a
+// transaction that is rolled back.
+func MigrateSQLiteDB(path string, dryRun bool) ([]Migration, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return migrateSQLite(db, path, dryRun)
+}
+
+func migrateSQLite(db *sql.DB, path string, dryRun bool) ([]Migration, error) {
+	var applied []Migration
+	var version, tables int
+
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return applied, err
+	}
+	if version > len(sqliteMigrations) {
+		return applied, fmt.Errorf("Database schema version %d is newer than supported version %d", version, len(sqliteMigrations))
+	}
+	pending := sqliteMigrations[version:]
+	if len(pending) == 0 {
+		return applied, nil
+	}
+
+	err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables)
+	if err != nil {
+		return applied, err
+	}
+	backup := schemaBackupPath(path, version)
+	if !dryRun && tables > 0 {
+		os.Remove(backup)
+		_, err = db.Exec("VACUUM INTO ?", backup)
+		if err != nil {
+			return applied, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return applied, err
+	}
+	defer tx.Rollback()
+
+	for _, m := range pending {
+		_, err = tx.Exec(m.stmt)
+		if up, ok := sqliteMigrationFuncs[m.Version]; ok && err == nil {
+			err = up(tx)
+		}
+		if err != nil {
+			return applied, fmt.Errorf("Migration %s failed: %w", m, err)
+		}
+		applied = append(applied, m.Migration)
+	}
+	// PRAGMA doesn't accept bound parameters
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(sqliteMigrations)))
+	if err != nil || dryRun {
+		return applied, err
+	}
+
+	err = tx.Commit()
+	if err == nil && tables > 0 {
+		log.Printf("Migrated database %s from schema v%d to v%d (backup at %s)", path, version, len(sqliteMigrations), backup)
+	}
+	return applied, err
+}
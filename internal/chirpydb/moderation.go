@@ -0,0 +1,497 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Moderator actions, as recorded in the audit log
+const (
+	ModApprove   = "approve"
+	ModHide      = "hide"
+	ModDelete    = "delete"
+	ModSuspend   = "suspend"
+	ModUnsuspend = "unsuspend"
+	ModSetRole   = "set_role"
+)
+
+// ChirpHidden is the status of a chirp a moderator has taken out of public
+// view. Like held chirps, hidden chirps can be approved to publish them again.
+const ChirpHidden = "hidden"
+
+// Report is a user's complaint about a chirp. A chirp's reports are closed
+// when a moderator acts on it.
+type Report struct {
+	ID         int       `json:"id"`
+	ChirpID    int       `json:"chirp_id"`
+	ReporterID int       `json:"reporter_id"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ModerationItem is a chirp waiting for a moderator because it was held by
+// the filter, reported by users, or both
+type ModerationItem struct {
+	Chirp   Chirp    `json:"chirp"`
+	Reports []Report `json:"reports"`
+}
+
+// AuditEntry records a moderator action. UserID is the user acted on, which
+// for chirp actions is the chirp's author.
+type AuditEntry struct {
+	ID          int       `json:"id"`
+	ModeratorID int       `json:"moderator_id"`
+	Action      string    `json:"action"`
+	ChirpID     int       `json:"chirp_id,omitempty"`
+	UserID      int       `json:"user_id"`
+	Note        string    `json:"note,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// chirpStatus returns the status a moderator action leaves a chirp in
+func chirpStatus(action string) (string, error) {
+	switch action {
+	case ModApprove:
+		return "", nil
+	case ModHide:
+		return ChirpHidden, nil
+	}
+	return "", errors.New("Unknown moderation action")
+}
+
+// changeEvent returns the event for a chirp that went from old to chirp, or
+// an empty string if it didn't appear or disappear
+func changeEvent(old, chirp Chirp) string {
+	if old.Published() && !chirp.Published() {
+		return EventChirpDeleted
+	} else if !old.Published() && chirp.Published() {
+		return EventChirpCreated
+	}
+	return ""
+}
+
+func (dbs *DBStructure) audit(e AuditEntry) {
+	e.ID = dbs.NextAuditID
+	e.CreatedAt = time.Now().UTC()
+	dbs.Audit = append(dbs.Audit, e)
+	dbs.NextAuditID++
+}
+
+// ReportChirp records a user's report on a published chirp. Reporting a chirp
+// again returns the open report.
+func (db *DB) ReportChirp(chirpID, reporterID int, reason string) (Report, error) {
+	var result Report
+
+	err := db.Update(func(dbs *DBStructure) error {
+		chirp, ok := dbs.Chirps[chirpID]
+		if !ok || !chirp.Published() {
+			return errors.New("Invalid chirp ID")
+		}
+		for _, report := range dbs.Reports[chirpID] {
+			if report.ReporterID == reporterID {
+				result = report
+				return nil
+			}
+		}
+
+		result = Report{
+			ID:         dbs.NextReportID,
+			ChirpID:    chirpID,
+			ReporterID: reporterID,
+			Reason:     reason,
+			CreatedAt:  time.Now().UTC(),
+		}
+		dbs.Reports[chirpID] = append(dbs.Reports[chirpID], result)
+		dbs.NextReportID++
+		return nil
+	})
+
+	return result, err
+}
+
+// ModerationQueue returns the chirps waiting for a moderator, oldest first,
+// starting after the chirp with ID after
+func (db *DB) ModerationQueue(after, limit int) ([]ModerationItem, error) {
+	var result []ModerationItem
+
+	err := db.View(func(dbs *DBStructure) error {
+		for id, chirp := range dbs.Chirps {
+			if id > after && (chirp.Status == ChirpHeld || len(dbs.Reports[id]) > 0) {
+				reports := append([]Report{}, dbs.Reports[id]...)
+				result = append(result, ModerationItem{Chirp: chirp, Reports: reports})
+			}
+		}
+		return nil
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Chirp.ID < result[j].Chirp.ID })
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result, err
+}
+
+// ModerateChirp approves, hides or deletes a chirp, closing its reports. The
+// chirp is returned as the action left it, or as it was if it was deleted.
+func (db *DB) ModerateChirp(chirpID, moderatorID int, action, note string) (Chirp, error) {
+	var result Chirp
+	var event string
+
+	err := db.Update(func(dbs *DBStructure) error {
+		old, ok := dbs.Chirps[chirpID]
+		if !ok {
+			return errors.New("Invalid chirp ID")
+		}
+
+		result = old
+		if action == ModDelete {
+			db.deleteChirp(dbs, old)
+			if old.Published() {
+				event = EventChirpDeleted
+			}
+		} else {
+			status, err := chirpStatus(action)
+			if err != nil {
+				return err
+			}
+			result = db.setStatus(dbs, old, status)
+			event = changeEvent(old, result)
+		}
+
+		delete(dbs.Reports, chirpID)
+		dbs.audit(AuditEntry{ModeratorID: moderatorID, Action: action, ChirpID: chirpID, UserID: old.AuthorID, Note: note})
+		return nil
+	})
+	if err == nil && len(event) > 0 {
+		db.events.publish(event, result)
+	}
+
+	return result, err
+}
+
+// setStatus publishes or unpublishes a chirp inside an Update. A held chirp
+// sends its notifications when it is first published.
+func (db *DB) setStatus(dbs *DBStructure, chirp Chirp, status string) Chirp {
+	old := chirp
+	chirp.Status = status
+	dbs.Chirps[chirp.ID] = chirp
+	if old.Published() == chirp.Published() {
+		return chirp
+	}
+
+	delta := 1
+	if chirp.Published() {
+		db.index.show(chirp)
+		db.search.add(chirp)
+	} else {
+		db.index.hide(chirp)
+		db.search.remove(chirp)
+		delta = -1
+	}
+	var parent Chirp
+	if chirp.InReplyTo != 0 {
+		parent = dbs.Chirps[chirp.InReplyTo]
+		parent.ReplyCount += delta
+		dbs.Chirps[parent.ID] = parent
+	}
+	if old.Status == ChirpHeld {
+		for _, n := range chirpNotifications(chirp, parent.AuthorID) {
+			dbs.notify(n)
+		}
+	}
+
+	return chirp
+}
+
+// SuspendUser suspends or reinstates a user
+func (db *DB) SuspendUser(userID, moderatorID int, suspended bool, note string) (User, error) {
+	var result User
+
+	err := db.Update(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[userID]
+		if !ok {
+			return errors.New("User id does not exist")
+		}
+
+		user.IsSuspended = suspended
+		user.UpdatedAt = time.Now().UTC()
+		dbs.Users[userID] = user
+		result = user.User
+
+		action := ModSuspend
+		if !suspended {
+			action = ModUnsuspend
+		}
+		dbs.audit(AuditEntry{ModeratorID: moderatorID, Action: action, UserID: userID, Note: note})
+		return nil
+	})
+
+	return result, err
+}
+
+// AuditLog returns moderator actions, newest first, starting before the entry
+// with ID before when it is non-zero
+func (db *DB) AuditLog(before, limit int) ([]AuditEntry, error) {
+	var result []AuditEntry
+
+	err := db.View(func(dbs *DBStructure) error {
+		for i := len(dbs.Audit) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+			if before == 0 || dbs.Audit[i].ID < before {
+				result = append(result, dbs.Audit[i])
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func auditSQLite(tx *sql.Tx, e AuditEntry) error {
+	_, err := tx.Exec("INSERT INTO audit_log (moderator_id, action, chirp_id, user_id, note, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		e.ModeratorID, e.Action, nullID(e.ChirpID), e.UserID, e.Note, time.Now().UTC())
+	return err
+}
+
+func scanReport(row scanner) (Report, error) {
+	var r Report
+	err := row.Scan(&r.ID, &r.ChirpID, &r.ReporterID, &r.Reason, &r.CreatedAt)
+	return r, err
+}
+
+func (db *SQLiteDB) ReportChirp(chirpID, reporterID int, reason string) (Report, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := db.getChirp(tx, chirpID)
+	if err != nil {
+		return Report{}, err
+	}
+	if !chirp.Published() {
+		return Report{}, errors.New("Invalid chirp ID")
+	}
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO reports (chirp_id, reporter_id, reason, created_at) VALUES (?, ?, ?, ?)",
+		chirpID, reporterID, reason, time.Now().UTC())
+	if err != nil {
+		return Report{}, err
+	}
+	result, err := scanReport(tx.QueryRow("SELECT id, chirp_id, reporter_id, reason, created_at FROM reports WHERE chirp_id = ? AND reporter_id = ?",
+		chirpID, reporterID))
+	if err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
+
+func (db *SQLiteDB) ModerationQueue(after, limit int) ([]ModerationItem, error) {
+	var result []ModerationItem
+
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.db.Query(`
+		SELECT `+chirpColumns+` FROM chirps
+		WHERE id > ? AND (status = ? OR id IN (SELECT chirp_id FROM reports))
+		ORDER BY id LIMIT ?`, after, ChirpHeld, limit)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	items := make(map[int]int)
+	var args []any
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return result, err
+		}
+		items[chirp.ID] = len(result)
+		args = append(args, chirp.ID)
+		result = append(result, ModerationItem{Chirp: chirp, Reports: []Report{}})
+	}
+	if err = rows.Err(); err != nil || len(result) == 0 {
+		return result, err
+	}
+	rows.Close()
+
+	placeholders := strings.Repeat(", ?", len(args))[2:]
+	rows, err = db.db.Query("SELECT id, chirp_id, reporter_id, reason, created_at FROM reports WHERE chirp_id IN ("+placeholders+") ORDER BY id", args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return result, err
+		}
+		i := items[report.ChirpID]
+		result[i].Reports = append(result[i].Reports, report)
+	}
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) ModerateChirp(chirpID, moderatorID int, action, note string) (Chirp, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := db.getChirp(tx, chirpID)
+	if err != nil {
+		return old, err
+	}
+
+	result := old
+	var event string
+	var outbox []Notification
+	if action == ModDelete {
+		err = deleteSQLiteChirp(tx, old)
+		if old.Published() {
+			event = EventChirpDeleted
+		}
+	} else {
+		var status string
+		status, err = chirpStatus(action)
+		if err == nil {
+			result, err = setSQLiteStatus(tx, &outbox, old, status)
+			event = changeEvent(old, result)
+		}
+	}
+	if err != nil {
+		return result, err
+	}
+
+	_, err = tx.Exec("DELETE FROM reports WHERE chirp_id = ?", chirpID)
+	if err != nil {
+		return result, err
+	}
+	err = auditSQLite(tx, AuditEntry{ModeratorID: moderatorID, Action: action, ChirpID: chirpID, UserID: old.AuthorID, Note: note})
+	if err != nil {
+		return result, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return result, err
+	}
+	switch event {
+	case EventChirpCreated:
+		db.search.add(result)
+	case EventChirpDeleted:
+		db.search.remove(old)
+	}
+	if len(event) > 0 {
+		db.events.publish(event, result)
+	}
+	db.events.publishNotifications(outbox)
+
+	return result, nil
+}
+
+// setSQLiteStatus publishes or unpublishes a chirp. A held chirp sends its
+// notifications when it is first published.
+func setSQLiteStatus(tx *sql.Tx, outbox *[]Notification, chirp Chirp, status string) (Chirp, error) {
+	old := chirp
+	chirp.Status = status
+	_, err := tx.Exec("UPDATE chirps SET status = ? WHERE id = ?", status, chirp.ID)
+	if err != nil || old.Published() == chirp.Published() {
+		return chirp, err
+	}
+
+	delta := 1
+	if !chirp.Published() {
+		delta = -1
+	}
+	var parentAuthorID int
+	if chirp.InReplyTo != 0 {
+		err = tx.QueryRow("UPDATE chirps SET reply_count = reply_count + ? WHERE id = ? RETURNING author_id", delta, chirp.InReplyTo).
+			Scan(&parentAuthorID)
+		if err != nil {
+			return chirp, err
+		}
+	}
+	if old.Status == ChirpHeld {
+		for _, n := range chirpNotifications(chirp, parentAuthorID) {
+			err = notifySQLite(tx, outbox, n)
+			if err != nil {
+				return chirp, err
+			}
+		}
+	}
+
+	return chirp, nil
+}
+
+func (db *SQLiteDB) SuspendUser(userID, moderatorID int, suspended bool, note string) (User, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := db.getUser(tx, userID)
+	if err != nil {
+		return User{}, err
+	}
+	user.IsSuspended = suspended
+	user.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec("UPDATE users SET suspended = ?, updated_at = ? WHERE id = ?", user.IsSuspended, user.UpdatedAt, userID)
+	if err != nil {
+		return User{}, err
+	}
+
+	action := ModSuspend
+	if !suspended {
+		action = ModUnsuspend
+	}
+	err = auditSQLite(tx, AuditEntry{ModeratorID: moderatorID, Action: action, UserID: userID, Note: note})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user.User, tx.Commit()
+}
+
+func (db *SQLiteDB) AuditLog(before, limit int) ([]AuditEntry, error) {
+	var result []AuditEntry
+
+	query := "SELECT id, moderator_id, action, COALESCE(chirp_id, 0), user_id, note, created_at FROM audit_log"
+	var args []any
+	if before > 0 {
+		query += " WHERE id < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEntry
+		err = rows.Scan(&e.ID, &e.ModeratorID, &e.Action, &e.ChirpID, &e.UserID, &e.Note, &e.CreatedAt)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, e)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,239 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const (
+	NotifyMention   = "mention"
+	NotifyReply     = "reply"
+	NotifyFollow    = "follow"
+	NotifyLike      = "like"
+	NotifyChirpyRed = "chirpy_red"
+)
+
+// Notification tells a user that something happened that involves them.
+// ActorID is the user who caused it and ChirpID the chirp it is about, when
+// there is one.
+type Notification struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Type      string    `json:"type"`
+	ActorID   int       `json:"actor_id,omitempty"`
+	ChirpID   int       `json:"chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+// NotificationQuery selects one page of a user's notifications, newest first
+type NotificationQuery struct {
+	UserID int
+	// Before skips notifications with this ID or newer when non-zero
+	Before     int
+	UnreadOnly bool
+	// Limit is the maximum number of notifications returned, or 0 for no limit
+	Limit int
+}
+
+// wanted reports whether a notification should be sent. Users aren't
+// notified about their own actions.
+func (n Notification) wanted() bool {
+	return n.UserID != 0 && n.UserID != n.ActorID
+}
+
+// chirpNotifications returns the notifications for a new chirp: a reply to
+// the author of the parent, and a mention to everyone mentioned in it
+func chirpNotifications(chirp Chirp, parentAuthorID int) []Notification {
+	var result []Notification
+
+	notified := map[int]bool{chirp.AuthorID: true}
+	if chirp.InReplyTo != 0 {
+		result = append(result, Notification{UserID: parentAuthorID, Type: NotifyReply, ActorID: chirp.AuthorID, ChirpID: chirp.ID})
+		notified[parentAuthorID] = true
+	}
+	for _, e := range chirp.Entities {
+		if e.Type == EntityMention && !notified[e.UserID] {
+			result = append(result, Notification{UserID: e.UserID, Type: NotifyMention, ActorID: chirp.AuthorID, ChirpID: chirp.ID})
+			notified[e.UserID] = true
+		}
+	}
+
+	return result
+}
+
+// notify records a notification. The caller must be inside an Update.
+func (dbs *DBStructure) notify(n Notification) {
+	if !n.wanted() {
+		return
+	}
+
+	n.ID = dbs.NextNotificationID
+	n.CreatedAt = time.Now().UTC()
+	dbs.Notifications[n.UserID] = append(dbs.Notifications[n.UserID], n)
+	dbs.NextNotificationID++
+	dbs.outbox = append(dbs.outbox, n)
+}
+
+// unread reports whether the recipient of n still hasn't read a notification
+// of the same type from the same actor about the same chirp
+func (dbs *DBStructure) unread(n Notification) bool {
+	for _, existing := range dbs.Notifications[n.UserID] {
+		if !existing.Read && existing.Type == n.Type && existing.ActorID == n.ActorID && existing.ChirpID == n.ChirpID {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) GetNotifications(q NotificationQuery) ([]Notification, error) {
+	var result []Notification
+
+	err := db.View(func(dbs *DBStructure) error {
+		// Notifications are stored oldest first
+		list := dbs.Notifications[q.UserID]
+		for i := len(list) - 1; i >= 0 && (q.Limit == 0 || len(result) < q.Limit); i-- {
+			n := list[i]
+			if (q.Before != 0 && n.ID >= q.Before) || (q.UnreadOnly && n.Read) {
+				continue
+			}
+			result = append(result, n)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *DB) UnreadNotifications(userID int) (int, error) {
+	count := 0
+
+	err := db.View(func(dbs *DBStructure) error {
+		for _, n := range dbs.Notifications[userID] {
+			if !n.Read {
+				count++
+			}
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+// MarkNotificationsRead marks a user's notifications as read, or all of them
+// if ids is empty. It returns the number of unread notifications left.
+func (db *DB) MarkNotificationsRead(userID int, ids []int) (int, error) {
+	unread := 0
+
+	marked := make(map[int]bool)
+	for _, id := range ids {
+		marked[id] = true
+	}
+
+	err := db.Update(func(dbs *DBStructure) error {
+		for i, n := range dbs.Notifications[userID] {
+			if len(ids) == 0 || marked[n.ID] {
+				dbs.Notifications[userID][i].Read = true
+			} else if !n.Read {
+				unread++
+			}
+		}
+		return nil
+	})
+
+	return unread, err
+}
+
+// notifySQLite records a notification inside a transaction and adds it to
+// outbox, to be published once the transaction commits
+func notifySQLite(tx *sql.Tx, outbox *[]Notification, n Notification) error {
+	if !n.wanted() {
+		return nil
+	}
+
+	n.CreatedAt = time.Now().UTC()
+	res, err := tx.Exec("INSERT INTO notifications (user_id, type, actor_id, chirp_id, created_at) VALUES (?, ?, ?, ?, ?)",
+		n.UserID, n.Type, nullID(n.ActorID), nullID(n.ChirpID), n.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	n.ID = int(id)
+	*outbox = append(*outbox, n)
+
+	return nil
+}
+
+func unreadSQLite(tx *sql.Tx, n Notification) (bool, error) {
+	var result bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM notifications
+			WHERE user_id = ? AND NOT read AND type = ? AND actor_id IS ? AND chirp_id IS ?
+		)`, n.UserID, n.Type, nullID(n.ActorID), nullID(n.ChirpID)).Scan(&result)
+	return result, err
+}
+
+func (db *SQLiteDB) GetNotifications(q NotificationQuery) ([]Notification, error) {
+	var result []Notification
+
+	query := "SELECT id, user_id, type, COALESCE(actor_id, 0), COALESCE(chirp_id, 0), created_at, read FROM notifications WHERE user_id = ?"
+	args := []any{q.UserID}
+	if q.Before != 0 {
+		query += " AND id < ?"
+		args = append(args, q.Before)
+	}
+	if q.UnreadOnly {
+		query += " AND NOT read"
+	}
+	query += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n Notification
+		err = rows.Scan(&n.ID, &n.UserID, &n.Type, &n.ActorID, &n.ChirpID, &n.CreatedAt, &n.Read)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, n)
+	}
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) UnreadNotifications(userID int) (int, error) {
+	var count int
+	err := db.db.QueryRow("SELECT count(*) FROM notifications WHERE user_id = ? AND NOT read", userID).Scan(&count)
+	return count, err
+}
+
+func (db *SQLiteDB) MarkNotificationsRead(userID int, ids []int) (int, error) {
+	query := "UPDATE notifications SET read = 1 WHERE user_id = ? AND NOT read"
+	args := []any{userID}
+	if len(ids) > 0 {
+		query += " AND id IN (" + strings.Repeat(", ?", len(ids))[2:] + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	_, err := db.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return db.UnreadNotifications(userID)
+}
@@ -0,0 +1,201 @@
+package chirpydb
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// DefaultJanitorInterval is how often RunJanitor prunes expired revocations
+// and sessions
+const DefaultJanitorInterval = time.Hour
+
+// legacyTokenLifetime is the longest a Chirpy token lasted before revocations
+// stored their expiry. It bounds how long migrated revocations are kept.
+const legacyTokenLifetime = 60 * 24 * time.Hour
+
+// Revocation records that a token was revoked. It only needs to be kept until
+// the token expires, since an expired token is rejected anyway.
+type Revocation struct {
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RevocationStats describes the size of the revocation list. Expired
+// revocations are removed by the next PruneRevocations.
+type RevocationStats struct {
+	Total   int `json:"total"`
+	Expired int `json:"expired"`
+}
+
+// TokenKey is the key a token's revocation is stored under, so the tokens
+// themselves are never stored
+func TokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// legacyRevocation converts a revocation stored with the whole token before
+// revocations were keyed by TokenKey. The expiry is read from the token's
+// claims, which were checked when it was revoked.
+func legacyRevocation(token string, revokedAt time.Time) (string, Revocation) {
+	result := Revocation{RevokedAt: revokedAt, ExpiresAt: revokedAt.Add(legacyTokenLifetime)}
+
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err == nil && json.Unmarshal(payload, &claims) == nil && claims.ExpiresAt > 0 {
+			result.ExpiresAt = time.Unix(claims.ExpiresAt, 0).UTC()
+		}
+	}
+
+	return TokenKey(token), result
+}
+
+// RunJanitor prunes expired revocations from s every interval until done is
+// closed. Token families are pruned once their last refresh token, which
+// lasted tokenLifetime, has expired. Tokens are still accepted for leeway
+// after they expire, so they are only pruned once that has passed too.
+func RunJanitor(s Store, interval, tokenLifetime, leeway time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now().Add(-leeway)
+			n, err := s.PruneRevocations(now)
+			if err != nil {
+				log.Println("Failed to prune token revocations:", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d expired token revocations", n)
+			}
+			n, err = s.PruneTokenFamilies(now.Add(-tokenLifetime))
+			if err != nil {
+				log.Println("Failed to prune token families:", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d expired token families", n)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// RevokeToken revokes the token with the given TokenKey until it expires.
+// Revoking a token again keeps the original revocation.
+func (db *DB) RevokeToken(key string, expiresAt time.Time) error {
+	return db.Update(func(dbs *DBStructure) error {
+		if _, ok := dbs.Revocations[key]; !ok {
+			dbs.Revocations[key] = Revocation{RevokedAt: time.Now().UTC(), ExpiresAt: expiresAt.UTC()}
+		}
+		return nil
+	})
+}
+
+func (db *DB) GetTokenRevocation(key string) (Revocation, error) {
+	var result Revocation
+
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		result, ok = dbs.Revocations[key]
+		if !ok {
+			return errors.New("Token has not been revoked")
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *DB) IsTokenRevoked(key string) bool {
+	_, err := db.GetTokenRevocation(key)
+	return err == nil
+}
+
+// PruneRevocations removes the revocations of tokens that expired before now
+// and returns how many it removed
+func (db *DB) PruneRevocations(now time.Time) (int, error) {
+	// Only take the write lock, and write the file, if there's work to do
+	stats, err := db.RevocationStats(now)
+	if err != nil || stats.Expired == 0 {
+		return 0, err
+	}
+
+	var result int
+	err = db.Update(func(dbs *DBStructure) error {
+		for key, revocation := range dbs.Revocations {
+			if revocation.ExpiresAt.Before(now) {
+				delete(dbs.Revocations, key)
+				result++
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *DB) RevocationStats(now time.Time) (RevocationStats, error) {
+	var result RevocationStats
+
+	err := db.View(func(dbs *DBStructure) error {
+		result.Total = len(dbs.Revocations)
+		for _, revocation := range dbs.Revocations {
+			if revocation.ExpiresAt.Before(now) {
+				result.Expired++
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *SQLiteDB) RevokeToken(key string, expiresAt time.Time) error {
+	_, err := db.db.Exec("INSERT OR IGNORE INTO token_revocations (token_hash, revoked_at, expires_at) VALUES (?, ?, ?)",
+		key, time.Now().UTC(), expiresAt.UTC())
+	return err
+}
+
+func (db *SQLiteDB) GetTokenRevocation(key string) (Revocation, error) {
+	var result Revocation
+
+	err := db.db.QueryRow("SELECT revoked_at, expires_at FROM token_revocations WHERE token_hash = ?", key).
+		Scan(&result.RevokedAt, &result.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, errors.New("Token has not been revoked")
+	}
+
+	return result, err
+}
+
+func (db *SQLiteDB) IsTokenRevoked(key string) bool {
+	_, err := db.GetTokenRevocation(key)
+	return err == nil
+}
+
+func (db *SQLiteDB) PruneRevocations(now time.Time) (int, error) {
+	res, err := db.db.Exec("DELETE FROM token_revocations WHERE expires_at < ?", now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (db *SQLiteDB) RevocationStats(now time.Time) (RevocationStats, error) {
+	var result RevocationStats
+	err := db.db.QueryRow("SELECT count(*), count(CASE WHEN expires_at < ? THEN 1 END) FROM token_revocations", now.UTC()).
+		Scan(&result.Total, &result.Expired)
+	return result, err
+}
@@ -0,0 +1,85 @@
+package chirpydb
+
+import (
+	"errors"
+	"time"
+)
+
+// Roles, from least to most privileged. Each role can do everything the ones
+// before it can.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{RoleUser: 1, RoleModerator: 2, RoleAdmin: 3}
+
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole reports whether role grants at least the privileges of required.
+// Unknown roles, including the empty role, grant nothing beyond a user's.
+func HasRole(role, required string) bool {
+	rank, ok := roleRanks[role]
+	if !ok {
+		rank = roleRanks[RoleUser]
+	}
+	return rank >= roleRanks[required]
+}
+
+// SetRole changes a user's role. moderatorID is the admin making the change,
+// or 0 when it's made from the command line.
+func (db *DB) SetRole(userID, moderatorID int, role string) (User, error) {
+	var result User
+	if !ValidRole(role) {
+		return result, errors.New("Unknown role")
+	}
+
+	err := db.Update(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[userID]
+		if !ok {
+			return errors.New("User id does not exist")
+		}
+
+		user.Role = role
+		user.UpdatedAt = time.Now().UTC()
+		dbs.Users[userID] = user
+		result = user.User
+		dbs.audit(AuditEntry{ModeratorID: moderatorID, Action: ModSetRole, UserID: userID, Note: role})
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *SQLiteDB) SetRole(userID, moderatorID int, role string) (User, error) {
+	if !ValidRole(role) {
+		return User{}, errors.New("Unknown role")
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := db.getUser(tx, userID)
+	if err != nil {
+		return User{}, err
+	}
+	user.Role = role
+	user.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec("UPDATE users SET role = ?, updated_at = ? WHERE id = ?", user.Role, user.UpdatedAt, userID)
+	if err != nil {
+		return User{}, err
+	}
+	err = auditSQLite(tx, AuditEntry{ModeratorID: moderatorID, Action: ModSetRole, UserID: userID, Note: role})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user.User, tx.Commit()
+}
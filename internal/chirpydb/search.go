@@ -0,0 +1,264 @@
+package chirpydb
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// SearchQuery selects chirps by content. Query is a list of terms that must
+// all match: a plain word matches that word, a word ending in * matches any
+// word starting with it, and "quoted words" must appear next to each other.
+type SearchQuery struct {
+	Query string
+	// AuthorID limits results to one author's chirps when non-zero
+	AuthorID int
+	Limit    int
+	Offset   int
+}
+
+// searchIndex is an in-memory inverted index of chirp bodies. Both stores
+// rebuild it when they are opened and keep it up to date as chirps change.
+type searchIndex struct {
+	mux sync.RWMutex
+
+	// postings maps a term to the positions it appears at in each chirp
+	postings map[string]map[int][]int
+	// terms holds every indexed term in sorted order for prefix lookups
+	terms []string
+	// authors maps every indexed chirp to its author for filtering
+	authors map[int]int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[int][]int),
+		authors:  make(map[int]int),
+	}
+}
+
+// tokenize splits text into lower case words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (idx *searchIndex) add(c Chirp) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.addLocked(c)
+}
+
+func (idx *searchIndex) addLocked(c Chirp) {
+	idx.authors[c.ID] = c.AuthorID
+	for pos, term := range tokenize(c.Body) {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = make(map[int][]int)
+			idx.postings[term] = docs
+			i := sort.SearchStrings(idx.terms, term)
+			idx.terms = append(idx.terms, "")
+			copy(idx.terms[i+1:], idx.terms[i:])
+			idx.terms[i] = term
+		}
+		docs[c.ID] = append(docs[c.ID], pos)
+	}
+}
+
+func (idx *searchIndex) remove(c Chirp) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.removeLocked(c)
+}
+
+func (idx *searchIndex) removeLocked(c Chirp) {
+	delete(idx.authors, c.ID)
+	for _, term := range tokenize(c.Body) {
+		docs, ok := idx.postings[term]
+		if !ok {
+			continue
+		}
+		delete(docs, c.ID)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+			i := sort.SearchStrings(idx.terms, term)
+			if i < len(idx.terms) && idx.terms[i] == term {
+				idx.terms = append(idx.terms[:i], idx.terms[i+1:]...)
+			}
+		}
+	}
+}
+
+// update reindexes a chirp whose body changed from old to c.Body
+func (idx *searchIndex) update(old, c Chirp) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.removeLocked(old)
+	idx.addLocked(c)
+}
+
+// searchClause is one part of a parsed query that a chirp must match
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+func parseSearchQuery(query string) ([]searchClause, error) {
+	var clauses []searchClause
+
+	for len(query) > 0 {
+		query = strings.TrimSpace(query)
+		if strings.HasPrefix(query, `"`) {
+			phrase, rest, _ := strings.Cut(query[1:], `"`)
+			if terms := tokenize(phrase); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			query = rest
+			continue
+		}
+
+		word, rest := query, ""
+		if i := strings.IndexFunc(query, unicode.IsSpace); i >= 0 {
+			word, rest = query[:i], query[i:]
+		}
+		prefix := strings.HasSuffix(word, "*")
+		terms := tokenize(word)
+		if prefix && len(terms) == 1 {
+			clauses = append(clauses, searchClause{terms: terms, prefix: true})
+		} else if len(terms) > 0 {
+			// Words like "re-chirp" are indexed as separate terms, so treat them as a phrase
+			clauses = append(clauses, searchClause{terms: terms})
+		}
+		query = rest
+	}
+
+	if len(clauses) == 0 {
+		return nil, errors.New("Empty search query")
+	}
+	return clauses, nil
+}
+
+// expand returns the indexed terms a prefix matches
+func (idx *searchIndex) expand(prefix string) []string {
+	var result []string
+	for i := sort.SearchStrings(idx.terms, prefix); i < len(idx.terms); i++ {
+		if !strings.HasPrefix(idx.terms[i], prefix) {
+			break
+		}
+		result = append(result, idx.terms[i])
+	}
+	return result
+}
+
+func (idx *searchIndex) idf(term string) float64 {
+	return math.Log(1 + float64(len(idx.authors))/float64(1+len(idx.postings[term])))
+}
+
+// match scores every chirp that satisfies a clause
+func (idx *searchIndex) match(clause searchClause) map[int]float64 {
+	scores := make(map[int]float64)
+
+	if clause.prefix {
+		for _, term := range idx.expand(clause.terms[0]) {
+			idf := idx.idf(term)
+			for id, positions := range idx.postings[term] {
+				scores[id] += float64(len(positions)) * idf
+			}
+		}
+		return scores
+	}
+
+	var idf float64
+	for _, term := range clause.terms {
+		idf += idx.idf(term)
+	}
+	first := clause.terms[0]
+	for id, positions := range idx.postings[first] {
+		count := 0
+		for _, pos := range positions {
+			if idx.phraseAt(id, clause.terms, pos) {
+				count++
+			}
+		}
+		if count > 0 {
+			scores[id] = float64(count) * idf
+		}
+	}
+	return scores
+}
+
+// phraseAt reports whether terms appear in order starting at pos
+func (idx *searchIndex) phraseAt(id int, terms []string, pos int) bool {
+	for offset, term := range terms[1:] {
+		found := false
+		for _, p := range idx.postings[term][id] {
+			if p == pos+offset+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// search returns the IDs of matching chirps, most relevant first.
+// Equally relevant chirps are ordered newest first.
+func (idx *searchIndex) search(q SearchQuery) ([]int, error) {
+	clauses, err := parseSearchQuery(q.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	var scores map[int]float64
+	for _, clause := range clauses {
+		matches := idx.match(clause)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id := range scores {
+			score, ok := matches[id]
+			if !ok {
+				delete(scores, id)
+			} else {
+				scores[id] += score
+			}
+		}
+	}
+
+	var ids []int
+	for id := range scores {
+		if q.AuthorID == 0 || idx.authors[id] == q.AuthorID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		return a > b
+	})
+
+	if q.Offset >= len(ids) {
+		return nil, nil
+	}
+	ids = ids[q.Offset:]
+	if q.Limit > 0 && len(ids) > q.Limit {
+		ids = ids[:q.Limit]
+	}
+	return ids, nil
+}
@@ -0,0 +1,545 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type SQLiteDB struct {
+	db     *sql.DB
+	search *searchIndex
+	events *Broker
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+const chirpColumns = "id, author_id, body, created_at, updated_at, COALESCE(in_reply_to, 0), reply_count, like_count, rechirp_count, entities, status"
+
+func scanChirp(row scanner) (Chirp, error) {
+	var chirp Chirp
+	var entities []byte
+	err := row.Scan(&chirp.ID, &chirp.AuthorID, &chirp.Body, &chirp.CreatedAt, &chirp.UpdatedAt,
+		&chirp.InReplyTo, &chirp.ReplyCount, &chirp.LikeCount, &chirp.RechirpCount, &entities, &chirp.Status)
+	if err != nil {
+		return chirp, err
+	}
+	err = json.Unmarshal(entities, &chirp.Entities)
+	return chirp, err
+}
+
+// nullID stores an unset (zero) ID reference as NULL
+func nullID(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = migrateSQLite(db, path, false)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	result := &SQLiteDB{db: db, search: newSearchIndex(), events: newBroker()}
+	chirps, err := result.GetChirps()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, chirp := range chirps {
+		if chirp.Published() {
+			result.search.add(chirp)
+		}
+	}
+
+	return result, nil
+}
+
+func (db *SQLiteDB) Close() error {
+	db.events.Close()
+	return db.db.Close()
+}
+
+func (db *SQLiteDB) CreateChirp(msg string, authorID, inReplyTo int) (Chirp, error) {
+	return db.createChirp(msg, authorID, inReplyTo, "")
+}
+
+func (db *SQLiteDB) HoldChirp(msg string, authorID, inReplyTo int) (Chirp, error) {
+	return db.createChirp(msg, authorID, inReplyTo, ChirpHeld)
+}
+
+func (db *SQLiteDB) createChirp(msg string, authorID, inReplyTo int, status string) (Chirp, error) {
+	now := time.Now().UTC()
+	result := Chirp{
+		AuthorID:  authorID,
+		Body:      msg,
+		CreatedAt: now,
+		UpdatedAt: now,
+		InReplyTo: inReplyTo,
+		Status:    status,
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	var parentAuthorID int
+	if inReplyTo != 0 {
+		// Held chirps don't count as replies until they are published
+		query := "SELECT author_id FROM chirps WHERE id = ? AND status = ''"
+		if result.Published() {
+			query = "UPDATE chirps SET reply_count = reply_count + 1 WHERE id = ? AND status = '' RETURNING author_id"
+		}
+		err = tx.QueryRow(query, inReplyTo).Scan(&parentAuthorID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return result, errors.New("Parent chirp does not exist")
+		} else if err != nil {
+			return result, err
+		}
+	}
+
+	res, err := tx.Exec("INSERT INTO chirps (author_id, body, created_at, updated_at, in_reply_to, status) VALUES (?, ?, ?, ?, ?, ?)",
+		authorID, msg, now, now, nullID(inReplyTo), status)
+	if err != nil {
+		return result, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return result, err
+	}
+	result.ID = int(id)
+	err = setSQLiteEntities(tx, &result)
+	if err != nil {
+		return result, err
+	}
+	if !result.Published() {
+		return result, tx.Commit()
+	}
+	var outbox []Notification
+	for _, n := range chirpNotifications(result, parentAuthorID) {
+		err = notifySQLite(tx, &outbox, n)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return result, err
+	}
+	db.search.add(result)
+	db.events.publish(EventChirpCreated, result)
+	db.events.publishNotifications(outbox)
+
+	return result, nil
+}
+
+func (db *SQLiteDB) getChirp(q queryRower, id int) (Chirp, error) {
+	result, err := scanChirp(q.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, errors.New("Invalid chirp ID")
+	}
+
+	return result, err
+}
+
+func (db *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	return db.getChirp(db.db, id)
+}
+
+func (db *SQLiteDB) UpdateChirp(id int, body string) (Chirp, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := db.getChirp(tx, id)
+	if err != nil {
+		return old, err
+	}
+
+	_, err = tx.Exec("INSERT INTO chirp_history (chirp_id, body, created_at) VALUES (?, ?, ?)",
+		id, old.Body, old.UpdatedAt)
+	if err != nil {
+		return old, err
+	}
+	result := old
+	result.Body = body
+	result.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec("UPDATE chirps SET body = ?, updated_at = ? WHERE id = ?", result.Body, result.UpdatedAt, id)
+	if err != nil {
+		return result, err
+	}
+	err = setSQLiteEntities(tx, &result)
+	if err != nil {
+		return result, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return result, err
+	}
+	if result.Published() {
+		db.search.update(old, result)
+	}
+
+	return result, nil
+}
+
+func (db *SQLiteDB) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	var result []ChirpRevision
+
+	chirp, err := db.GetChirp(id)
+	if err != nil {
+		return result, err
+	}
+
+	rows, err := db.db.Query("SELECT body, created_at FROM chirp_history WHERE chirp_id = ? ORDER BY id", id)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rev ChirpRevision
+		err = rows.Scan(&rev.Body, &rev.CreatedAt)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, rev)
+	}
+	result = append(result, ChirpRevision{Body: chirp.Body, CreatedAt: chirp.UpdatedAt})
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) DeleteChirp(id int) error {
+	chirp, err := db.GetChirp(id)
+	if err != nil {
+		// Deleting a chirp that doesn't exist is not an error
+		return nil
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteSQLiteChirp(tx, chirp)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if chirp.Published() {
+		db.search.remove(chirp)
+		db.events.publish(EventChirpDeleted, chirp)
+	}
+
+	return nil
+}
+
+// deleteSQLiteChirp removes a chirp, moving its replies up the conversation
+func deleteSQLiteChirp(tx *sql.Tx, chirp Chirp) error {
+	err := reparentReplies(tx, chirp)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM chirps WHERE id = ?", chirp.ID)
+	return err
+}
+
+func (db *SQLiteDB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	var chirps []Chirp
+
+	ids, err := db.search.search(q)
+	if err != nil {
+		return chirps, err
+	}
+
+	for _, id := range ids {
+		chirp, err := db.GetChirp(id)
+		if err != nil {
+			// Deleted since it was found
+			continue
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, nil
+}
+
+func (db *SQLiteDB) GetChirps() ([]Chirp, error) {
+	var chirps []Chirp
+
+	rows, err := db.db.Query("SELECT " + chirpColumns + " FROM chirps ORDER BY id")
+	if err != nil {
+		return chirps, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return chirps, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (db *SQLiteDB) ListChirps(q ChirpQuery) ([]Chirp, error) {
+	var chirps []Chirp
+	var where []string
+	var args []any
+
+	where = append(where, "status = ''")
+	if q.AuthorID != 0 {
+		where = append(where, "author_id = ?")
+		args = append(args, q.AuthorID)
+	}
+	order := "ASC"
+	op := ">"
+	if q.Desc {
+		order = "DESC"
+		op = "<"
+	}
+	if q.After != nil {
+		where = append(where, "(created_at, id) "+op+" (?, ?)")
+		args = append(args, q.After.CreatedAt.UTC(), q.After.ID)
+	}
+
+	query := "SELECT " + chirpColumns + " FROM chirps"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY created_at %s, id %s", order, order)
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return chirps, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return chirps, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (db *SQLiteDB) CreateUser(email, password string) (User, error) {
+	pwh, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	if err != nil {
+		return User{}, err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM emails WHERE email = ?)", email).Scan(&exists)
+	if err != nil {
+		return User{}, err
+	}
+	if exists {
+		return User{}, fmt.Errorf("%w for %s", ErrUserExists, email)
+	}
+
+	now := time.Now().UTC()
+	res, err := tx.Exec("INSERT INTO users (pwh, created_at, updated_at) VALUES (?, ?, ?)", pwh, now, now)
+	if err != nil {
+		return User{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	_, err = tx.Exec("INSERT INTO emails (email, user_id) VALUES (?, ?)", email, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{ID: int(id), Email: email, Role: RoleUser, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+func (db *SQLiteDB) getUser(q queryRower, id int) (dbUser, error) {
+	var result dbUser
+
+	err := q.QueryRow(`
+		SELECT u.id, e.email, u.is_chirpy_red, u.suspended, u.role, u.created_at, u.updated_at, u.pwh
+		FROM users u JOIN emails e ON e.user_id = u.id
+		WHERE u.id = ?`, id).
+		Scan(&result.ID, &result.Email, &result.IsChirpyRed, &result.IsSuspended, &result.Role, &result.CreatedAt, &result.UpdatedAt, &result.PWH)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, errors.New("User id does not exist")
+	}
+
+	return result, err
+}
+
+func (db *SQLiteDB) UpdateUser(id int, properties map[string]string) (User, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := db.getUser(tx, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	var outbox []Notification
+	for key, prop := range properties {
+		switch key {
+		case "password":
+			user.PWH, err = bcrypt.GenerateFromPassword([]byte(prop), 0)
+			if err != nil {
+				return User{}, err
+			}
+		case "email":
+			if prop != user.Email {
+				var exists bool
+				err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM emails WHERE email = ?)", prop).Scan(&exists)
+				if err != nil {
+					return User{}, err
+				}
+				if exists {
+					return User{}, fmt.Errorf("%w for %s", ErrUserExists, prop)
+				}
+				_, err = tx.Exec("UPDATE emails SET email = ? WHERE user_id = ?", prop, user.ID)
+				if err != nil {
+					return User{}, err
+				}
+				user.Email = prop
+			}
+		case "is_chirpy_red":
+			if prop == "true" && !user.IsChirpyRed {
+				err = notifySQLite(tx, &outbox, Notification{UserID: user.ID, Type: NotifyChirpyRed})
+				if err != nil {
+					return User{}, err
+				}
+			}
+			user.IsChirpyRed = (prop == "true")
+		}
+	}
+
+	user.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec("UPDATE users SET pwh = ?, is_chirpy_red = ?, updated_at = ? WHERE id = ?",
+		user.PWH, user.IsChirpyRed, user.UpdatedAt, user.ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	db.events.publishNotifications(outbox)
+
+	return user.User, nil
+}
+
+func (db *SQLiteDB) GetUser(id int) (User, error) {
+	user, err := db.getUser(db.db, id)
+	return user.User, err
+}
+
+func (db *SQLiteDB) GetUsers() ([]User, error) {
+	var result []User
+
+	rows, err := db.db.Query(`
+		SELECT u.id, e.email, u.is_chirpy_red, u.suspended, u.role, u.created_at, u.updated_at
+		FROM users u JOIN emails e ON e.user_id = u.id
+		ORDER BY u.id`)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		err = rows.Scan(&u.ID, &u.Email, &u.IsChirpyRed, &u.IsSuspended, &u.Role, &u.CreatedAt, &u.UpdatedAt)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, u)
+	}
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) UserLogin(email, password string) (User, error) {
+	var result User
+	var id int
+
+	err := db.db.QueryRow("SELECT user_id FROM emails WHERE email = ?", email).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, errors.New("Email does not exist")
+	} else if err != nil {
+		return result, err
+	}
+	user, err := db.getUser(db.db, id)
+	if err != nil {
+		return result, err
+	}
+
+	err = bcrypt.CompareHashAndPassword(user.PWH, []byte(password))
+	if err != nil {
+		return result, err
+	}
+
+	result = user.User
+	return result, nil
+}
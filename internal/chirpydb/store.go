@@ -0,0 +1,76 @@
+package chirpydb
+
+import "time"
+
+// Store is the persistence layer used by the Chirpy API. DB keeps everything
+// in a single JSON file, SQLiteDB keeps it in a SQLite database.
+type Store interface {
+	CreateChirp(msg string, authorID, inReplyTo int) (Chirp, error)
+	HoldChirp(msg string, authorID, inReplyTo int) (Chirp, error)
+	GetChirp(id int) (Chirp, error)
+	UpdateChirp(id int, body string) (Chirp, error)
+	GetChirpHistory(id int) ([]ChirpRevision, error)
+	DeleteChirp(id int) error
+	GetChirps() ([]Chirp, error)
+	ListChirps(q ChirpQuery) ([]Chirp, error)
+	SearchChirps(q SearchQuery) ([]Chirp, error)
+	GetThread(id int) (ChirpThread, error)
+	ListHashtag(tag string, after *ChirpCursor, limit int) ([]Chirp, error)
+	TrendingHashtags(since time.Time, limit int) ([]HashtagCount, error)
+
+	LikeChirp(chirpID, userID int) (Chirp, error)
+	UnlikeChirp(chirpID, userID int) (Chirp, error)
+	LikedChirps(userID int, chirpIDs []int) (map[int]bool, error)
+	Rechirp(chirpID, userID int, quote string) (Chirp, error)
+	DeleteRechirp(chirpID, userID int) (Chirp, error)
+	GetRechirps(chirpID int) ([]Rechirp, error)
+
+	CreateUser(email, password string) (User, error)
+	UpdateUser(id int, properties map[string]string) (User, error)
+	GetUser(id int) (User, error)
+	SetRole(userID, moderatorID int, role string) (User, error)
+	GetUsers() ([]User, error)
+	UserLogin(email, password string) (User, error)
+
+	Follow(followerID, followeeID int) error
+	Unfollow(followerID, followeeID int) error
+	GetFollowers(id int) ([]Follow, error)
+	GetFollowing(id int) ([]Follow, error)
+	Timeline(userID int, after *ChirpCursor, limit int) ([]Chirp, error)
+
+	GetNotifications(q NotificationQuery) ([]Notification, error)
+	UnreadNotifications(userID int) (int, error)
+	MarkNotificationsRead(userID int, ids []int) (int, error)
+
+	ReportChirp(chirpID, reporterID int, reason string) (Report, error)
+	ModerationQueue(after, limit int) ([]ModerationItem, error)
+	ModerateChirp(chirpID, moderatorID int, action, note string) (Chirp, error)
+	SuspendUser(userID, moderatorID int, suspended bool, note string) (User, error)
+	AuditLog(before, limit int) ([]AuditEntry, error)
+
+	RevokeToken(key string, expiresAt time.Time) error
+	GetTokenRevocation(key string) (Revocation, error)
+	IsTokenRevoked(key string) bool
+	PruneRevocations(now time.Time) (int, error)
+	RevocationStats(now time.Time) (RevocationStats, error)
+
+	CreateTokenFamily(userID int, tokenID, userAgent, ip string) (TokenFamily, error)
+	GetTokenFamily(id int) (TokenFamily, error)
+	ListTokenFamilies(userID int) ([]TokenFamily, error)
+	RotateToken(familyID int, tokenID, newTokenID string) (TokenFamily, error)
+	RevokeTokenFamily(id int) error
+	RevokeTokenFamilies(userID int) (int, error)
+	TokensValidAfter(userID int) (time.Time, error)
+	PruneTokenFamilies(before time.Time) (int, error)
+
+	// Events publishes chirps as they are created and deleted, and
+	// notifications as they are recorded
+	Events() *Broker
+
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
@@ -0,0 +1,145 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+)
+
+// ChirpThread is a chirp and every reply below it
+type ChirpThread struct {
+	Chirp
+	Replies []ChirpThread `json:"replies"`
+}
+
+// buildThread assembles the tree rooted at root from a flat list of chirps
+func buildThread(root Chirp, chirps []Chirp) ChirpThread {
+	children := make(map[int][]Chirp)
+	for _, c := range chirps {
+		children[c.InReplyTo] = append(children[c.InReplyTo], c)
+	}
+
+	var build func(c Chirp) ChirpThread
+	build = func(c Chirp) ChirpThread {
+		result := ChirpThread{Chirp: c, Replies: []ChirpThread{}}
+		replies := children[c.ID]
+		sort.Slice(replies, func(i, j int) bool { return replies[i].Cursor().before(replies[j].Cursor()) })
+		for _, reply := range replies {
+			result.Replies = append(result.Replies, build(reply))
+		}
+		return result
+	}
+
+	return build(root)
+}
+
+// GetThread returns the whole conversation a chirp belongs to, starting from
+// the chirp that began it. A chirp that isn't published hides the chirps
+// above it as well as its replies, so the thread then starts below it. The
+// chirp itself is always included, since the caller may see it.
+func (db *DB) GetThread(id int) (ChirpThread, error) {
+	var result ChirpThread
+
+	err := db.View(func(dbs *DBStructure) error {
+		root, ok := dbs.Chirps[id]
+		if !ok {
+			return errors.New("Invalid chirp ID")
+		}
+		for root.InReplyTo != 0 {
+			parent, ok := dbs.Chirps[root.InReplyTo]
+			if !ok || !parent.Published() {
+				break
+			}
+			root = parent
+		}
+
+		var chirps []Chirp
+		queue := []int{root.ID}
+		for len(queue) > 0 {
+			for _, reply := range db.index.replies[queue[0]] {
+				// Replies below a chirp that isn't published are hidden with it
+				if chirp := dbs.Chirps[reply]; chirp.Published() || reply == id {
+					chirps = append(chirps, chirp)
+					queue = append(queue, reply)
+				}
+			}
+			queue = queue[1:]
+		}
+
+		result = buildThread(root, chirps)
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *SQLiteDB) GetThread(id int) (ChirpThread, error) {
+	var result ChirpThread
+
+	root, err := db.GetChirp(id)
+	if err != nil {
+		return result, err
+	}
+	for root.InReplyTo != 0 {
+		parent, err := db.GetChirp(root.InReplyTo)
+		if err != nil {
+			return result, err
+		}
+		if !parent.Published() {
+			break
+		}
+		root = parent
+	}
+
+	rows, err := db.db.Query(`
+		WITH RECURSIVE thread (id) AS (
+			SELECT id FROM chirps WHERE in_reply_to = ? AND (status = '' OR id = ?)
+			UNION ALL
+			SELECT c.id FROM chirps c JOIN thread t ON c.in_reply_to = t.id WHERE c.status = '' OR c.id = ?
+		)
+		SELECT `+chirpColumns+` FROM chirps WHERE id IN (SELECT id FROM thread)`, root.ID, id, id)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	var chirps []Chirp
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return result, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+
+	return buildThread(root, chirps), nil
+}
+
+// reparentReplies moves the replies to a chirp that is about to be deleted up
+// to its parent, or makes them top-level chirps if it had none
+func reparentReplies(tx *sql.Tx, chirp Chirp) error {
+	var parent any
+	if chirp.InReplyTo != 0 {
+		parent = chirp.InReplyTo
+	}
+
+	// Only published replies count towards the parent's replies
+	var moved int
+	err := tx.QueryRow("SELECT count(*) FROM chirps WHERE in_reply_to = ? AND status = ''", chirp.ID).Scan(&moved)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE chirps SET in_reply_to = ? WHERE in_reply_to = ?", parent, chirp.ID)
+	if err != nil || chirp.InReplyTo == 0 {
+		return err
+	}
+
+	if chirp.Published() {
+		moved--
+	}
+	_, err = tx.Exec("UPDATE chirps SET reply_count = reply_count + ? WHERE id = ?", moved, chirp.InReplyTo)
+	return err
+}
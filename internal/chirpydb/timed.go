@@ -0,0 +1,273 @@
+package chirpydb
+
+import "time"
+
+// ObserveFunc is called with the name of every store operation and how long
+// it took
+type ObserveFunc func(op string, elapsed time.Duration)
+
+// timedStore reports how long each operation of the store it wraps takes
+type timedStore struct {
+	Store
+	observe ObserveFunc
+}
+
+// Timed wraps a store so observe is called after each of its operations.
+// Operation names are the method names in snake case, like "create_chirp".
+func Timed(s Store, observe ObserveFunc) Store {
+	return &timedStore{Store: s, observe: observe}
+}
+
+func (s *timedStore) time(op string, start time.Time) {
+	s.observe(op, time.Since(start))
+}
+
+func (s *timedStore) CreateChirp(msg string, authorID, inReplyTo int) (Chirp, error) {
+	defer s.time("create_chirp", time.Now())
+	return s.Store.CreateChirp(msg, authorID, inReplyTo)
+}
+
+func (s *timedStore) HoldChirp(msg string, authorID, inReplyTo int) (Chirp, error) {
+	defer s.time("hold_chirp", time.Now())
+	return s.Store.HoldChirp(msg, authorID, inReplyTo)
+}
+
+func (s *timedStore) GetChirp(id int) (Chirp, error) {
+	defer s.time("get_chirp", time.Now())
+	return s.Store.GetChirp(id)
+}
+
+func (s *timedStore) UpdateChirp(id int, body string) (Chirp, error) {
+	defer s.time("update_chirp", time.Now())
+	return s.Store.UpdateChirp(id, body)
+}
+
+func (s *timedStore) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	defer s.time("get_chirp_history", time.Now())
+	return s.Store.GetChirpHistory(id)
+}
+
+func (s *timedStore) DeleteChirp(id int) error {
+	defer s.time("delete_chirp", time.Now())
+	return s.Store.DeleteChirp(id)
+}
+
+func (s *timedStore) GetChirps() ([]Chirp, error) {
+	defer s.time("get_chirps", time.Now())
+	return s.Store.GetChirps()
+}
+
+func (s *timedStore) ListChirps(q ChirpQuery) ([]Chirp, error) {
+	defer s.time("list_chirps", time.Now())
+	return s.Store.ListChirps(q)
+}
+
+func (s *timedStore) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	defer s.time("search_chirps", time.Now())
+	return s.Store.SearchChirps(q)
+}
+
+func (s *timedStore) GetThread(id int) (ChirpThread, error) {
+	defer s.time("get_thread", time.Now())
+	return s.Store.GetThread(id)
+}
+
+func (s *timedStore) ListHashtag(tag string, after *ChirpCursor, limit int) ([]Chirp, error) {
+	defer s.time("list_hashtag", time.Now())
+	return s.Store.ListHashtag(tag, after, limit)
+}
+
+func (s *timedStore) TrendingHashtags(since time.Time, limit int) ([]HashtagCount, error) {
+	defer s.time("trending_hashtags", time.Now())
+	return s.Store.TrendingHashtags(since, limit)
+}
+
+func (s *timedStore) LikeChirp(chirpID, userID int) (Chirp, error) {
+	defer s.time("like_chirp", time.Now())
+	return s.Store.LikeChirp(chirpID, userID)
+}
+
+func (s *timedStore) UnlikeChirp(chirpID, userID int) (Chirp, error) {
+	defer s.time("unlike_chirp", time.Now())
+	return s.Store.UnlikeChirp(chirpID, userID)
+}
+
+func (s *timedStore) LikedChirps(userID int, chirpIDs []int) (map[int]bool, error) {
+	defer s.time("liked_chirps", time.Now())
+	return s.Store.LikedChirps(userID, chirpIDs)
+}
+
+func (s *timedStore) Rechirp(chirpID, userID int, quote string) (Chirp, error) {
+	defer s.time("rechirp", time.Now())
+	return s.Store.Rechirp(chirpID, userID, quote)
+}
+
+func (s *timedStore) DeleteRechirp(chirpID, userID int) (Chirp, error) {
+	defer s.time("delete_rechirp", time.Now())
+	return s.Store.DeleteRechirp(chirpID, userID)
+}
+
+func (s *timedStore) GetRechirps(chirpID int) ([]Rechirp, error) {
+	defer s.time("get_rechirps", time.Now())
+	return s.Store.GetRechirps(chirpID)
+}
+
+func (s *timedStore) CreateUser(email, password string) (User, error) {
+	defer s.time("create_user", time.Now())
+	return s.Store.CreateUser(email, password)
+}
+
+func (s *timedStore) UpdateUser(id int, properties map[string]string) (User, error) {
+	defer s.time("update_user", time.Now())
+	return s.Store.UpdateUser(id, properties)
+}
+
+func (s *timedStore) GetUser(id int) (User, error) {
+	defer s.time("get_user", time.Now())
+	return s.Store.GetUser(id)
+}
+
+func (s *timedStore) SetRole(userID, moderatorID int, role string) (User, error) {
+	defer s.time("set_role", time.Now())
+	return s.Store.SetRole(userID, moderatorID, role)
+}
+
+func (s *timedStore) GetUsers() ([]User, error) {
+	defer s.time("get_users", time.Now())
+	return s.Store.GetUsers()
+}
+
+func (s *timedStore) UserLogin(email, password string) (User, error) {
+	defer s.time("user_login", time.Now())
+	return s.Store.UserLogin(email, password)
+}
+
+func (s *timedStore) Follow(followerID, followeeID int) error {
+	defer s.time("follow", time.Now())
+	return s.Store.Follow(followerID, followeeID)
+}
+
+func (s *timedStore) Unfollow(followerID, followeeID int) error {
+	defer s.time("unfollow", time.Now())
+	return s.Store.Unfollow(followerID, followeeID)
+}
+
+func (s *timedStore) GetFollowers(id int) ([]Follow, error) {
+	defer s.time("get_followers", time.Now())
+	return s.Store.GetFollowers(id)
+}
+
+func (s *timedStore) GetFollowing(id int) ([]Follow, error) {
+	defer s.time("get_following", time.Now())
+	return s.Store.GetFollowing(id)
+}
+
+func (s *timedStore) Timeline(userID int, after *ChirpCursor, limit int) ([]Chirp, error) {
+	defer s.time("timeline", time.Now())
+	return s.Store.Timeline(userID, after, limit)
+}
+
+func (s *timedStore) GetNotifications(q NotificationQuery) ([]Notification, error) {
+	defer s.time("get_notifications", time.Now())
+	return s.Store.GetNotifications(q)
+}
+
+func (s *timedStore) UnreadNotifications(userID int) (int, error) {
+	defer s.time("unread_notifications", time.Now())
+	return s.Store.UnreadNotifications(userID)
+}
+
+func (s *timedStore) MarkNotificationsRead(userID int, ids []int) (int, error) {
+	defer s.time("mark_notifications_read", time.Now())
+	return s.Store.MarkNotificationsRead(userID, ids)
+}
+
+func (s *timedStore) ReportChirp(chirpID, reporterID int, reason string) (Report, error) {
+	defer s.time("report_chirp", time.Now())
+	return s.Store.ReportChirp(chirpID, reporterID, reason)
+}
+
+func (s *timedStore) ModerationQueue(after, limit int) ([]ModerationItem, error) {
+	defer s.time("moderation_queue", time.Now())
+	return s.Store.ModerationQueue(after, limit)
+}
+
+func (s *timedStore) ModerateChirp(chirpID, moderatorID int, action, note string) (Chirp, error) {
+	defer s.time("moderate_chirp", time.Now())
+	return s.Store.ModerateChirp(chirpID, moderatorID, action, note)
+}
+
+func (s *timedStore) SuspendUser(userID, moderatorID int, suspended bool, note string) (User, error) {
+	defer s.time("suspend_user", time.Now())
+	return s.Store.SuspendUser(userID, moderatorID, suspended, note)
+}
+
+func (s *timedStore) AuditLog(before, limit int) ([]AuditEntry, error) {
+	defer s.time("audit_log", time.Now())
+	return s.Store.AuditLog(before, limit)
+}
+
+func (s *timedStore) RevokeToken(key string, expiresAt time.Time) error {
+	defer s.time("revoke_token", time.Now())
+	return s.Store.RevokeToken(key, expiresAt)
+}
+
+func (s *timedStore) GetTokenRevocation(key string) (Revocation, error) {
+	defer s.time("get_token_revocation", time.Now())
+	return s.Store.GetTokenRevocation(key)
+}
+
+func (s *timedStore) IsTokenRevoked(key string) bool {
+	defer s.time("is_token_revoked", time.Now())
+	return s.Store.IsTokenRevoked(key)
+}
+
+func (s *timedStore) PruneRevocations(now time.Time) (int, error) {
+	defer s.time("prune_revocations", time.Now())
+	return s.Store.PruneRevocations(now)
+}
+
+func (s *timedStore) RevocationStats(now time.Time) (RevocationStats, error) {
+	defer s.time("revocation_stats", time.Now())
+	return s.Store.RevocationStats(now)
+}
+
+func (s *timedStore) CreateTokenFamily(userID int, tokenID, userAgent, ip string) (TokenFamily, error) {
+	defer s.time("create_token_family", time.Now())
+	return s.Store.CreateTokenFamily(userID, tokenID, userAgent, ip)
+}
+
+func (s *timedStore) GetTokenFamily(id int) (TokenFamily, error) {
+	defer s.time("get_token_family", time.Now())
+	return s.Store.GetTokenFamily(id)
+}
+
+func (s *timedStore) ListTokenFamilies(userID int) ([]TokenFamily, error) {
+	defer s.time("list_token_families", time.Now())
+	return s.Store.ListTokenFamilies(userID)
+}
+
+func (s *timedStore) RotateToken(familyID int, tokenID, newTokenID string) (TokenFamily, error) {
+	defer s.time("rotate_token", time.Now())
+	return s.Store.RotateToken(familyID, tokenID, newTokenID)
+}
+
+func (s *timedStore) RevokeTokenFamily(id int) error {
+	defer s.time("revoke_token_family", time.Now())
+	return s.Store.RevokeTokenFamily(id)
+}
+
+func (s *timedStore) RevokeTokenFamilies(userID int) (int, error) {
+	defer s.time("revoke_token_families", time.Now())
+	return s.Store.RevokeTokenFamilies(userID)
+}
+
+func (s *timedStore) TokensValidAfter(userID int) (time.Time, error) {
+	defer s.time("tokens_valid_after", time.Now())
+	return s.Store.TokensValidAfter(userID)
+}
+
+func (s *timedStore) PruneTokenFamilies(before time.Time) (int, error) {
+	defer s.time("prune_token_families", time.Now())
+	return s.Store.PruneTokenFamilies(before)
+}
@@ -0,0 +1,364 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrTokenReused is returned by RotateToken when the token being rotated was
+// already replaced. The family is revoked, since either the user or whoever
+// stole their token is holding a token they shouldn't have.
+var ErrTokenReused = errors.New("Refresh token has already been used")
+
+// ErrTokenFamilyRevoked is returned by RotateToken when the family was
+// revoked, so none of its tokens can be rotated anymore
+var ErrTokenFamilyRevoked = errors.New("Token family has been revoked")
+
+// TokenFamily is the chain of refresh tokens that began with one login, which
+// makes it that login's session. Every refresh replaces the family's token,
+// so only the newest one is valid. UserAgent and IP are those of the login.
+type TokenFamily struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	TokenID   string    `json:"token_id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	RotatedAt time.Time `json:"rotated_at"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+func (f TokenFamily) Revoked() bool {
+	return !f.RevokedAt.IsZero()
+}
+
+// CreateTokenFamily starts a family for a user who just logged in. tokenID is
+// the ID of their first refresh token.
+func (db *DB) CreateTokenFamily(userID int, tokenID, userAgent, ip string) (TokenFamily, error) {
+	var result TokenFamily
+
+	err := db.Update(func(dbs *DBStructure) error {
+		if _, ok := dbs.Users[userID]; !ok {
+			return errors.New("User id does not exist")
+		}
+
+		now := time.Now().UTC()
+		result = TokenFamily{
+			ID:        dbs.NextTokenFamilyID,
+			UserID:    userID,
+			TokenID:   tokenID,
+			UserAgent: userAgent,
+			IP:        ip,
+			CreatedAt: now,
+			RotatedAt: now,
+		}
+		dbs.TokenFamilies[result.ID] = result
+		dbs.NextTokenFamilyID++
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *DB) GetTokenFamily(id int) (TokenFamily, error) {
+	var result TokenFamily
+
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		result, ok = dbs.TokenFamilies[id]
+		if !ok {
+			return errors.New("Token family does not exist")
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// ListTokenFamilies returns the token families of a user that haven't been
+// revoked, oldest first
+func (db *DB) ListTokenFamilies(userID int) ([]TokenFamily, error) {
+	var result []TokenFamily
+
+	err := db.View(func(dbs *DBStructure) error {
+		for _, family := range dbs.TokenFamilies {
+			if family.UserID == userID && !family.Revoked() {
+				result = append(result, family)
+			}
+		}
+		return nil
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
+	return result, err
+}
+
+// RotateToken replaces a family's refresh token tokenID with newTokenID. If
+// tokenID isn't the family's current token, the family is revoked and
+// ErrTokenReused is returned.
+func (db *DB) RotateToken(familyID int, tokenID, newTokenID string) (TokenFamily, error) {
+	var result TokenFamily
+	var reused bool
+
+	err := db.Update(func(dbs *DBStructure) error {
+		family, ok := dbs.TokenFamilies[familyID]
+		if !ok {
+			return errors.New("Token family does not exist")
+		}
+		if family.Revoked() {
+			return ErrTokenFamilyRevoked
+		}
+
+		now := time.Now().UTC()
+		if family.TokenID != tokenID {
+			reused = true
+			family.RevokedAt = now
+		} else {
+			family.TokenID = newTokenID
+			family.RotatedAt = now
+		}
+		dbs.TokenFamilies[familyID] = family
+		result = family
+		return nil
+	})
+
+	if err == nil && reused {
+		err = ErrTokenReused
+	}
+	return result, err
+}
+
+// RevokeTokenFamily invalidates every refresh token in a family. Revoking a
+// family again keeps the original revocation time.
+func (db *DB) RevokeTokenFamily(id int) error {
+	return db.Update(func(dbs *DBStructure) error {
+		family, ok := dbs.TokenFamilies[id]
+		if !ok {
+			return errors.New("Token family does not exist")
+		}
+		if !family.Revoked() {
+			family.RevokedAt = time.Now().UTC()
+			dbs.TokenFamilies[id] = family
+		}
+		return nil
+	})
+}
+
+// RevokeTokenFamilies revokes every token family of a user and returns how
+// many were still active. Tokens issued before token families existed don't
+// belong to one, so TokensValidAfter is moved up to cut them off too.
+func (db *DB) RevokeTokenFamilies(userID int) (int, error) {
+	var result int
+
+	err := db.Update(func(dbs *DBStructure) error {
+		now := time.Now().UTC()
+		for id, family := range dbs.TokenFamilies {
+			if family.UserID == userID && !family.Revoked() {
+				family.RevokedAt = now
+				dbs.TokenFamilies[id] = family
+				result++
+			}
+		}
+		if user, ok := dbs.Users[userID]; ok {
+			user.TokensValidAfter = now
+			dbs.Users[userID] = user
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// TokensValidAfter returns when a user's tokens without a token family were
+// last revoked, or the zero time if they never were
+func (db *DB) TokensValidAfter(userID int) (time.Time, error) {
+	var result time.Time
+
+	err := db.View(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[userID]
+		if !ok {
+			return errors.New("User id does not exist")
+		}
+		result = user.TokensValidAfter
+		return nil
+	})
+
+	return result, err
+}
+
+// PruneTokenFamilies removes the token families whose last refresh token was
+// issued before before, and returns how many it removed. A family can only be
+// revoked after its last rotation, so this includes every family revoked
+// before then.
+func (db *DB) PruneTokenFamilies(before time.Time) (int, error) {
+	var result int
+
+	err := db.View(func(dbs *DBStructure) error {
+		for _, family := range dbs.TokenFamilies {
+			if family.RotatedAt.Before(before) {
+				result++
+			}
+		}
+		return nil
+	})
+	// Only take the write lock, and write the file, if there's work to do
+	if err != nil || result == 0 {
+		return 0, err
+	}
+
+	result = 0
+	err = db.Update(func(dbs *DBStructure) error {
+		for id, family := range dbs.TokenFamilies {
+			if family.RotatedAt.Before(before) {
+				delete(dbs.TokenFamilies, id)
+				result++
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+const tokenFamilyColumns = "id, user_id, token_id, user_agent, ip, created_at, rotated_at, revoked_at"
+
+func scanTokenFamily(row scanner) (TokenFamily, error) {
+	var result TokenFamily
+	var revokedAt sql.NullTime
+	err := row.Scan(&result.ID, &result.UserID, &result.TokenID, &result.UserAgent, &result.IP,
+		&result.CreatedAt, &result.RotatedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, errors.New("Token family does not exist")
+	}
+	result.RevokedAt = revokedAt.Time
+	return result, err
+}
+
+func (db *SQLiteDB) CreateTokenFamily(userID int, tokenID, userAgent, ip string) (TokenFamily, error) {
+	now := time.Now().UTC()
+	result := TokenFamily{UserID: userID, TokenID: tokenID, UserAgent: userAgent, IP: ip, CreatedAt: now, RotatedAt: now}
+
+	res, err := db.db.Exec(`
+		INSERT INTO token_families (user_id, token_id, user_agent, ip, created_at, rotated_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, tokenID, userAgent, ip, now, now)
+	if err != nil {
+		return result, err
+	}
+	id, err := res.LastInsertId()
+	result.ID = int(id)
+	return result, err
+}
+
+func (db *SQLiteDB) GetTokenFamily(id int) (TokenFamily, error) {
+	return scanTokenFamily(db.db.QueryRow("SELECT "+tokenFamilyColumns+" FROM token_families WHERE id = ?", id))
+}
+
+func (db *SQLiteDB) RotateToken(familyID int, tokenID, newTokenID string) (TokenFamily, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return TokenFamily{}, err
+	}
+	defer tx.Rollback()
+
+	family, err := scanTokenFamily(tx.QueryRow("SELECT "+tokenFamilyColumns+" FROM token_families WHERE id = ?", familyID))
+	if err != nil {
+		return family, err
+	}
+	if family.Revoked() {
+		return family, ErrTokenFamilyRevoked
+	}
+
+	now := time.Now().UTC()
+	reused := family.TokenID != tokenID
+	if reused {
+		family.RevokedAt = now
+		_, err = tx.Exec("UPDATE token_families SET revoked_at = ? WHERE id = ?", now, familyID)
+	} else {
+		family.TokenID = newTokenID
+		family.RotatedAt = now
+		_, err = tx.Exec("UPDATE token_families SET token_id = ?, rotated_at = ? WHERE id = ?", newTokenID, now, familyID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == nil && reused {
+		err = ErrTokenReused
+	}
+	return family, err
+}
+
+func (db *SQLiteDB) RevokeTokenFamily(id int) error {
+	res, err := db.db.Exec("UPDATE token_families SET revoked_at = coalesce(revoked_at, ?) WHERE id = ?", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Token family does not exist")
+	}
+	return nil
+}
+
+func (db *SQLiteDB) ListTokenFamilies(userID int) ([]TokenFamily, error) {
+	var result []TokenFamily
+
+	rows, err := db.db.Query("SELECT "+tokenFamilyColumns+" FROM token_families WHERE user_id = ? AND revoked_at IS NULL ORDER BY id", userID)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		family, err := scanTokenFamily(rows)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, family)
+	}
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) RevokeTokenFamilies(userID int) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	res, err := tx.Exec("UPDATE token_families SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE users SET tokens_valid_after = ? WHERE id = ?", now, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), tx.Commit()
+}
+
+func (db *SQLiteDB) TokensValidAfter(userID int) (time.Time, error) {
+	var result sql.NullTime
+	err := db.db.QueryRow("SELECT tokens_valid_after FROM users WHERE id = ?", userID).Scan(&result)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result.Time, errors.New("User id does not exist")
+	}
+	return result.Time, err
+}
+
+func (db *SQLiteDB) PruneTokenFamilies(before time.Time) (int, error) {
+	res, err := db.db.Exec("DELETE FROM token_families WHERE rotated_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
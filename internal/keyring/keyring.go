@@ -0,0 +1,344 @@
+// Package keyring signs and verifies JWTs with a set of RS256 and EdDSA keys
+// that can be rotated on a schedule, falling back to an HS256 secret.
+//
+// Each key is identified by the kid header of the tokens it signs. The newest
+// key that has become active signs new tokens, and the keys it replaced keep
+// verifying until every token they signed has expired. The secret is retired
+// the same way when the first key activates: it only verifies tokens issued
+// before then, and only until they have expired. Retirement is worked out
+// from the keys' activation times alone, so it doesn't start over when the
+// server restarts.
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ActivatesAtHeader is the PEM header that schedules when a key starts
+// signing tokens, in RFC 3339 format. Load requires it. Keys parsed without it
+// have been active all along.
+const ActivatesAtHeader = "Activates-At"
+
+// Key is a private key that signs tokens once it becomes active
+type Key struct {
+	ID          string
+	ActivatesAt time.Time
+
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+// Algorithm is the alg header of the tokens the key signs
+func (k *Key) Algorithm() string {
+	return k.method.Alg()
+}
+
+// ParseKey reads an RSA or Ed25519 private key from PEM data. Its ID is the
+// key's JWK thumbprint (RFC 7638).
+func ParseKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := new(Key)
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.method, key.private = jwt.SigningMethodRS256, private
+	case ed25519.PrivateKey:
+		key.method, key.private = jwt.SigningMethodEdDSA, private
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T", parsed)
+	}
+
+	if activates, ok := block.Headers[ActivatesAtHeader]; ok {
+		key.ActivatesAt, err = time.Parse(time.RFC3339, activates)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s header: %w", ActivatesAtHeader, err)
+		}
+	}
+	key.ID, err = thumbprint(key.JWK())
+	return key, err
+}
+
+// JWK is the public half of a key as a JSON Web Key
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+func (k *Key) JWK() JWK {
+	result := JWK{Kid: k.ID, Use: "sig", Alg: k.Algorithm()}
+	switch public := k.private.Public().(type) {
+	case *rsa.PublicKey:
+		result.Kty = "RSA"
+		result.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		result.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		result.Kty = "OKP"
+		result.Crv = "Ed25519"
+		result.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return result
+}
+
+// thumbprint hashes the required members of a JWK in the order RFC 7638 sets
+func thumbprint(jwk JWK) (string, error) {
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	default:
+		return "", fmt.Errorf("Unsupported key type %q", jwk.Kty)
+	}
+
+	buf, err := json.Marshal(members)
+	sum := sha256.Sum256(buf)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), err
+}
+
+// Keyring holds the keys that sign and verify tokens
+type Keyring struct {
+	secret []byte
+	// keys are sorted by activation time, oldest first
+	keys []*Key
+	// maxAge is the longest a token can be valid for, which is how long a
+	// key keeps verifying after a newer one replaces it
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+// New creates a keyring that signs with the HS256 secret until keys are added
+func New(secret string, maxAge time.Duration) *Keyring {
+	return &Keyring{secret: []byte(secret), maxAge: maxAge, now: time.Now}
+}
+
+// Add adds keys to the keyring
+func (kr *Keyring) Add(keys ...*Key) error {
+	for _, key := range keys {
+		for _, existing := range kr.keys {
+			if existing.ID == key.ID {
+				return fmt.Errorf("Duplicate key %s", key.ID)
+			}
+		}
+		kr.keys = append(kr.keys, key)
+	}
+	sort.SliceStable(kr.keys, func(i, j int) bool { return kr.keys[i].ActivatesAt.Before(kr.keys[j].ActivatesAt) })
+	return nil
+}
+
+// Load creates a keyring with every .pem key in dir. Every key must have an
+// ActivatesAtHeader, since the keys it replaces are retired relative to it.
+// Of the keys with the same activation time, the last by file name signs.
+func Load(dir, secret string, maxAge time.Duration) (*Keyring, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No .pem keys in %s", dir)
+	}
+
+	result := New(secret, maxAge)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if key.ActivatesAt.IsZero() {
+			return nil, fmt.Errorf("%s: Missing %s header", path, ActivatesAtHeader)
+		}
+		if err = result.Add(key); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return result, nil
+}
+
+// signingKey is the newest key that is active at now, or nil if none are
+func (kr *Keyring) signingKey(now time.Time) *Key {
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		if !kr.keys[i].ActivatesAt.After(now) {
+			return kr.keys[i]
+		}
+	}
+	return nil
+}
+
+// verifying reports whether a key may still have signed unexpired tokens at
+// now. Keys scheduled for the future verify too, so they are published in
+// advance.
+func (kr *Keyring) verifying(i int, now time.Time) bool {
+	if i == len(kr.keys)-1 {
+		return true
+	}
+	// The key was replaced when the next one activated. A key without an
+	// activation time has been active all along, so the keys before it never
+	// signed anything.
+	replaced := kr.keys[i+1].ActivatesAt
+	return now.Before(replaced.Add(kr.maxAge))
+}
+
+// secretRetired returns when the first key started signing in place of the
+// secret, and whether it has by now
+func (kr *Keyring) secretRetired(now time.Time) (time.Time, bool) {
+	if len(kr.keys) == 0 || kr.keys[0].ActivatesAt.After(now) {
+		return time.Time{}, false
+	}
+	return kr.keys[0].ActivatesAt, true
+}
+
+// secretVerifying reports whether tokens signed with the secret are still
+// accepted at now. Once a key has replaced it, they are until every token the
+// secret signed has expired.
+func (kr *Keyring) secretVerifying(now time.Time) bool {
+	retired, ok := kr.secretRetired(now)
+	return !ok || now.Before(retired.Add(kr.maxAge))
+}
+
+// Sign signs claims with the current signing key, or with the HS256 secret if
+// no key is active yet
+func (kr *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key := kr.signingKey(kr.now())
+	if key == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(kr.secret)
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
+}
+
+// Keyfunc finds the key that verifies a token. Tokens with a kid must use
+// that key's algorithm, and tokens without one must be HS256, so a public key
+// can never be used as an HMAC secret.
+func (kr *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	now := kr.now()
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("Token has no key ID")
+		}
+		if !kr.secretVerifying(now) {
+			return nil, errors.New("Signing secret has been retired")
+		}
+		// Only tokens signed before a key replaced the secret, and that expire
+		// when those tokens did, are accepted. Anyone holding the secret
+		// chooses the times, so a backdated token can't outlive the others.
+		if retired, ok := kr.secretRetired(now); ok {
+			issued, err := token.Claims.GetIssuedAt()
+			if err != nil || issued == nil || issued.After(retired) {
+				return nil, errors.New("Token was signed with a retired secret")
+			}
+			expires, err := token.Claims.GetExpirationTime()
+			if err != nil || expires == nil || expires.Sub(issued.Time) > kr.maxAge || expires.After(retired.Add(kr.maxAge)) {
+				return nil, errors.New("Token signed with a retired secret outlives it")
+			}
+		}
+		return kr.secret, nil
+	}
+
+	for i, key := range kr.keys {
+		if key.ID != kid {
+			continue
+		}
+		if !kr.verifying(i, now) {
+			return nil, errors.New("Signing key has been retired")
+		}
+		if token.Method.Alg() != key.Algorithm() {
+			return nil, errors.New("Token algorithm doesn't match its key")
+		}
+		return key.private.Public(), nil
+	}
+	return nil, fmt.Errorf("Unknown key %q", kid)
+}
+
+// Methods are the algorithms of the keys that verify tokens, plus HS256 until
+// the secret has been retired
+func (kr *Keyring) Methods() []string {
+	var result []string
+	now := kr.now()
+	for i, key := range kr.keys {
+		if kr.verifying(i, now) && !slices.Contains(result, key.Algorithm()) {
+			result = append(result, key.Algorithm())
+		}
+	}
+	if kr.secretVerifying(now) {
+		result = append(result, jwt.SigningMethodHS256.Alg())
+	}
+	return result
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that verify tokens, including scheduled keys
+// that haven't started signing yet
+func (kr *Keyring) JWKS() JWKS {
+	result := JWKS{Keys: []JWK{}}
+	now := kr.now()
+	for i, key := range kr.keys {
+		if kr.verifying(i, now) {
+			result.Keys = append(result.Keys, key.JWK())
+		}
+	}
+	return result
+}
@@ -0,0 +1,306 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func rsaPEM(t *testing.T, headers map[string]string) []byte {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Headers: headers, Bytes: x509.MarshalPKCS1PrivateKey(private)})
+}
+
+func ed25519PEM(t *testing.T, headers map[string]string) []byte {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Headers: headers, Bytes: der})
+}
+
+func parseKey(t *testing.T, data []byte) *Key {
+	t.Helper()
+	key, err := ParseKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func claims() jwt.Claims {
+	return claimsAt(time.Now())
+}
+
+func claimsAt(issued time.Time) jwt.Claims {
+	return jwt.RegisteredClaims{
+		Subject:   "1",
+		IssuedAt:  jwt.NewNumericDate(issued),
+		ExpiresAt: jwt.NewNumericDate(issued.Add(time.Hour)),
+	}
+}
+
+// verify parses a token with the keyring, returning its kid
+func verify(kr *Keyring, token string) (string, error) {
+	parsed, err := jwt.Parse(token, kr.Keyfunc, jwt.WithValidMethods(kr.Methods()))
+	if err != nil {
+		return "", err
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid, nil
+}
+
+func TestSecretFallback(t *testing.T) {
+	kr := New("secret", time.Hour)
+	token, err := kr.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, err := verify(kr, token); err != nil || kid != "" {
+		t.Fatalf("Unexpected kid %q (%v)", kid, err)
+	}
+	if methods := kr.Methods(); !slices.Equal(methods, []string{"HS256"}) {
+		t.Fatalf("Unexpected methods %v", methods)
+	}
+	if _, err = verify(New("other", time.Hour), token); err == nil {
+		t.Fatal("Verified token signed with another secret")
+	}
+	if jwks := kr.JWKS(); len(jwks.Keys) != 0 {
+		t.Fatalf("Secret published in JWKS: %+v", jwks)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for name, data := range map[string][]byte{"RS256": rsaPEM(t, nil), "EdDSA": ed25519PEM(t, nil)} {
+		t.Run(name, func(t *testing.T) {
+			key := parseKey(t, data)
+			if key.Algorithm() != name {
+				t.Fatalf("Expected %s, got %s", name, key.Algorithm())
+			}
+			kr := New("secret", time.Hour)
+			legacy, _ := kr.Sign(claimsAt(time.Now().Add(-time.Minute)))
+			key.ActivatesAt = time.Now().Add(-time.Second)
+			if err := kr.Add(key); err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := kr.Sign(claims())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kid, err := verify(kr, token); err != nil || kid != key.ID {
+				t.Fatalf("Expected kid %s, got %q (%v)", key.ID, kid, err)
+			}
+
+			// Tokens signed with the secret before the key was added still verify
+			if _, err = verify(kr, legacy); err != nil {
+				t.Fatal(err)
+			}
+
+			jwks := kr.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != key.ID || jwks.Keys[0].Alg != name {
+				t.Fatalf("Unexpected JWKS %+v", jwks)
+			}
+			if methods := kr.Methods(); !slices.Equal(methods, []string{name, "HS256"}) {
+				t.Fatalf("Unexpected methods %v", methods)
+			}
+		})
+	}
+}
+
+func TestAlgorithmConfusion(t *testing.T) {
+	key := parseKey(t, rsaPEM(t, nil))
+	kr := New("secret", time.Hour)
+	kr.Add(key)
+
+	// An HMAC token claiming the RSA key, signed with its public key
+	public, _ := x509.MarshalPKIXPublicKey(key.private.Public())
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	token.Header["kid"] = key.ID
+	forged, _ := token.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+	if _, err := verify(kr, forged); err == nil {
+		t.Fatal("Verified HS256 token signed with a public key")
+	}
+
+	// An RSA token without a kid
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, claims())
+	signed, _ := token.SignedString(key.private)
+	if _, err := verify(kr, signed); err == nil {
+		t.Fatal("Verified RS256 token without a kid")
+	}
+
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, claims())
+	token.Header["kid"] = "unknown"
+	signed, _ = token.SignedString(key.private)
+	if _, err := verify(kr, signed); err == nil {
+		t.Fatal("Verified token with an unknown kid")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	start := time.Now()
+	activates := start.Add(time.Hour).UTC().Format(time.RFC3339)
+	old := parseKey(t, rsaPEM(t, nil))
+	next := parseKey(t, ed25519PEM(t, map[string]string{ActivatesAtHeader: activates}))
+
+	kr := New("secret", 24*time.Hour)
+	kr.Add(next, old)
+	now := start
+	kr.now = func() time.Time { return now }
+
+	before, _ := kr.Sign(claims())
+	if kid, _ := verify(kr, before); kid != old.ID {
+		t.Fatalf("Expected old key to sign before rotation, got %q", kid)
+	}
+	if jwks := kr.JWKS(); len(jwks.Keys) != 2 {
+		t.Fatalf("Scheduled key isn't published in advance: %+v", jwks)
+	}
+
+	now = start.Add(2 * time.Hour)
+	after, _ := kr.Sign(claims())
+	if kid, _ := verify(kr, after); kid != next.ID {
+		t.Fatalf("Expected new key to sign after rotation, got %q", kid)
+	}
+	if _, err := kr.Keyfunc(&jwt.Token{Method: jwt.SigningMethodRS256, Header: map[string]any{"kid": old.ID}}); err != nil {
+		t.Fatalf("Replaced key stopped verifying early: %v", err)
+	}
+
+	// Once every token it signed has expired, the old key is retired
+	now = start.Add(26 * time.Hour)
+	if _, err := kr.Keyfunc(&jwt.Token{Method: jwt.SigningMethodRS256, Header: map[string]any{"kid": old.ID}}); err == nil {
+		t.Fatal("Retired key still verifies")
+	}
+	if jwks := kr.JWKS(); len(jwks.Keys) != 1 || jwks.Keys[0].Kid != next.ID {
+		t.Fatalf("Unexpected JWKS after retirement %+v", jwks)
+	}
+	if methods := kr.Methods(); !slices.Equal(methods, []string{"EdDSA"}) {
+		t.Fatalf("Retired key's algorithm still accepted: %v", methods)
+	}
+
+	// A key without an activation time has been signing all along, so the
+	// keys before it never verify
+	unscheduled := New("secret", 24*time.Hour)
+	unscheduled.Add(parseKey(t, rsaPEM(t, nil)), old)
+	if _, err := unscheduled.Keyfunc(&jwt.Token{Method: jwt.SigningMethodRS256, Header: map[string]any{"kid": old.ID}}); err != nil {
+		t.Fatalf("Newest key doesn't verify: %v", err)
+	}
+	if _, err := unscheduled.Keyfunc(&jwt.Token{Method: jwt.SigningMethodRS256, Header: map[string]any{"kid": unscheduled.keys[0].ID}}); err == nil {
+		t.Fatal("Key replaced by a key without an activation time still verifies")
+	}
+}
+
+func TestSecretRetirement(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	now := start
+	kr := New("secret", 24*time.Hour)
+	kr.now = func() time.Time { return now }
+
+	// The secret keeps signing until the scheduled key activates
+	key := parseKey(t, rsaPEM(t, map[string]string{ActivatesAtHeader: start.Add(time.Hour).UTC().Format(time.RFC3339)}))
+	kr.Add(key)
+	before, _ := kr.Sign(claimsAt(start))
+	if kid, err := verify(kr, before); err != nil || kid != "" {
+		t.Fatalf("Secret stopped signing before the key activated: %q (%v)", kid, err)
+	}
+
+	// Then it only verifies the tokens it signed until they expire
+	now = start.Add(2 * time.Hour)
+	if _, err := verify(kr, before); err != nil {
+		t.Fatalf("Token signed before rotation was rejected: %v", err)
+	}
+	secret := func(issued time.Time) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claimsAt(issued)).SignedString([]byte("secret"))
+		return token
+	}
+	if _, err := verify(kr, secret(now)); err == nil {
+		t.Fatal("Verified token signed with the secret after it was retired")
+	}
+	noIssued, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}).SignedString([]byte("secret"))
+	if _, err := verify(kr, noIssued); err == nil {
+		t.Fatal("Verified token without an issue time signed with a retired secret")
+	}
+
+	// Whoever holds the secret can backdate a token, but not make it outlive
+	// the tokens the secret really signed
+	for _, expires := range []time.Time{start.Add(48 * time.Hour), now.Add(23 * time.Hour)} {
+		forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(start),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		}).SignedString([]byte("secret"))
+		if _, err := verify(kr, forged); err == nil {
+			t.Fatalf("Verified backdated token expiring at %v", expires)
+		}
+	}
+
+	// Restarting the server doesn't start the retirement over
+	restarted := New("secret", 24*time.Hour)
+	restarted.now = func() time.Time { return start.Add(26 * time.Hour) }
+	restarted.Add(key)
+	if slices.Contains(restarted.Methods(), "HS256") {
+		t.Fatal("HS256 accepted again after a restart")
+	}
+
+	now = start.Add(26 * time.Hour)
+	if slices.Contains(kr.Methods(), "HS256") {
+		t.Fatal("HS256 still accepted after the secret's tokens expired")
+	}
+	if _, err := kr.Keyfunc(&jwt.Token{Method: jwt.SigningMethodHS256, Header: map[string]any{}, Claims: claimsAt(start)}); err == nil {
+		t.Fatal("Retired secret still verifies")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(dir, "secret", time.Hour); err == nil {
+		t.Fatal("Loaded keyring from empty directory")
+	}
+
+	activates := map[string]string{ActivatesAtHeader: time.Now().UTC().Format(time.RFC3339)}
+	rsaKey, edKey := rsaPEM(t, activates), ed25519PEM(t, activates)
+	os.WriteFile(filepath.Join(dir, "a.pem"), rsaKey, 0600)
+	os.WriteFile(filepath.Join(dir, "b.pem"), edKey, 0600)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a key"), 0600)
+	kr, err := Load(dir, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kr.keys) != 2 || kr.signingKey(time.Now()).ID != parseKey(t, edKey).ID {
+		t.Fatal("Expected the last key by file name to sign")
+	}
+
+	os.WriteFile(filepath.Join(dir, "c.pem"), rsaKey, 0600)
+	if _, err = Load(dir, "secret", time.Hour); err == nil {
+		t.Fatal("Loaded the same key twice")
+	}
+	os.Remove(filepath.Join(dir, "c.pem"))
+
+	os.WriteFile(filepath.Join(dir, "c.pem"), ed25519PEM(t, map[string]string{ActivatesAtHeader: "tomorrow"}), 0600)
+	if _, err = Load(dir, "secret", time.Hour); err == nil {
+		t.Fatal("Loaded key with invalid activation time")
+	}
+
+	os.WriteFile(filepath.Join(dir, "c.pem"), ed25519PEM(t, nil), 0600)
+	if _, err = Load(dir, "secret", time.Hour); err == nil {
+		t.Fatal("Loaded key without an activation time")
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounter("test_requests_total", "Requests served.", "route", "code")
+	latency := reg.NewHistogram("test_latency_seconds", "Request latency.", []float64{1, 0.1}, "route")
+	reg.CounterFunc("test_hits_total", "Hits with a\nnewline.", func() float64 { return 3 })
+
+	requests.Inc("/b", "200")
+	requests.Inc("/a", "404")
+	requests.Add(2, "/a", "200")
+	requests.Inc(`/"quoted"`, "200")
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.5, "/a")
+	latency.Observe(2, "/a")
+
+	var sb strings.Builder
+	if err := reg.WriteText(&sb); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_hits_total Hits with a\nnewline.
+# TYPE test_hits_total counter
+test_hits_total 3
+# HELP test_latency_seconds Request latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{route="/a",le="0.1"} 1
+test_latency_seconds_bucket{route="/a",le="1"} 2
+test_latency_seconds_bucket{route="/a",le="+Inf"} 3
+test_latency_seconds_sum{route="/a"} 2.55
+test_latency_seconds_count{route="/a"} 3
+# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{route="/\"quoted\"",code="200"} 1
+test_requests_total{route="/a",code="200"} 2
+test_requests_total{route="/a",code="404"} 1
+test_requests_total{route="/b",code="200"} 1
+`
+	if sb.String() != want {
+		t.Fatalf("Unexpected output:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounter("test_total", "Test counter.", "worker")
+	histogram := reg.NewHistogram("test_seconds", "Test histogram.", DefaultBuckets)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counter.Inc("all")
+				histogram.Observe(0.001)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var sb strings.Builder
+	reg.WriteText(&sb)
+	for _, line := range []string{`test_total{worker="all"} 8000`, "test_seconds_count 8000"} {
+		if !strings.Contains(sb.String(), line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, sb.String())
+		}
+	}
+}
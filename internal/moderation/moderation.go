@@ -0,0 +1,147 @@
+// Package moderation checks chirps against a list of blocked words
+package moderation
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Action is what happens to a chirp that contains a blocked word
+type Action string
+
+const (
+	// ActionMask replaces every blocked word with asterisks
+	ActionMask Action = "mask"
+	// ActionReject refuses the chirp
+	ActionReject Action = "reject"
+	// ActionHold keeps the chirp out of public view until a moderator
+	// reviews it
+	ActionHold Action = "hold"
+
+	// Mask is what a blocked word is replaced with
+	Mask = "****"
+)
+
+// DefaultWords is the word list used when none is configured
+var DefaultWords = []string{"kerfuffle", "sharbert", "fornax"}
+
+func ParseAction(s string) (Action, error) {
+	switch a := Action(strings.ToLower(s)); a {
+	case ActionMask, ActionReject, ActionHold:
+		return a, nil
+	}
+	return "", fmt.Errorf("Unknown moderation action %q", s)
+}
+
+// Filter finds blocked words in chirps. A Filter is safe for concurrent use.
+type Filter struct {
+	words  map[string]bool
+	action Action
+}
+
+// NewFilter returns a filter for words. Matching ignores case.
+func NewFilter(words []string, action Action) *Filter {
+	f := &Filter{words: make(map[string]bool), action: action}
+	for _, w := range words {
+		w = strings.ToLower(strings.TrimSpace(w))
+		if len(w) > 0 {
+			f.words[w] = true
+		}
+	}
+	return f
+}
+
+// LoadFilter reads a word list with one word per line. Blank lines and lines
+// starting with # are ignored.
+func LoadFilter(path string, action Action) (*Filter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.IndexFunc(line, unicode.IsSpace) >= 0 {
+			return nil, fmt.Errorf("%s: %q is not a single word", path, line)
+		}
+		words = append(words, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewFilter(words, action), nil
+}
+
+func (f *Filter) Action() Action {
+	return f.action
+}
+
+// Result is the outcome of checking a chirp
+type Result struct {
+	// Body is the chirp with every blocked word masked
+	Body string
+	// Matches lists the blocked words found, lowercased, in the order they
+	// first appear
+	Matches []string
+}
+
+// Blocked reports whether the chirp contained any blocked words, in which
+// case the filter's action applies
+func (r Result) Blocked() bool {
+	return len(r.Matches) > 0
+}
+
+// isWordRune reports whether r can be part of a word. Anything else, such as
+// spaces and punctuation, separates words.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r)
+}
+
+// Check finds the blocked words in body. Only whole words match, so a blocked
+// word inside a longer word is left alone.
+func (f *Filter) Check(body string) Result {
+	var result Result
+	var masked strings.Builder
+	seen := make(map[string]bool)
+
+	rest := body
+	for len(rest) > 0 {
+		start := strings.IndexFunc(rest, isWordRune)
+		if start < 0 {
+			break
+		}
+		end := strings.IndexFunc(rest[start:], func(r rune) bool { return !isWordRune(r) })
+		if end < 0 {
+			end = len(rest)
+		} else {
+			end += start
+		}
+
+		word := strings.ToLower(rest[start:end])
+		masked.WriteString(rest[:start])
+		if f.words[word] {
+			masked.WriteString(Mask)
+			if !seen[word] {
+				seen[word] = true
+				result.Matches = append(result.Matches, word)
+			}
+		} else {
+			masked.WriteString(rest[start:end])
+		}
+		rest = rest[end:]
+	}
+	masked.WriteString(rest)
+
+	result.Body = masked.String()
+	return result
+}
@@ -0,0 +1,76 @@
+package moderation
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	f := NewFilter([]string{"kerfuffle", "Sharbert", "fornax", "çà"}, ActionMask)
+
+	tests := []struct {
+		body    string
+		want    string
+		matches []string
+	}{
+		{"This is fine", "This is fine", nil},
+		{"What a kerfuffle", "What a ****", []string{"kerfuffle"}},
+		{"Kerfuffle! KERFUFFLE, kerfuffle.", "****! ****, ****.", []string{"kerfuffle"}},
+		{"sharbert and fornax", "**** and ****", []string{"sharbert", "fornax"}},
+		{"kerfuffles and unfornax stay", "kerfuffles and unfornax stay", nil},
+		{"sharbert_fornax", "****_****", []string{"sharbert", "fornax"}},
+		{"ÇÀ va", "**** va", []string{"çà"}},
+		{"garçàn", "garçàn", nil},
+		{"", "", nil},
+	}
+
+	for _, test := range tests {
+		result := f.Check(test.body)
+		if result.Body != test.want {
+			t.Errorf("Check(%q) body = %q, want %q", test.body, result.Body, test.want)
+		}
+		if !slices.Equal(result.Matches, test.matches) {
+			t.Errorf("Check(%q) matches = %v, want %v", test.body, result.Matches, test.matches)
+		}
+		if result.Blocked() != (len(test.matches) > 0) {
+			t.Errorf("Check(%q) blocked = %v", test.body, result.Blocked())
+		}
+	}
+}
+
+func TestLoadFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	err := os.WriteFile(path, []byte("# Blocked words\n\nKerfuffle\n  fornax  \n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadFilter(path, ActionHold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Action() != ActionHold {
+		t.Fatalf("Expected hold, got %s", f.Action())
+	}
+	if result := f.Check("kerfuffle fornax sharbert"); result.Body != "**** **** sharbert" {
+		t.Fatalf("Unexpected body %q", result.Body)
+	}
+
+	os.WriteFile(path, []byte("two words\n"), 0644)
+	if _, err = LoadFilter(path, ActionMask); err == nil {
+		t.Fatal("Loaded a phrase")
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	for _, s := range []string{"mask", "Reject", "HOLD"} {
+		if _, err := ParseAction(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ParseAction("ban"); err == nil {
+		t.Fatal("Parsed unknown action")
+	}
+}
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/almushel/chirpy/internal/auth"
 	. "github.com/almushel/chirpy/internal/chirpapi"
+	"github.com/almushel/chirpy/internal/chirpydb"
+	"github.com/almushel/chirpy/internal/keyring"
+	"github.com/almushel/chirpy/internal/moderation"
 )
 
+// shutdownTimeout is how long the server waits for requests in flight to
+// finish when it is interrupted
+const shutdownTimeout = 10 * time.Second
+
 func middlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -49,49 +63,179 @@ func parseEnv() {
 	}
 }
 
+func openStore(kind, path string, flushInterval time.Duration) (chirpydb.Store, error) {
+	switch kind {
+	case "json":
+		return chirpydb.NewDBWithOptions(path, chirpydb.Options{
+			Backups:       chirpydb.DefaultBackups,
+			FlushInterval: flushInterval,
+		})
+	case "sqlite":
+		return chirpydb.NewSQLiteDB(path)
+	}
+	return nil, fmt.Errorf("Unknown database store %q", kind)
+}
+
+func migrateStore(kind, path string, dryRun bool) ([]chirpydb.Migration, error) {
+	switch kind {
+	case "json":
+		return chirpydb.MigrateDB(path, dryRun)
+	case "sqlite":
+		return chirpydb.MigrateSQLiteDB(path, dryRun)
+	}
+	return nil, fmt.Errorf("Unknown database store %q", kind)
+}
+
+// makeAdmin gives the user with the given email the admin role, so there is
+// someone who can grant roles through the API
+func makeAdmin(kind, path, email string) (chirpydb.User, error) {
+	db, err := openStore(kind, path, 0)
+	if err != nil {
+		return chirpydb.User{}, err
+	}
+	defer db.Close()
+
+	users, err := db.GetUsers()
+	if err != nil {
+		return chirpydb.User{}, err
+	}
+	for _, user := range users {
+		if user.Email == email {
+			return db.SetRole(user.ID, 0, chirpydb.RoleAdmin)
+		}
+	}
+	return chirpydb.User{}, fmt.Errorf("No user with email %s", email)
+}
+
 func InitServer(cfg *ApiConfig, addr string) (*http.Server, error) {
 	var server http.Server
 
 	r := chi.NewRouter()
+	r.Use(cfg.MiddlewareMetrics)
 	fs := cfg.MiddlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("."))))
 	r.Handle("/app/*", fs)
 	r.Handle("/app", fs)
+	r.Get("/.well-known/jwks.json", cfg.JWKSHandler)
 
 	apiRouter := chi.NewRouter()
 	apiRouter.Get("/healthz", healthzHandler)
-	apiRouter.HandleFunc("/reset", cfg.ResetHandler)
+	apiRouter.With(cfg.RequireRole(chirpydb.RoleAdmin)).HandleFunc("/reset", cfg.ResetHandler)
 
 	apiRouter.Post("/chirps", cfg.PostChirpsHandler)
 	apiRouter.Get("/chirps", cfg.GetChirpsHandler)
+	apiRouter.Get("/chirps/search", cfg.SearchChirpsHandler)
+	apiRouter.Get("/chirps/stream", cfg.StreamChirpsHandler)
 	apiRouter.Get("/chirps/{chirpID}", cfg.GetChirpsHandler)
+	apiRouter.Put("/chirps/{chirpID}", cfg.PutChirpsHandler)
+	apiRouter.Get("/chirps/{chirpID}/history", cfg.GetChirpHistoryHandler)
+	apiRouter.Get("/chirps/{chirpID}/thread", cfg.GetThreadHandler)
 	apiRouter.Delete("/chirps/{chirpID}", cfg.DeleteChirpsHandler)
+	apiRouter.Post("/chirps/{chirpID}/like", cfg.PostLikeHandler)
+	apiRouter.Delete("/chirps/{chirpID}/like", cfg.DeleteLikeHandler)
+	apiRouter.Post("/chirps/{chirpID}/rechirp", cfg.PostRechirpHandler)
+	apiRouter.Delete("/chirps/{chirpID}/rechirp", cfg.DeleteRechirpHandler)
+	apiRouter.Get("/chirps/{chirpID}/rechirps", cfg.GetRechirpsHandler)
+	apiRouter.Post("/chirps/{chirpID}/report", cfg.PostReportHandler)
+
+	apiRouter.Get("/hashtags/trending", cfg.TrendingHashtagsHandler)
+	apiRouter.Get("/hashtags/{tag}", cfg.GetHashtagHandler)
 
 	apiRouter.Post("/users", cfg.PostUsersHandler)
 	apiRouter.Put("/users", cfg.PutUsersHandler)
+	apiRouter.Post("/users/{userID}/follow", cfg.PostFollowHandler)
+	apiRouter.Delete("/users/{userID}/follow", cfg.DeleteFollowHandler)
+	apiRouter.Get("/users/{userID}/followers", cfg.GetFollowersHandler)
+	apiRouter.Get("/users/{userID}/following", cfg.GetFollowingHandler)
+	apiRouter.Get("/timeline", cfg.TimelineHandler)
+	apiRouter.Get("/notifications", cfg.GetNotificationsHandler)
+	apiRouter.Post("/notifications/read", cfg.PostNotificationsReadHandler)
+	apiRouter.Get("/ws", cfg.WebSocketHandler)
 
 	apiRouter.Post("/login", cfg.PostLoginHandler)
 	apiRouter.Post("/refresh", cfg.PostRefreshHandler)
 	apiRouter.Post("/revoke", cfg.PostRevokeHandler)
+	apiRouter.Get("/sessions", cfg.GetSessionsHandler)
+	apiRouter.Delete("/sessions", cfg.DeleteSessionsHandler)
+	apiRouter.Delete("/sessions/{sessionID}", cfg.DeleteSessionHandler)
 
 	apiRouter.Post("/polka/webhooks", cfg.PolkaWebhookHandler)
 
 	r.Mount("/api", apiRouter)
 
 	adminRouter := chi.NewRouter()
-	adminRouter.Get("/metrics", cfg.MetricsHandler)
+	adminRouter.With(cfg.RequireRole(chirpydb.RoleAdmin)).Get("/metrics", cfg.MetricsHandler)
+	adminRouter.With(cfg.RequireScraper).Get("/metrics/prometheus", cfg.PrometheusHandler)
+	adminRouter.With(cfg.RequireRole(chirpydb.RoleAdmin)).Put("/users/{userID}/role", cfg.PutRoleHandler)
+	adminRouter.With(cfg.RequireRole(chirpydb.RoleAdmin)).Get("/revocations", cfg.RevocationsHandler)
+	adminRouter.Route("/moderation", func(r chi.Router) {
+		r.Use(cfg.RequireRole(chirpydb.RoleModerator))
+		r.Get("/", cfg.ModerationQueueHandler)
+		r.Post("/chirps/{chirpID}", cfg.ModerateChirpHandler)
+		r.Post("/users/{userID}/suspend", cfg.PostSuspendHandler)
+		r.Delete("/users/{userID}/suspend", cfg.DeleteSuspendHandler)
+		r.Get("/audit", cfg.AuditLogHandler)
+	})
 	r.Mount("/admin", adminRouter)
 
 	server.Handler = middlewareCors(r)
 	server.Addr = addr
+	server.RegisterOnShutdown(cfg.CloseStreams)
 
 	return &server, nil
 }
 
 func main() {
 	dbg := flag.Bool("debug", false, "Enable debug mode")
+	store := flag.String("store", "json", "Database store to use (json or sqlite)")
+	dbPath := flag.String("db", "database.json", "Path to the database file")
+	flushInterval := flag.Duration("flush-interval", 0, "Batch JSON database writes and flush them at this interval (0 writes synchronously)")
+	janitorInterval := flag.Duration("janitor-interval", chirpydb.DefaultJanitorInterval, "How often to remove the revocations and sessions of expired tokens")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "List the schema migrations the database needs and exit")
+	bootstrapAdmin := flag.String("bootstrap-admin", "", "Make the user with this email an admin and exit")
+	blockedWords := flag.String("blocked-words", "", "Path to a list of words chirps may not contain, one per line")
+	moderationAction := flag.String("moderation-action", "mask", "What to do with chirps containing blocked words (mask, reject or hold)")
+	jwtKeys := flag.String("jwt-keys", "", "Directory of .pem private keys to sign tokens with instead of JWT_SECRET")
+	jwtAudience := flag.String("jwt-audience", DefaultAudience, "Audience of the tokens the server issues and accepts")
+	jwtLeeway := flag.Duration("jwt-leeway", auth.DefaultLeeway, "How much clock skew to allow for when checking token times")
+	jwtLegacyBefore := flag.String("jwt-legacy-before", "", "Keep accepting tokens without an audience signed with JWT_SECRET before this RFC 3339 time")
 	flag.Parse()
 	if *dbg {
-		os.Remove("database.json")
+		chirpydb.RemoveDB(*dbPath)
+	}
+
+	if *migrateDryRun {
+		pending, err := migrateStore(*store, *dbPath, true)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(pending) == 0 {
+			fmt.Println(*dbPath, "is up to date")
+		}
+		for _, m := range pending {
+			fmt.Println(m)
+		}
+		return
+	}
+
+	if len(*bootstrapAdmin) > 0 {
+		user, err := makeAdmin(*store, *dbPath, *bootstrapAdmin)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("%s (user #%d) is now an admin\n", user.Email, user.ID)
+		return
+	}
+
+	action, err := moderation.ParseAction(*moderationAction)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	filter := moderation.NewFilter(moderation.DefaultWords, action)
+	if len(*blockedWords) > 0 {
+		filter, err = moderation.LoadFilter(*blockedWords, action)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
 	parseEnv()
@@ -106,12 +250,61 @@ func main() {
 		return
 	}
 
-	cfg, err := NewChirpAPI("database.json", jwt, pk)
+	db, err := openStore(*store, *dbPath, *flushInterval)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+
+	cfg, err := NewChirpAPI(db, jwt, pk)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	cfg.SetFilter(filter)
+	cfg.SetScrapeToken(os.Getenv("METRICS_TOKEN"))
+	cfg.SetTokenValidation(*jwtAudience, *jwtLeeway)
+	if len(*jwtLegacyBefore) > 0 {
+		cutoff, err := time.Parse(time.RFC3339, *jwtLegacyBefore)
+		if err != nil {
+			log.Fatalln("Invalid -jwt-legacy-before:", err)
+		}
+		cfg.SetLegacyTokenCutoff(cutoff)
+	}
+	if len(*jwtKeys) > 0 {
+		keys, err := keyring.Load(*jwtKeys, jwt, RefreshTokenLifetime)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cfg.SetKeyring(keys)
+	}
 	server, err := InitServer(cfg, "localhost:8080")
+
+	janitorDone := make(chan struct{})
+	go chirpydb.RunJanitor(db, *janitorInterval, RefreshTokenLifetime, *jwtLeeway, janitorDone)
+
+	// Shut down cleanly on interrupt so pending database writes are flushed.
+	// ListenAndServe returns as soon as Shutdown starts, so the database is
+	// only closed once the requests still in flight have finished.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		close(janitorDone)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("Shutdown:", err)
+		}
+	}()
+
 	log.Println("Chirpy listening and serving at", server.Addr)
-	log.Fatalf(server.ListenAndServe().Error())
-	return
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Println(err)
+		return
+	}
+	<-shutdownDone
 }
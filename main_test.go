@@ -1,24 +1,42 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+
 	. "github.com/almushel/chirpy/internal/chirpapi"
+	"github.com/almushel/chirpy/internal/chirpydb"
 )
 
 type chirpStruct struct {
-	ID       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type userStruct struct {
+	ID          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 const (
@@ -29,24 +47,35 @@ const (
 	testEmail1 = "user@email.com"
 	testEmail2 = "user2@email.com"
 	testPW1    = "12345"
+
+	testScrapeToken = "scrape-token"
 )
 
 var running bool
 var accessToken, refreshToken string
+var testDB *chirpydb.DB
+var testSecret []byte
 
 func init() {
-	os.Remove(dbPath)
+	chirpydb.RemoveDB(dbPath)
 
 	var cfg *ApiConfig
-	var jwt, pk []byte
+	var pk []byte
 
-	jwt = make([]byte, 64)
-	_, err := rand.Read(jwt)
+	testSecret = make([]byte, 64)
+	_, err := rand.Read(testSecret)
 	if err == nil {
 		pk = make([]byte, 16)
 		_, err = rand.Read(pk)
 		if err == nil {
-			cfg, err = NewChirpAPI(dbPath, string(jwt), string(pk))
+			testDB, err = chirpydb.NewDB(dbPath)
+			if err == nil {
+				cfg, err = NewChirpAPI(testDB, string(testSecret), string(pk))
+			}
+			if err == nil {
+				cfg.SetScrapeToken(testScrapeToken)
+				cfg.SetLegacyTokenCutoff(time.Now())
+			}
 		}
 	}
 
@@ -55,6 +84,11 @@ func init() {
 		os.Exit(1)
 	}
 
+	// WebSockets notice ended sessions at their next ping, so the tests ping
+	// often enough not to wait long. It is set before the server starts, since
+	// handlers read it.
+	WSPingInterval = time.Second
+
 	server, err := InitServer(cfg, serverAddr)
 	go func() {
 		running = true
@@ -137,7 +171,12 @@ func TestPostUser(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if strings.Compare(string(rBody), fmt.Sprintf(`{"id":1,"email":"%s","is_chirpy_red":false}`, testEmail1)) != 0 {
+	var user userStruct
+	err = json.Unmarshal(rBody, &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 1 || user.Email != testEmail1 || user.IsChirpyRed || user.CreatedAt.IsZero() {
 		t.Fatalf("Unexpected response: %s", string(rBody))
 	}
 }
@@ -189,7 +228,12 @@ func TestPutUser(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if strings.Compare(string(rBody), fmt.Sprintf(`{"id":1,"email":"%s","is_chirpy_red":false}`, testEmail2)) != 0 {
+	var user userStruct
+	err = json.Unmarshal(rBody, &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 1 || user.Email != testEmail2 || user.IsChirpyRed || user.UpdatedAt.Before(user.CreatedAt) {
 		t.Fatalf("Unexpected response: %s", string(rBody))
 	}
 }
@@ -217,9 +261,14 @@ func TestPostChirp(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		expected := fmt.Sprintf(`{"id":%d,"author_id":1,%s}`, i+1, chirp[1:len(chirp)-1])
-		if strings.Compare(string(rBody), expected) != 0 {
-			t.Fatalf("\nExpected; %s\n Recieved: %s", expected, string(rBody))
+		var expected, received chirpStruct
+		json.Unmarshal(chirp, &expected)
+		err = json.Unmarshal(rBody, &received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.ID != i+1 || received.AuthorID != 1 || received.Body != expected.Body || received.CreatedAt.IsZero() {
+			t.Fatalf("\nExpected; %s\n Recieved: %s", chirp, string(rBody))
 		}
 	}
 }
@@ -241,11 +290,46 @@ func TestGetChirps(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if strings.Compare(string(responseBody), `{"id":4,"author_id":1,"body":"This is fourth test chirp!"}`) != 0 {
+	var chirp chirpStruct
+	err = json.Unmarshal(responseBody, &chirp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 4 || chirp.AuthorID != 1 || chirp.Body != "This is fourth test chirp!" {
 		t.Fatal("Unexpected GET chirp response body")
 	}
 }
 
+func TestPutChirp(t *testing.T) {
+	requestBody := []byte(`{"body":"This is the edited fourth test chirp!"}`)
+	request, err := http.NewRequest("PUT", apiAddr+"/chirps/4", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRequest(t, request, 401, "Edited chirp without authorization")
+
+	request, _ = http.NewRequest("PUT", apiAddr+"/chirps/4", bytes.NewBuffer(requestBody))
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	response := testRequest(t, request, 200, "Failed to edit chirp")
+	response.Body.Close()
+
+	request, _ = http.NewRequest("GET", apiAddr+"/chirps/4/history", nil)
+	response = testRequest(t, request, 200, "Failed to get chirp history")
+	defer response.Body.Close()
+
+	var history []struct {
+		Body      string    `json:"body"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Body != "This is fourth test chirp!" || history[1].Body != "This is the edited fourth test chirp!" {
+		t.Fatalf("Unexpected chirp history: %v", history)
+	}
+}
+
 func TestDeleteChirp(t *testing.T) {
 	deleteID := 3
 	request, err := http.NewRequest("DELETE", apiAddr+"/chirps/"+fmt.Sprint(deleteID), nil)
@@ -261,31 +345,653 @@ func TestDeleteChirp(t *testing.T) {
 	testRequest(t, request, 404, "Successfully GOT deleted chirp")
 }
 
-func TestRefresh(t *testing.T) {
-	request, err := http.NewRequest("POST", apiAddr+"/refresh", nil)
+func TestChirpPagination(t *testing.T) {
+	var ids []int
+	next := apiAddr + "/chirps?sort=desc&limit=2"
+	for len(next) > 0 {
+		response, err := http.Get(next)
+		if err != nil {
+			t.Fatal(err)
+		} else if response.StatusCode != 200 {
+			t.Fatal("Failed to get page of chirps")
+		}
+
+		var page []chirpStruct
+		err = json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chirp := range page {
+			ids = append(ids, chirp.ID)
+		}
+
+		next = ""
+		link := response.Header.Get("Link")
+		if len(link) > 0 {
+			url, _, _ := strings.Cut(link, ">")
+			next = "http://" + serverAddr + strings.TrimPrefix(url, "<")
+		}
+	}
+
+	if fmt.Sprint(ids) != "[4 2 1]" {
+		t.Fatalf("Unexpected chirps across pages: %v", ids)
+	}
+
+	response, err := http.Get(apiAddr + "/chirps?cursor=garbage")
 	if err != nil {
 		t.Fatal(err)
 	}
-	testRequest(t, request, 401, "Refreshed access token without authorization header")
+	response.Body.Close()
+	if response.StatusCode != 400 {
+		t.Fatal("Accepted an invalid cursor")
+	}
+}
 
-	request.Header.Add("Authorization", "Bearer "+refreshToken)
-	response := testRequest(t, request, 200, "Refresh failed with valid authorization")
-	responseBody, err := io.ReadAll(response.Body)
+func TestSearchChirps(t *testing.T) {
+	response, err := http.Get(apiAddr + "/chirps/search?q=" + url.QueryEscape(`"edited fourth" test`))
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		t.Fatal("Search request failed")
+	}
+
+	var chirps []chirpStruct
+	err = json.NewDecoder(response.Body).Decode(&chirps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].ID != 4 {
+		t.Fatalf("Unexpected search results: %v", chirps)
+	}
+
+	request, _ := http.NewRequest("GET", apiAddr+"/chirps/search", nil)
+	testRequest(t, request, 400, "Searched without a query")
+
+	request, _ = http.NewRequest("GET", apiAddr+"/chirps/search?q=nothingmatchesthis", nil)
+	response = testRequest(t, request, 200, "Search without results failed")
+	defer response.Body.Close()
+	empty, _ := io.ReadAll(response.Body)
+	if string(bytes.TrimSpace(empty)) != "[]" {
+		t.Fatalf("Search without results didn't return an empty list: %s", empty)
+	}
+}
+
+func TestThread(t *testing.T) {
+	request, err := http.NewRequest("POST", apiAddr+"/chirps", bytes.NewBufferString(`{"body":"A reply","in_reply_to":4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	response := testRequest(t, request, 201, "Failed to post reply")
+	var reply chirpStruct
+	json.NewDecoder(response.Body).Decode(&reply)
+	response.Body.Close()
+
+	request, _ = http.NewRequest("GET", apiAddr+"/chirps/"+fmt.Sprint(reply.ID)+"/thread", nil)
+	response = testRequest(t, request, 200, "Failed to get thread")
+	defer response.Body.Close()
+
+	var thread struct {
+		ID         int `json:"id"`
+		ReplyCount int `json:"reply_count"`
+		Replies    []struct {
+			ID        int `json:"id"`
+			InReplyTo int `json:"in_reply_to"`
+		} `json:"replies"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&thread)
 	if err != nil {
 		t.Fatal(err)
-	} else if response.StatusCode != 200 {
-		t.Fatal(response.Status)
 	}
+	if thread.ID != 4 || thread.ReplyCount != 1 || len(thread.Replies) != 1 || thread.Replies[0].ID != reply.ID {
+		t.Fatalf("Unexpected thread: %+v", thread)
+	}
+
+	request, _ = http.NewRequest("POST", apiAddr+"/chirps", bytes.NewBufferString(`{"body":"A reply","in_reply_to":1000}`))
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	testRequest(t, request, 400, "Replied to a chirp that doesn't exist")
+}
 
-	var refresh struct {
+func TestFollow(t *testing.T) {
+	// A second user follows the first one, who has posted every chirp so far
+	requestBody := []byte(fmt.Sprintf(`{"password":"%s", "email":"%s"}`, testPW1, testEmail1))
+	request, _ := http.NewRequest("POST", apiAddr+"/users", bytes.NewBuffer(requestBody))
+	testRequest(t, request, 201, "Failed to create second user").Body.Close()
+	request, _ = http.NewRequest("POST", apiAddr+"/users", bytes.NewBuffer(requestBody))
+	testRequest(t, request, 409, "Created a user with a taken email").Body.Close()
+	request, _ = http.NewRequest("POST", apiAddr+"/login", bytes.NewBuffer(requestBody))
+	response := testRequest(t, request, 200, "Failed to log in second user")
+	var auth struct {
 		Token string `json:"token"`
 	}
-	err = json.Unmarshal(responseBody, &refresh)
+	json.NewDecoder(response.Body).Decode(&auth)
+	response.Body.Close()
+
+	taken := []byte(fmt.Sprintf(`{"password":"%s", "email":"%s"}`, testPW1, testEmail2))
+	request, _ = http.NewRequest("PUT", apiAddr+"/users", bytes.NewBuffer(taken))
+	request.Header.Add("Authorization", "Bearer "+auth.Token)
+	testRequest(t, request, 409, "Changed email to another user's").Body.Close()
+
+	request, _ = http.NewRequest("POST", apiAddr+"/users/1/follow", nil)
+	testRequest(t, request, 401, "Followed without authorization")
+	request.Header.Add("Authorization", "Bearer "+auth.Token)
+	testRequest(t, request, 200, "Failed to follow user").Body.Close()
+
+	request, _ = http.NewRequest("POST", apiAddr+"/users/2/follow", nil)
+	request.Header.Add("Authorization", "Bearer "+auth.Token)
+	testRequest(t, request, 400, "Followed self")
+
+	request, _ = http.NewRequest("GET", apiAddr+"/users/1/followers", nil)
+	response = testRequest(t, request, 200, "Failed to get followers")
+	var followers []struct {
+		UserID int `json:"user_id"`
+	}
+	json.NewDecoder(response.Body).Decode(&followers)
+	response.Body.Close()
+	if len(followers) != 1 || followers[0].UserID != 2 {
+		t.Fatalf("Unexpected followers: %+v", followers)
+	}
+
+	chirpList, err := getChirps()
 	if err != nil {
 		t.Fatal(err)
 	}
-	accessToken = refresh.Token
+	request, _ = http.NewRequest("GET", apiAddr+"/timeline?limit=2", nil)
+	request.Header.Add("Authorization", "Bearer "+auth.Token)
+	response = testRequest(t, request, 200, "Failed to get timeline")
+	var timeline []chirpStruct
+	json.NewDecoder(response.Body).Decode(&timeline)
+	response.Body.Close()
+	if len(timeline) != 2 || timeline[0].ID != chirpList[len(chirpList)-1].ID {
+		t.Fatalf("Unexpected timeline: %+v", timeline)
+	}
+	if !strings.Contains(response.Header.Get("Link"), `rel="next"`) {
+		t.Fatal("Missing next page link")
+	}
+
+	request, _ = http.NewRequest("DELETE", apiAddr+"/users/1/follow", nil)
+	request.Header.Add("Authorization", "Bearer "+auth.Token)
+	testRequest(t, request, 200, "Failed to unfollow user").Body.Close()
+
+	request, _ = http.NewRequest("GET", apiAddr+"/timeline", nil)
+	request.Header.Add("Authorization", "Bearer "+auth.Token)
+	response = testRequest(t, request, 200, "Failed to get timeline")
+	empty, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(bytes.TrimSpace(empty)) != "[]" {
+		t.Fatalf("Timeline not empty after unfollowing: %s", empty)
+	}
+
+	request, _ = http.NewRequest("GET", apiAddr+"/users/1/followers", nil)
+	response = testRequest(t, request, 200, "Failed to get followers")
+	empty, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(bytes.TrimSpace(empty)) != "[]" {
+		t.Fatalf("Followers not empty after unfollowing: %s", empty)
+	}
+}
+
+func TestLikes(t *testing.T) {
+	request, _ := http.NewRequest("POST", apiAddr+"/chirps/1/like", nil)
+	testRequest(t, request, 401, "Liked chirp without authorization")
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	testRequest(t, request, 200, "Failed to like chirp").Body.Close()
+
+	request, _ = http.NewRequest("POST", apiAddr+"/chirps/1/rechirp", bytes.NewBufferString(`{"quote":"Look at this"}`))
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	testRequest(t, request, 201, "Failed to rechirp").Body.Close()
+
+	type likedChirp struct {
+		LikeCount    int   `json:"like_count"`
+		RechirpCount int   `json:"rechirp_count"`
+		LikedByMe    *bool `json:"liked_by_me"`
+	}
+	getChirp := func(token string) likedChirp {
+		request, _ := http.NewRequest("GET", apiAddr+"/chirps/1", nil)
+		if len(token) > 0 {
+			request.Header.Add("Authorization", "Bearer "+token)
+		}
+		response := testRequest(t, request, 200, "Failed to get chirp")
+		defer response.Body.Close()
+		var chirp likedChirp
+		json.NewDecoder(response.Body).Decode(&chirp)
+		return chirp
+	}
+
+	chirp := getChirp(accessToken)
+	if chirp.LikeCount != 1 || chirp.RechirpCount != 1 || chirp.LikedByMe == nil || !*chirp.LikedByMe {
+		t.Fatalf("Unexpected liked chirp: %+v", chirp)
+	}
+	if chirp = getChirp(""); chirp.LikedByMe != nil {
+		t.Fatal("liked_by_me set for an anonymous request")
+	}
+
+	request, _ = http.NewRequest("DELETE", apiAddr+"/chirps/1/like", nil)
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	testRequest(t, request, 200, "Failed to unlike chirp").Body.Close()
+	if chirp = getChirp(accessToken); chirp.LikeCount != 0 || *chirp.LikedByMe {
+		t.Fatalf("Unexpected unliked chirp: %+v", chirp)
+	}
+}
+
+func TestHashtags(t *testing.T) {
+	request, _ := http.NewRequest("POST", apiAddr+"/chirps", bytes.NewBufferString(`{"body":"Hello #Chirpy"}`))
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	response := testRequest(t, request, 201, "Failed to post tagged chirp")
+	var posted struct {
+		ID       int `json:"id"`
+		Entities []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"entities"`
+	}
+	json.NewDecoder(response.Body).Decode(&posted)
+	response.Body.Close()
+	if len(posted.Entities) != 1 || posted.Entities[0].Type != "hashtag" || posted.Entities[0].Text != "chirpy" {
+		t.Fatalf("Unexpected entities: %+v", posted.Entities)
+	}
+
+	request, _ = http.NewRequest("GET", apiAddr+"/hashtags/chirpy", nil)
+	response = testRequest(t, request, 200, "Failed to list hashtag")
+	var tagged []chirpStruct
+	json.NewDecoder(response.Body).Decode(&tagged)
+	response.Body.Close()
+	if len(tagged) != 1 || tagged[0].ID != posted.ID {
+		t.Fatalf("Unexpected tagged chirps: %+v", tagged)
+	}
+
+	request, _ = http.NewRequest("GET", apiAddr+"/hashtags/unused", nil)
+	response = testRequest(t, request, 200, "Failed to list unused hashtag")
+	empty, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(bytes.TrimSpace(empty)) != "[]" {
+		t.Fatalf("Expected no chirps for an unused hashtag, got %s", empty)
+	}
+
+	request, _ = http.NewRequest("GET", apiAddr+"/hashtags/trending?window=1h", nil)
+	response = testRequest(t, request, 200, "Failed to get trending hashtags")
+	var trending []struct {
+		Tag   string `json:"tag"`
+		Count int    `json:"count"`
+	}
+	json.NewDecoder(response.Body).Decode(&trending)
+	response.Body.Close()
+	if len(trending) != 1 || trending[0].Tag != "chirpy" || trending[0].Count != 1 {
+		t.Fatalf("Unexpected trending hashtags: %+v", trending)
+	}
+
+	request, _ = http.NewRequest("GET", apiAddr+"/hashtags/trending?window=forever", nil)
+	testRequest(t, request, 400, "Accepted an invalid window")
+	// 213504 days overflows into about 25 minutes
+	request, _ = http.NewRequest("GET", apiAddr+"/hashtags/trending?window=213504d", nil)
+	testRequest(t, request, 400, "Accepted a window that overflows")
+}
+
+func TestNotifications(t *testing.T) {
+	type notifications struct {
+		UnreadCount   int `json:"unread_count"`
+		Notifications []struct {
+			Type    string `json:"type"`
+			ActorID int    `json:"actor_id"`
+		} `json:"notifications"`
+	}
+
+	request, _ := http.NewRequest("GET", apiAddr+"/notifications", nil)
+	testRequest(t, request, 401, "Got notifications without authorization")
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	response := testRequest(t, request, 200, "Failed to get notifications")
+	var inbox notifications
+	json.NewDecoder(response.Body).Decode(&inbox)
+	response.Body.Close()
+	// The second user followed the first in TestFollow
+	if inbox.UnreadCount != 1 || len(inbox.Notifications) != 1 || inbox.Notifications[0].Type != "follow" || inbox.Notifications[0].ActorID != 2 {
+		t.Fatalf("Unexpected notifications: %+v", inbox)
+	}
+
+	request, _ = http.NewRequest("POST", apiAddr+"/notifications/read", nil)
+	request.Header.Add("Authorization", "Bearer "+accessToken)
+	response = testRequest(t, request, 200, "Failed to mark notifications read")
+	inbox = notifications{}
+	json.NewDecoder(response.Body).Decode(&inbox)
+	response.Body.Close()
+	if inbox.UnreadCount != 0 {
+		t.Fatalf("Expected no unread notifications, got %d", inbox.UnreadCount)
+	}
+}
+
+func TestChirpStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	readEvent := func(body *bufio.Reader) (id, event string) {
+		for {
+			line, err := body.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			if len(line) == 0 && len(event) > 0 {
+				return id, event
+			}
+			if value, ok := strings.CutPrefix(line, "id: "); ok {
+				id = value
+			} else if value, ok := strings.CutPrefix(line, "event: "); ok {
+				event = value
+			}
+		}
+	}
+
+	request, _ := http.NewRequestWithContext(ctx, "GET", apiAddr+"/chirps/stream?author_id=1", nil)
+	response := testRequest(t, request, 200, "Failed to open chirp stream")
+	defer response.Body.Close()
+
+	post, _ := http.NewRequest("POST", apiAddr+"/chirps", bytes.NewBufferString(`{"body":"Streamed chirp"}`))
+	post.Header.Add("Authorization", "Bearer "+accessToken)
+	testRequest(t, post, 201, "Failed to post chirp").Body.Close()
+
+	id, event := readEvent(bufio.NewReader(response.Body))
+	if event != "chirp.created" {
+		t.Fatalf("Unexpected event %q", event)
+	}
+
+	// Reconnecting from before the event replays it
+	lastID, _ := strconv.Atoi(id)
+	request, _ = http.NewRequestWithContext(ctx, "GET", apiAddr+"/chirps/stream", nil)
+	request.Header.Set("Last-Event-ID", strconv.Itoa(lastID-1))
+	resumed := testRequest(t, request, 200, "Failed to resume chirp stream")
+	defer resumed.Body.Close()
+	if replayed, _ := readEvent(bufio.NewReader(resumed.Body)); replayed != id {
+		t.Fatalf("Expected event %s to be replayed, got %s", id, replayed)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	wsAddr := "ws://" + serverAddr + "/api/ws"
+	if _, _, err := websocket.DefaultDialer.Dial(wsAddr, nil); err == nil {
+		t.Fatal("Connected without authorization")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsAddr+"?access_token="+accessToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	type message struct {
+		Type         string `json:"type"`
+		Channel      string `json:"channel"`
+		Event        string `json:"event"`
+		Chirp        *chirpStruct
+		Notification *struct {
+			Type    string `json:"type"`
+			ActorID int    `json:"actor_id"`
+		} `json:"notification"`
+	}
+	read := func() message {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	for _, channel := range []string{"author:1", "notifications", "nonsense"} {
+		conn.WriteJSON(map[string]string{"type": "subscribe", "channel": channel})
+	}
+	for _, want := range []string{"subscribed", "subscribed", "error"} {
+		if msg := read(); msg.Type != want {
+			t.Fatalf("Expected %s, got %+v", want, msg)
+		}
+	}
+
+	post, _ := http.NewRequest("POST", apiAddr+"/chirps", bytes.NewBufferString(`{"body":"Live chirp"}`))
+	post.Header.Add("Authorization", "Bearer "+accessToken)
+	response := testRequest(t, post, 201, "Failed to post chirp")
+	var chirp chirpStruct
+	json.NewDecoder(response.Body).Decode(&chirp)
+	response.Body.Close()
+	if msg := read(); msg.Channel != "author:1" || msg.Event != "chirp.created" || msg.Chirp == nil || msg.Chirp.ID != chirp.ID {
+		t.Fatalf("Unexpected chirp event: %+v", msg)
+	}
+
+	// The second user liking the chirp notifies the first
+	requestBody := []byte(fmt.Sprintf(`{"password":"%s", "email":"%s"}`, testPW1, testEmail1))
+	login, _ := http.NewRequest("POST", apiAddr+"/login", bytes.NewBuffer(requestBody))
+	response = testRequest(t, login, 200, "Failed to log in second user")
+	var auth struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(response.Body).Decode(&auth)
+	response.Body.Close()
+	like, _ := http.NewRequest("POST", apiAddr+"/chirps/"+fmt.Sprint(chirp.ID)+"/like", nil)
+	like.Header.Add("Authorization", "Bearer "+auth.Token)
+	testRequest(t, like, 200, "Failed to like chirp").Body.Close()
+	if msg := read(); msg.Channel != "notifications" || msg.Notification == nil || msg.Notification.Type != "like" || msg.Notification.ActorID != 2 {
+		t.Fatalf("Unexpected notification event: %+v", msg)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	post, _ := http.NewRequest("POST", apiAddr+"/chirps", bytes.NewBufferString(`{"body":"Kerfuffle, what a KERFUFFLE! No kerfuffles here"}`))
+	post.Header.Add("Authorization", "Bearer "+accessToken)
+	response := testRequest(t, post, 201, "Failed to post chirp")
+	var chirp chirpStruct
+	json.NewDecoder(response.Body).Decode(&chirp)
+	response.Body.Close()
+
+	// The masked body is what's stored, not only what's returned
+	get, _ := http.NewRequest("GET", apiAddr+"/chirps/"+fmt.Sprint(chirp.ID), nil)
+	response = testRequest(t, get, 200, "Failed to get chirp")
+	json.NewDecoder(response.Body).Decode(&chirp)
+	response.Body.Close()
+	if chirp.Body != "****, what a ****! No kerfuffles here" {
+		t.Fatalf("Unexpected chirp body %q", chirp.Body)
+	}
+
+	// and so are rechirp quotes
+	rechirp, _ := http.NewRequest("POST", apiAddr+"/chirps/"+fmt.Sprint(chirp.ID)+"/rechirp", bytes.NewBufferString(`{"quote":"What a kerfuffle"}`))
+	rechirp.Header.Add("Authorization", "Bearer "+accessToken)
+	testRequest(t, rechirp, 201, "Failed to rechirp").Body.Close()
+	get, _ = http.NewRequest("GET", apiAddr+"/chirps/"+fmt.Sprint(chirp.ID)+"/rechirps", nil)
+	response = testRequest(t, get, 200, "Failed to get rechirps")
+	var rechirps []struct {
+		Quote string `json:"quote"`
+	}
+	json.NewDecoder(response.Body).Decode(&rechirps)
+	response.Body.Close()
+	if len(rechirps) != 1 || rechirps[0].Quote != "What a ****" {
+		t.Fatalf("Unexpected rechirps %+v", rechirps)
+	}
+}
+
+func TestModerationQueue(t *testing.T) {
+	adminAddr := "http://" + serverAddr + "/admin/moderation"
+	request := func(method, url, token, body string) *http.Request {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		if len(token) > 0 {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		return req
+	}
+	login := func(email string, code int) string {
+		body := fmt.Sprintf(`{"password":"%s", "email":"%s"}`, testPW1, email)
+		response := testRequest(t, request("POST", apiAddr+"/login", "", body), code, "Unexpected login response")
+		defer response.Body.Close()
+		var auth struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(response.Body).Decode(&auth)
+		return auth.Token
+	}
+	userToken := login(testEmail1, 200)
+
+	response := testRequest(t, request("POST", apiAddr+"/chirps", accessToken, `{"body":"Report me"}`), 201, "Failed to post chirp")
+	var chirp chirpStruct
+	json.NewDecoder(response.Body).Decode(&chirp)
+	response.Body.Close()
+	chirpAddr := "/chirps/" + fmt.Sprint(chirp.ID)
+
+	response = testRequest(t, request("GET", apiAddr+chirpAddr+"/rechirps", "", ""), 200, "Failed to get rechirps")
+	rechirps, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(bytes.TrimSpace(rechirps)) != "[]" {
+		t.Fatalf("Expected no rechirps, got %s", rechirps)
+	}
+
+	testRequest(t, request("POST", apiAddr+chirpAddr+"/report", accessToken, ""), 400, "Reported own chirp").Body.Close()
+	testRequest(t, request("POST", apiAddr+chirpAddr+"/report", userToken, `{"reason":"spam"}`), 201, "Failed to report chirp").Body.Close()
+
+	testRequest(t, request("GET", adminAddr, "", ""), 401, "Got moderation queue without authorization").Body.Close()
+	testRequest(t, request("GET", adminAddr, accessToken, ""), 403, "Got moderation queue without being a moderator").Body.Close()
+
+	// Roles are granted by an admin and take effect immediately
+	if _, err := testDB.SetRole(1, 0, chirpydb.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	adminToken := accessToken
+	testRequest(t, request("PUT", "http://"+serverAddr+"/admin/users/2/role", adminToken, `{"role":"moderator"}`), 200, "Failed to set role").Body.Close()
+	modToken := userToken
+	testRequest(t, request("GET", "http://"+serverAddr+"/admin/metrics", modToken, ""), 403, "Moderator got metrics").Body.Close()
+	testRequest(t, request("GET", "http://"+serverAddr+"/admin/metrics", adminToken, ""), 200, "Admin couldn't get metrics").Body.Close()
+
+	response = testRequest(t, request("GET", adminAddr, modToken, ""), 200, "Failed to get moderation queue")
+	var queue []struct {
+		Chirp   chirpStruct `json:"chirp"`
+		Reports []struct {
+			ReporterID int    `json:"reporter_id"`
+			Reason     string `json:"reason"`
+		} `json:"reports"`
+	}
+	json.NewDecoder(response.Body).Decode(&queue)
+	response.Body.Close()
+	if len(queue) != 1 || queue[0].Chirp.ID != chirp.ID || len(queue[0].Reports) != 1 || queue[0].Reports[0].Reason != "spam" {
+		t.Fatalf("Unexpected moderation queue: %+v", queue)
+	}
+
+	// A hidden chirp is only visible to its author
+	testRequest(t, request("POST", adminAddr+chirpAddr, modToken, `{"action":"ban"}`), 400, "Applied unknown action").Body.Close()
+	testRequest(t, request("POST", adminAddr+chirpAddr, modToken, `{"action":"hide","note":"spam"}`), 200, "Failed to hide chirp").Body.Close()
+	testRequest(t, request("GET", apiAddr+chirpAddr, "", ""), 404, "Got hidden chirp").Body.Close()
+	testRequest(t, request("GET", apiAddr+chirpAddr, accessToken, ""), 200, "Author couldn't see hidden chirp").Body.Close()
+	testRequest(t, request("GET", apiAddr+chirpAddr+"/rechirps", "", ""), 404, "Got rechirps of hidden chirp").Body.Close()
+
+	// A suspended user's tokens stop working and they can't log in
+	testRequest(t, request("POST", adminAddr+"/users/1/suspend", modToken, ""), 403, "Moderator suspended an admin").Body.Close()
+	testRequest(t, request("POST", adminAddr+"/users/2/suspend", adminToken, ""), 200, "Failed to suspend user").Body.Close()
+	testRequest(t, request("POST", apiAddr+"/chirps", userToken, `{"body":"Am I suspended?"}`), 401, "Suspended user posted chirp").Body.Close()
+	login(testEmail1, 403)
+	testRequest(t, request("DELETE", adminAddr+"/users/2/suspend", adminToken, ""), 200, "Failed to lift suspension").Body.Close()
+	login(testEmail1, 200)
+
+	response = testRequest(t, request("GET", adminAddr+"/audit?limit=3", adminToken, ""), 200, "Failed to get audit log")
+	var audit []struct {
+		Action string `json:"action"`
+	}
+	json.NewDecoder(response.Body).Decode(&audit)
+	response.Body.Close()
+	if fmt.Sprint(audit) != "[{unsuspend} {suspend} {hide}]" {
+		t.Fatalf("Unexpected audit log: %v", audit)
+	}
+
+	// and so does taking them away
+	testRequest(t, request("PUT", "http://"+serverAddr+"/admin/users/2/role", adminToken, `{"role":"user"}`), 200, "Failed to set role").Body.Close()
+	testRequest(t, request("GET", adminAddr, modToken, ""), 403, "Demoted moderator got moderation queue").Body.Close()
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	// User 1 was made an admin in TestModerationQueue
+	body := fmt.Sprintf(`{"password":"%s", "email":"%s"}`, testPW1, testEmail2)
+	response, err := http.Post(apiAddr+"/login", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(response.Body).Decode(&auth)
+	response.Body.Close()
+
+	request, _ := http.NewRequest("GET", "http://"+serverAddr+"/admin/metrics/prometheus", nil)
+	testRequest(t, request, 401, "Got metrics without authorization").Body.Close()
+	request.Header.Set("Authorization", "Bearer "+auth.Token)
+	response = testRequest(t, request, 200, "Failed to get metrics")
+	defer response.Body.Close()
+	if ct := response.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected content type %q", ct)
+	}
+	metrics, _ := io.ReadAll(response.Body)
+
+	for _, want := range []string{
+		"# TYPE chirpy_fileserver_hits_total counter\nchirpy_fileserver_hits_total ",
+		`chirpy_http_requests_total{method="GET",route="/api/chirps/{chirpID}",code="200"} `,
+		`chirpy_http_requests_total{method="GET",route="/admin/metrics/prometheus",code="401"} 1`,
+		`chirpy_http_request_duration_seconds_count{method="POST",route="/api/login"} `,
+		`chirpy_db_operation_duration_seconds_bucket{op="create_chirp",le="+Inf"} `,
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("Metrics are missing %q", want)
+		}
+	}
+
+	// Scrapers can use the static token instead of an admin's access token
+	request.Header.Set("Authorization", "Bearer "+testScrapeToken)
+	testRequest(t, request, 200, "Failed to get metrics with the scrape token").Body.Close()
+	request.Header.Set("Authorization", "Bearer "+testScrapeToken+"x")
+	testRequest(t, request, 401, "Got metrics with the wrong scrape token").Body.Close()
+}
+
+func TestRefresh(t *testing.T) {
+	refresh := func(token string, code int) (string, string) {
+		request, err := http.NewRequest("POST", apiAddr+"/refresh", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) > 0 {
+			request.Header.Add("Authorization", "Bearer "+token)
+		}
+		response := testRequest(t, request, code, fmt.Sprintf("Expected refresh status %d", code))
+		defer response.Body.Close()
+		if code == 401 && len(response.Header.Get("WWW-Authenticate")) == 0 {
+			t.Fatal("Rejected refresh without a WWW-Authenticate header")
+		}
+
+		var tokens struct {
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
+		}
+		json.NewDecoder(response.Body).Decode(&tokens)
+		return tokens.Token, tokens.RefreshToken
+	}
+
+	refresh("", 401)
+	token, rotated := refresh(refreshToken, 200)
+	if len(token) == 0 || len(rotated) == 0 || rotated == refreshToken {
+		t.Fatal("Refresh didn't rotate the refresh token")
+	}
+	accessToken = token
+	_, newest := refresh(rotated, 200)
+
+	// Reusing a rotated token revokes the whole family, including the newest token
+	refresh(rotated, 401)
+	refresh(newest, 401)
+	request, _ := http.NewRequest("GET", apiAddr+"/sessions", nil)
+	request.Header.Add("Authorization", "Bearer "+token)
+	testRequest(t, request, 401, "Access token survived reuse of its refresh token").Body.Close()
+
+	body := fmt.Sprintf(`{"password":"%s", "email":"%s"}`, testPW1, testEmail2)
+	response, err := http.Post(apiAddr+"/login", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var auth struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(response.Body).Decode(&auth)
+	refreshToken = auth.RefreshToken
 }
 
 func TestRevoke(t *testing.T) {
@@ -293,11 +999,188 @@ func TestRevoke(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	testRequest(t, request, 401, "Revoke succeeded without authorization")
+	response := testRequest(t, request, 401, "Revoke succeeded without authorization")
+	response.Body.Close()
+	if challenge := response.Header.Get("WWW-Authenticate"); challenge != `Bearer realm="chirpy"` {
+		t.Fatalf("Unexpected WWW-Authenticate header %q", challenge)
+	}
 
 	request.Header.Add("Authorization", "Bearer "+refreshToken)
-	testRequest(t, request, 200, "Revoke failed with authorization")
+	testRequest(t, request, 200, "Revoke failed with authorization").Body.Close()
+	response = testRequest(t, request, 401, "Revoked token twice")
+	response.Body.Close()
+	if challenge := response.Header.Get("WWW-Authenticate"); !strings.Contains(challenge, "has been revoked") {
+		t.Fatalf("Unexpected WWW-Authenticate header %q", challenge)
+	}
 
 	request, _ = http.NewRequest("POST", apiAddr+"/refresh", nil)
-	testRequest(t, request, 401, "Refresh token still valid after revoke")
+	request.Header.Add("Authorization", "Bearer "+refreshToken)
+	testRequest(t, request, 401, "Refresh token still valid after revoke").Body.Close()
+}
+
+func TestSessions(t *testing.T) {
+	request := func(method, url, token string) *http.Request {
+		req, _ := http.NewRequest(method, url, nil)
+		if len(token) > 0 {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		return req
+	}
+	login := func(userAgent string) string {
+		body := fmt.Sprintf(`{"password":"%s", "email":"%s"}`, testPW1, testEmail2)
+		req, _ := http.NewRequest("POST", apiAddr+"/login", bytes.NewBufferString(body))
+		req.Header.Set("User-Agent", userAgent)
+		response := testRequest(t, req, 200, "Login failed")
+		defer response.Body.Close()
+		var auth struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(response.Body).Decode(&auth)
+		return auth.Token
+	}
+	phone, laptop, tablet := login("phone"), login("laptop"), login("tablet")
+
+	testRequest(t, request("GET", apiAddr+"/sessions", ""), 401, "Listed sessions without authorization").Body.Close()
+	response := testRequest(t, request("GET", apiAddr+"/sessions", laptop), 200, "Failed to list sessions")
+	var sessions []struct {
+		ID        int    `json:"id"`
+		UserAgent string `json:"user_agent"`
+		IP        string `json:"ip"`
+		Current   bool   `json:"current"`
+	}
+	json.NewDecoder(response.Body).Decode(&sessions)
+	response.Body.Close()
+
+	ids := map[string]int{}
+	for _, s := range sessions {
+		ids[s.UserAgent] = s.ID
+		if s.Current != (s.UserAgent == "laptop") || s.IP != "127.0.0.1" {
+			t.Fatalf("Unexpected session %+v", s)
+		}
+	}
+	if ids["phone"] == 0 || ids["laptop"] == 0 || ids["tablet"] == 0 {
+		t.Fatalf("Missing sessions in %+v", sessions)
+	}
+
+	// Ending a session cuts off its access tokens immediately
+	sessionAddr := apiAddr + "/sessions/" + fmt.Sprint(ids["phone"])
+	testRequest(t, request("DELETE", sessionAddr, laptop), 200, "Failed to end session").Body.Close()
+	testRequest(t, request("DELETE", sessionAddr, laptop), 404, "Ended session twice").Body.Close()
+	testRequest(t, request("GET", apiAddr+"/sessions", phone), 401, "Used token of ended session").Body.Close()
+	testRequest(t, request("GET", apiAddr+"/sessions", tablet), 200, "Other sessions ended").Body.Close()
+
+	// User 1 is an admin, and only refresh tokens without a session are revoked one by one
+	response = testRequest(t, request("GET", "http://"+serverAddr+"/admin/revocations", laptop), 200, "Failed to get revocation stats")
+	var stats struct {
+		Total   *int `json:"total"`
+		Expired *int `json:"expired"`
+	}
+	json.NewDecoder(response.Body).Decode(&stats)
+	response.Body.Close()
+	if stats.Total == nil || stats.Expired == nil || *stats.Total != 0 {
+		t.Fatalf("Unexpected revocation stats %+v", stats)
+	}
+
+	// Ending a session also closes its WebSocket connections at the next ping
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+serverAddr+"/api/ws?access_token="+tablet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Tokens issued before sessions existed don't belong to one, or have an
+	// audience
+	legacyToken := func(issuer string, issued time.Time) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   "1",
+			IssuedAt:  jwt.NewNumericDate(issued),
+			ExpiresAt: jwt.NewNumericDate(issued.Add(2 * time.Hour)),
+		}).SignedString(testSecret)
+		return token
+	}
+	legacy := legacyToken(AccessIssuer, time.Now().Add(-time.Hour))
+	testRequest(t, request("GET", apiAddr+"/sessions", legacy), 200, "Token without a session was rejected").Body.Close()
+	testRequest(t, request("GET", apiAddr+"/sessions", legacyToken(AccessIssuer, time.Now())), 401,
+		"Token without an audience issued after the cutoff was accepted").Body.Close()
+
+	// and are swapped for tokens that do when they are refreshed
+	legacyRefresh := legacyToken(RefreshIssuer, time.Now().Add(-time.Hour))
+	testRequest(t, request("POST", apiAddr+"/refresh", legacyRefresh), 200, "Failed to refresh token without a session").Body.Close()
+	testRequest(t, request("POST", apiAddr+"/refresh", legacyRefresh), 401, "Refreshed token without a session twice").Body.Close()
+
+	response = testRequest(t, request("DELETE", apiAddr+"/sessions", laptop), 200, "Failed to log out everywhere")
+	var result struct {
+		Ended int `json:"ended"`
+	}
+	json.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+	if result.Ended < 2 {
+		t.Fatalf("Expected at least 2 sessions ended, got %d", result.Ended)
+	}
+	testRequest(t, request("GET", apiAddr+"/sessions", laptop), 401, "Session survived logging out everywhere").Body.Close()
+	testRequest(t, request("GET", apiAddr+"/sessions", tablet), 401, "Session survived logging out everywhere").Body.Close()
+	testRequest(t, request("GET", apiAddr+"/sessions", legacy), 401, "Token without a session survived logging out everywhere").Body.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("Expected the WebSocket to be closed for ending its session, got %v", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	request, _ := http.NewRequest("GET", "http://"+serverAddr+"/.well-known/jwks.json", nil)
+	response := testRequest(t, request, 200, "Failed to get JWKS")
+	defer response.Body.Close()
+
+	// The test server signs with its secret, which is never published
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		t.Fatal(err)
+	}
+	if jwks.Keys == nil || len(jwks.Keys) != 0 {
+		t.Fatalf("Expected an empty key set, got %v", jwks.Keys)
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	body := fmt.Sprintf(`{"password":"%s", "email":"%s"}`, testPW1, testEmail2)
+	response, err := http.Post(apiAddr+"/login", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auth struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(response.Body).Decode(&auth)
+	response.Body.Close()
+
+	tests := []struct {
+		name, url, token, challenge string
+	}{
+		{"no token", apiAddr + "/timeline", "", `Bearer realm="chirpy"`},
+		{"malformed", apiAddr + "/timeline", "garbage", `Bearer realm="chirpy", error="invalid_token", error_description="Malformed authorization token"`},
+		{"refresh as access", apiAddr + "/timeline", auth.RefreshToken, `Bearer realm="chirpy", error="invalid_token", error_description="Invalid authorization issuer"`},
+		{"access as refresh", apiAddr + "/refresh", auth.Token, `Bearer realm="chirpy", error="invalid_token", error_description="Invalid authorization issuer"`},
+	}
+
+	for _, test := range tests {
+		method := "GET"
+		if strings.HasSuffix(test.url, "/refresh") {
+			method = "POST"
+		}
+		request, _ := http.NewRequest(method, test.url, nil)
+		if len(test.token) > 0 {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		response := testRequest(t, request, 401, test.name+" was authorized")
+		response.Body.Close()
+		if challenge := response.Header.Get("WWW-Authenticate"); challenge != test.challenge {
+			t.Fatalf("%s: expected challenge %s, got %s", test.name, test.challenge, challenge)
+		}
+	}
 }